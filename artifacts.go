@@ -0,0 +1,563 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// artifactKind is the kind of distribution kcm downloads and extracts.
+type artifactKind string
+
+const (
+	kafkaArtifact     artifactKind = "kafka"
+	confluentArtifact artifactKind = "confluent"
+	zookeeperArtifact artifactKind = "zookeeper"
+)
+
+var (
+	// The names of the archives published by Apache, the Kafka archives are cached with the same name.
+	kafkaArchivePattern     = regexp.MustCompile(`^kafka_(\d+\.\d+)-(.+)\.tgz$`)
+	zookeeperArchivePattern = regexp.MustCompile(`^apache-zookeeper-(.+)-bin\.tar\.gz$`)
+
+	// The names of the archives in the kcm cache, to import the cache of another machine.
+	legacyKafkaArchivePattern     = regexp.MustCompile(`^kafka_(.+)\.tar\.gz$`)
+	cachedZookeeperArchivePattern = regexp.MustCompile(`^zookeeper-(.+)\.tar\.gz$`)
+)
+
+// parseArchiveName returns the Kafka, Confluent or Zookeeper version of an archive based on its file name.
+// It returns false if the file is not a Kafka or Zookeeper archive.
+func parseArchiveName(name string) (artifactKey, bool) {
+	if m := kafkaArchivePattern.FindStringSubmatch(name); m != nil {
+		return artifactKey{kind: kafkaArtifact, version: m[2], scala: m[1]}, true
+	}
+	if m := legacyKafkaArchivePattern.FindStringSubmatch(name); m != nil {
+		return artifactKey{kind: kafkaArtifact, version: m[1], scala: legacyScalaVersion}, true
+	}
+	if m := zookeeperArchivePattern.FindStringSubmatch(name); m != nil {
+		return artifactKey{kind: zookeeperArtifact, version: m[1]}, true
+	}
+	if m := cachedZookeeperArchivePattern.FindStringSubmatch(name); m != nil {
+		return artifactKey{kind: zookeeperArtifact, version: m[1]}, true
+	}
+	if version, scala, ok := parseConfluentDistName(strings.TrimSuffix(name, ".tar.gz")); ok && strings.HasSuffix(name, ".tar.gz") {
+		return artifactKey{kind: confluentArtifact, version: string(version), scala: scala}, true
+	}
+	return artifactKey{}, false
+}
+
+// makeArtifactCachePath returns the path in the cache of a Kafka or Zookeeper archive, based on its file name.
+// It returns an empty string if the file is not a Kafka or Zookeeper archive.
+func makeArtifactCachePath(name string) string {
+	key, ok := parseArchiveName(name)
+	if !ok {
+		return ""
+	}
+	return key.TarballPath()
+}
+
+// checkTarball reads a whole gzipped tarball to make sure it's not truncated or corrupted.
+func checkTarball(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzf, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gzf)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			// NOTE(vincent): gzip only verifies its checksum at the end of the stream, which tar doesn't always read.
+			_, err := io.Copy(ioutil.Discard, gzf)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// importArtifact copies a Kafka or Zookeeper archive to the cache, as if it was downloaded.
+//
+// If a checksum file in the sha512sum format is next to the archive, the archive is verified against it.
+// It returns the path of the archive in the cache, or an empty string if the same archive was already there.
+func importArtifact(src string) (string, error) {
+	dst := makeArtifactCachePath(filepath.Base(src))
+	if dst == "" {
+		return "", fmt.Errorf("%q is not a Kafka or Zookeeper archive", src)
+	}
+
+	// 1. check it's valid
+
+	sum, err := computeChecksum(src)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(makeChecksumPath(src))
+	switch {
+	case err == nil:
+		expected, err := parseChecksum(string(data))
+		if err != nil {
+			return "", err
+		}
+		if sum != expected {
+			return "", fmt.Errorf("%q is corrupted, its checksum doesn't match %q", src, makeChecksumPath(src))
+		}
+
+	case !os.IsNotExist(err):
+		return "", err
+	}
+
+	if err := checkTarball(src); err != nil {
+		return "", fmt.Errorf("%q is not a valid archive. err: %w", src, err)
+	}
+
+	// 2. nothing to do if it's already in the cache
+
+	if existing, err := computeChecksum(dst); err == nil && existing == sum {
+		return "", nil
+	}
+
+	// 3. copy it next to its final path first so the cache never contains a partial archive
+
+	tmp := dst + ".part"
+
+	if err := copyFile(tmp, src); err != nil {
+		return "", err
+	}
+	if err := recordChecksum(dst, sum); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// artifactKey identifies a version of a Kafka distribution or of Zookeeper.
+type artifactKey struct {
+	kind    artifactKind
+	version string
+	// scala is the Scala version of a Kafka build, it's empty for Zookeeper.
+	scala string
+}
+
+func (k artifactKey) String() string {
+	if k.scala != "" {
+		return fmt.Sprintf("%s %s (Scala %s)", k.kind, k.version, k.scala)
+	}
+	return fmt.Sprintf("%s %s", k.kind, k.version)
+}
+
+func (k artifactKey) TarballPath() string {
+	if dist := getKafkaDistributionByKind(k.kind); dist != nil {
+		return dist.TarballPath(KafkaVersion(k.version), k.scala)
+	}
+	return makeZookeeperTarballPath(k.version)
+}
+
+func (k artifactKey) ExtractedPath() string {
+	if dist := getKafkaDistributionByKind(k.kind); dist != nil {
+		return dist.ExtractedPath(KafkaVersion(k.version), k.scala)
+	}
+	return makeZookeeperExtractedPath(k.version)
+}
+
+// artifact is a version of Kafka or Zookeeper, either cached, extracted or used by a cluster or Zookeeper.
+type artifact struct {
+	artifactKey
+
+	// The sizes are -1 if the archive is not cached or not extracted.
+	tarballSize   int64
+	extractedSize int64
+
+	// partial is true if an interrupted download is in the cache.
+	partial bool
+
+	// The clusters using a Kafka version or the Zookeeper ensembles using a Zookeeper version.
+	usedBy []string
+}
+
+func (a artifact) IsCached() bool    { return a.tarballSize >= 0 }
+func (a artifact) IsExtracted() bool { return a.extractedSize >= 0 }
+func (a artifact) IsUsed() bool      { return len(a.usedBy) > 0 }
+
+// getArtifactUsers returns the clusters using each Kafka version and the Zookeeper ensembles using each Zookeeper version.
+func getArtifactUsers(ctx context.Context) (map[artifactKey][]string, error) {
+	res := make(map[artifactKey][]string)
+
+	clusters, err := listClusterVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range clusters {
+		if cluster.Custom != nil {
+			continue
+		}
+
+		key := artifactKey{kind: clusterDistribution(cluster).Kind, version: string(cluster.Version), scala: cluster.ScalaVersion}
+		res[key] = append(res[key], string(cluster.Name))
+	}
+
+	zookeepers, err := listZookeepers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, zookeeper := range zookeepers {
+		key := artifactKey{kind: zookeeperArtifact, version: zookeeper.Version}
+		res[key] = append(res[key], zookeeper.Name)
+	}
+
+	return res, nil
+}
+
+// findArtifacts returns the versions of Kafka and Zookeeper in the cache, extracted or used, sorted by kind and version.
+func findArtifacts(users map[artifactKey][]string) ([]artifact, error) {
+	artifacts := make(map[artifactKey]*artifact)
+
+	get := func(key artifactKey) *artifact {
+		a, ok := artifacts[key]
+		if !ok {
+			a = &artifact{
+				artifactKey:   key,
+				tarballSize:   -1,
+				extractedSize: -1,
+			}
+			artifacts[key] = a
+		}
+		return a
+	}
+
+	// 1. the archives in the cache
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".part")
+		partial := name != entry.Name()
+
+		key, ok := parseArchiveName(name)
+		if !ok {
+			continue
+		}
+		a := get(key)
+
+		if partial {
+			a.partial = true
+		} else {
+			a.tarballSize = entry.Size()
+		}
+	}
+
+	// 2. the extracted distributions.
+	// NOTE(vincent): clusters also have their directory in dataDir, a cluster can be named like a distribution.
+
+	entries, err = ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		var a *artifact
+		for _, dist := range kafkaDistributions {
+			version, scala, ok := dist.ParseDistName(entry.Name())
+			if ok && isDir(filepath.Join(dataDir, entry.Name(), dist.ClasspathRoots[0])) {
+				a = get(artifactKey{kind: dist.Kind, version: string(version), scala: scala})
+			}
+		}
+		if strings.HasPrefix(entry.Name(), "zookeeper_") && isDir(filepath.Join(dataDir, entry.Name(), "lib")) {
+			a = get(artifactKey{kind: zookeeperArtifact, version: strings.TrimPrefix(entry.Name(), "zookeeper_")})
+		}
+		if a == nil {
+			continue
+		}
+
+		a.extractedSize, err = dirSize(filepath.Join(dataDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. the versions used, they may be neither cached nor extracted
+
+	for key, names := range users {
+		a := get(key)
+		a.usedBy = names
+		sort.Strings(a.usedBy)
+	}
+
+	res := make([]artifact, 0, len(artifacts))
+	for _, a := range artifacts {
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].kind != res[j].kind {
+			return res[i].kind < res[j].kind
+		}
+		if res[i].version != res[j].version {
+			return compareVersions(res[i].version, res[j].version) < 0
+		}
+		return compareVersions(res[i].scala, res[j].scala) < 0
+	})
+
+	return res, nil
+}
+
+// removeUnusedArtifact removes the archive, its checksum, an interrupted download and the extracted distribution of a version.
+// It returns false without removing anything if a cluster or a Zookeeper ensemble uses the version.
+//
+// NOTE(vincent): the users are checked again with the artifact lock held, the lock held by start
+// while it installs a version makes sure a cluster created since the version was found never loses it.
+func removeUnusedArtifact(a artifact) (bool, error) {
+	lock, err := acquireLock(makeArtifactLockName(a.ExtractedPath()))
+	if err != nil {
+		return false, err
+	}
+	defer lock.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	users, err := getArtifactUsers(ctx)
+	if err != nil {
+		return false, err
+	}
+	if len(users[a.artifactKey]) > 0 {
+		return false, nil
+	}
+
+	tarballPath := a.TarballPath()
+
+	for _, path := range []string{tarballPath, makeChecksumPath(tarballPath), tarballPath + ".part"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return true, os.RemoveAll(a.ExtractedPath())
+}
+
+// compareVersions compares two versions like 2.6.0 and 2.10.1 number by number.
+// Parts which are not numbers, like in 3.0.0-rc1, are compared as strings.
+// It returns -1 if a comes before b, 1 if it comes after and 0 if they're equal.
+func compareVersions(a, b string) int {
+	as := strings.FieldsFunc(a, isVersionSeparator)
+	bs := strings.FieldsFunc(b, isVersionSeparator)
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+
+		switch {
+		case aErr == nil && bErr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+
+	// A release candidate like 3.0.0-rc1 comes before 3.0.0, a patch like 0.10.2.1 after 0.10.2.
+
+	isPreRelease := func(parts []string, i int) bool {
+		_, err := strconv.Atoi(parts[i])
+		return err != nil
+	}
+
+	switch {
+	case len(as) < len(bs) && isPreRelease(bs, len(as)):
+		return 1
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs) && isPreRelease(as, len(bs)):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isVersionSeparator(r rune) bool {
+	return r == '.' || r == '-'
+}
+
+func dirSize(path string) (int64, error) {
+	var res int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			res += fi.Size()
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+//
+// Bundles
+//
+
+// exportArtifacts writes the archives of the artifacts with their checksums to a tar file,
+// which can be imported with importBundle on another machine.
+func exportArtifacts(dst string, artifacts []artifact) error {
+	tmp := dst + ".part"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	addFile := func(name string, size int64, r io.Reader) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    size,
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+
+	for _, a := range artifacts {
+		path := a.TarballPath()
+
+		// 1. don't spread a corrupted archive
+
+		if err := verifyArtifact(path); err != nil {
+			return err
+		}
+		sum, err := computeChecksum(path)
+		if err != nil {
+			return err
+		}
+
+		// 2. add the archive and its checksum
+
+		tarball, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = addFile(filepath.Base(path), a.tarballSize, tarball)
+		tarball.Close()
+		if err != nil {
+			return fmt.Errorf("unable to add %s. err: %w", path, err)
+		}
+
+		checksum := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+		if err := addFile(filepath.Base(makeChecksumPath(path)), int64(len(checksum)), strings.NewReader(checksum)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// isBundle returns true if the file is a bundle written by exportArtifacts.
+func isBundle(path string) bool {
+	return strings.HasSuffix(path, ".tar")
+}
+
+// extractBundle extracts a bundle written by exportArtifacts to dir.
+func extractBundle(dir, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%q is not a valid bundle. err: %w", src, err)
+		}
+
+		// NOTE(vincent): a bundle only contains files at its root, anything else didn't come from kcm.
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Name != filepath.Base(hdr.Name) {
+			return fmt.Errorf("%q is not a valid bundle, unexpected entry %q", src, hdr.Name)
+		}
+
+		out, err := os.Create(filepath.Join(dir, hdr.Name))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// catalogMaxAge is the age after which the catalog is refreshed from the mirrors.
+const catalogMaxAge = 24 * time.Hour
+
+// catalogRefreshTimeout is the time to wait for the mirrors when refreshing the catalog.
+// NOTE(vincent): it's refreshed implicitly by commands like create, which must not hang when the network is down.
+const catalogRefreshTimeout = 10 * time.Second
+
+func makeKafkaCatalogPath() string {
+	return filepath.Join(cacheDir, "kafka-versions")
+}
+
+func makeZookeeperCatalogPath() string {
+	return filepath.Join(cacheDir, "zookeeper-versions")
+}
+
+// kafkaCatalog is the list of the Kafka versions published by Apache.
+type kafkaCatalog struct {
+	// versions is sorted from the oldest to the newest.
+	versions []KafkaVersion
+}
+
+func newKafkaCatalog(versions []KafkaVersion) kafkaCatalog {
+	seen := make(map[KafkaVersion]bool)
+
+	var res kafkaCatalog
+	for _, version := range versions {
+		if !seen[version] {
+			seen[version] = true
+			res.versions = append(res.versions, version)
+		}
+	}
+
+	sort.Slice(res.versions, func(i, j int) bool {
+		return compareVersions(string(res.versions[i]), string(res.versions[j])) < 0
+	})
+
+	return res
+}
+
+func (c kafkaCatalog) Contains(version KafkaVersion) bool {
+	for _, v := range c.versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Latest returns the newest release, or an empty string if the catalog is empty.
+func (c kafkaCatalog) Latest() KafkaVersion {
+	for i := len(c.versions) - 1; i >= 0; i-- {
+		if isRelease(c.versions[i]) {
+			return c.versions[i]
+		}
+	}
+	return ""
+}
+
+// LatestPatch returns the newest release of a minor version like 2.6, or an empty string if there's none.
+func (c kafkaCatalog) LatestPatch(minor string) KafkaVersion {
+	for i := len(c.versions) - 1; i >= 0; i-- {
+		if isRelease(c.versions[i]) && minorVersion(c.versions[i]) == minor {
+			return c.versions[i]
+		}
+	}
+	return ""
+}
+
+// LTS returns the newest release of the minor version before the latest one.
+//
+// Kafka has no long term support releases, the previous minor version is the one
+// most likely to run in production and still receive fixes.
+func (c kafkaCatalog) LTS() KafkaVersion {
+	latest := c.Latest()
+	for i := len(c.versions) - 1; i >= 0; i-- {
+		if isRelease(c.versions[i]) && minorVersion(c.versions[i]) != minorVersion(latest) {
+			return c.versions[i]
+		}
+	}
+	return ""
+}
+
+// Resolve returns the version matching a version or an alias:
+//   - latest: the newest release
+//   - lts: the newest release of the previous minor version
+//   - a minor version like 2.6: its newest release
+func (c kafkaCatalog) Resolve(version string) (KafkaVersion, error) {
+	var res KafkaVersion
+
+	switch {
+	case version == "latest":
+		res = c.Latest()
+	case version == "lts":
+		res = c.LTS()
+	case c.Contains(KafkaVersion(version)):
+		return KafkaVersion(version), nil
+	case minorVersionPattern.MatchString(version):
+		res = c.LatestPatch(version)
+	}
+
+	if res == "" {
+		return "", fmt.Errorf("unknown Kafka version %q, use \"kcm versions -available\" to list the versions available", version)
+	}
+
+	return res, nil
+}
+
+var (
+	minorVersionPattern = regexp.MustCompile(`^\d+\.\d+$`)
+	releasePattern      = regexp.MustCompile(`^\d+\.\d+\.\d+(\.\d+)?$`)
+)
+
+// isRelease returns false for the release candidates and other unusual versions.
+func isRelease(version KafkaVersion) bool {
+	return releasePattern.MatchString(string(version))
+}
+
+func minorVersion(version KafkaVersion) string {
+	parts := strings.SplitN(string(version), ".", 3)
+	if len(parts) < 2 {
+		return string(version)
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// loadKafkaCatalog loads the catalog of Kafka versions.
+//
+// The catalog is cached and refreshed from the mirrors once it's older than catalogMaxAge, or if refresh is true.
+// If it can't be refreshed in catalogRefreshTimeout the cached catalog is used, even if it's too old.
+// The versions already in the cache or extracted are always part of the catalog, so kcm can be used offline.
+func loadKafkaCatalog(refresh bool) (kafkaCatalog, error) {
+	published, err := loadPublishedVersions(makeKafkaCatalogPath(), "Kafka", "/kafka/", "", refresh)
+	if err != nil {
+		return kafkaCatalog{}, err
+	}
+
+	var versions []KafkaVersion
+	for _, version := range published {
+		versions = append(versions, KafkaVersion(version))
+	}
+
+	artifacts, err := findArtifacts(nil)
+	if err != nil {
+		return kafkaCatalog{}, err
+	}
+	for _, a := range artifacts {
+		if a.kind == kafkaArtifact && (a.IsCached() || a.IsExtracted()) {
+			versions = append(versions, KafkaVersion(a.version))
+		}
+	}
+
+	return newKafkaCatalog(versions), nil
+}
+
+// loadZookeeperVersions loads the Zookeeper versions published by Apache, sorted from the oldest to the newest.
+// It's cached and refreshed like the catalog of Kafka versions, the versions already in the cache or extracted are always part of it.
+func loadZookeeperVersions(refresh bool) ([]string, error) {
+	versions, err := loadPublishedVersions(makeZookeeperCatalogPath(), "Zookeeper", "/zookeeper/", "zookeeper-", refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts, err := findArtifacts(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range artifacts {
+		if a.kind == zookeeperArtifact && (a.IsCached() || a.IsExtracted()) && !containsString(versions, a.version) {
+			versions = append(versions, a.version)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+
+	return versions, nil
+}
+
+// loadPublishedVersions returns the versions of a project cached at path, refreshing them from the directory of the mirrors if necessary.
+// The entries of the directory are the prefix followed by a version.
+func loadPublishedVersions(path, project, dir, prefix string, refresh bool) ([]string, error) {
+	// 1. refresh it if necessary
+
+	fi, err := os.Stat(path)
+	cached := err == nil
+
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	case err != nil:
+		refresh = true
+	case time.Since(fi.ModTime()) > catalogMaxAge:
+		refresh = true
+	}
+
+	if refresh && !*globalOffline {
+		ctx, cancel := context.WithTimeout(context.Background(), catalogRefreshTimeout)
+		defer cancel()
+
+		if err := refreshPublishedVersions(ctx, path, project, dir, prefix); err != nil {
+			if cached {
+				log.Printf("unable to refresh the catalog of %s versions, using the cached one. err: %v", project, err)
+			} else {
+				log.Printf("unable to get the catalog of %s versions, only the versions in the cache are known. err: %v", project, err)
+			}
+		}
+	}
+
+	// 2. read it
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var res []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			res = append(res, line)
+		}
+	}
+
+	return res, nil
+}
+
+// refreshPublishedVersions downloads the list of versions of a project from the mirrors and caches it at path.
+func refreshPublishedVersions(ctx context.Context, path, project, dir, prefix string) error {
+	d, err := newDownloader()
+	if err != nil {
+		return err
+	}
+
+	versions, err := d.FetchIndex(ctx, dir, prefix)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("no %s version found", project)
+	}
+
+	data := strings.Join(versions, "\n") + "\n"
+
+	// Write it next to its final path first so the catalog is never partial.
+
+	tmp := path + ".part"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// FetchIndex returns the entries of a directory listing of the mirrors, like /kafka/ which contains every version of Kafka.
+// Only the entries made of the prefix followed by a version are returned, without the prefix.
+//
+// NOTE(vincent): the Apache servers and most mirrors serve an HTML listing of their directories, there's no proper index.
+func (d *downloader) FetchIndex(ctx context.Context, dir, prefix string) ([]string, error) {
+	if d.offline {
+		return nil, fmt.Errorf("kcm is offline")
+	}
+
+	pattern := regexp.MustCompile(`href="` + regexp.QuoteMeta(prefix) + `(\d[^"/]*)/"`)
+
+	var err error
+	for _, u := range d.indexURLs(dir) {
+		var res []string
+		res, err = d.fetchIndexFrom(ctx, u, pattern)
+		if err == nil {
+			return res, nil
+		}
+
+		log.Printf("unable to get index %s. err: %v", u, err)
+	}
+
+	return nil, err
+}
+
+// indexURLs returns the URLs of the directory listing of a directory, in order.
+func (d *downloader) indexURLs(dir string) []string {
+	if len(d.mirrors) == 0 {
+		return []string{apacheArchiveURL + dir}
+	}
+
+	res := make([]string, 0, len(d.mirrors))
+	for _, mirror := range d.mirrors {
+		res = append(res, mirror+dir)
+	}
+	return res
+}
+
+func (d *downloader) fetchIndexFrom(ctx context.Context, u string, pattern *regexp.Regexp) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, m := range pattern.FindAllStringSubmatch(string(data), -1) {
+		res = append(res, m[1])
+	}
+
+	return res, nil
+}
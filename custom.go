@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// customSource is where a custom distribution of Kafka comes from.
+type customSource string
+
+const (
+	// customDir is an extracted distribution, like a local build of Kafka. It's used in place.
+	customDir customSource = "dir"
+	// customTarball is a tarball of a distribution on the local file system.
+	customTarball customSource = "tarball"
+	// customURL is a tarball of a distribution downloaded from any URL.
+	customURL customSource = "url"
+)
+
+// CustomDistribution is a build of Kafka which doesn't come from the Apache releases, like a local build or a release candidate.
+type CustomDistribution struct {
+	Name   string
+	Source customSource
+	// Location is the path or the URL of the distribution.
+	Location string
+}
+
+func (d CustomDistribution) String() string {
+	return fmt.Sprintf("%s (%s %s)", d.Name, d.Source, d.Location)
+}
+
+// ExtractedPath returns the path of the extracted distribution, the directory itself for a custom directory.
+func (d CustomDistribution) ExtractedPath() string {
+	if d.Source == customDir {
+		return d.Location
+	}
+	return filepath.Join(dataDir, "custom", d.Name)
+}
+
+// TarballPath returns the path of the tarball of the distribution, or an empty string for a custom directory.
+func (d CustomDistribution) TarballPath() string {
+	switch d.Source {
+	case customTarball:
+		return d.Location
+	case customURL:
+		return filepath.Join(cacheDir, "custom", d.Name+".tgz")
+	default:
+		return ""
+	}
+}
+
+// newCustomDistribution creates a custom distribution from a directory, a tarball or a URL, laid out like dist.
+// If name is empty the name of the directory or the tarball is used.
+func newCustomDistribution(name string, source customSource, location string, dist *kafkaDistribution) (CustomDistribution, error) {
+	res := CustomDistribution{
+		Name:     name,
+		Source:   source,
+		Location: location,
+	}
+
+	// 1. normalize the location and check it's usable
+
+	switch source {
+	case customDir, customTarball:
+		p, err := filepath.Abs(location)
+		if err != nil {
+			return res, err
+		}
+		res.Location = p
+
+		if source == customDir {
+			if root := dist.ClasspathRoots[0]; !isDir(filepath.Join(p, root)) {
+				return res, fmt.Errorf("%q is not a %s distribution, it has no %s directory", p, dist.Name, root)
+			}
+		} else if !fileExists(p) {
+			return res, fmt.Errorf("tarball %q doesn't exist", p)
+		}
+
+	case customURL:
+		u, err := url.Parse(location)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return res, fmt.Errorf("invalid URL %q, must be a http or https URL", location)
+		}
+	}
+
+	// 2. derive the name from the location
+
+	if res.Name == "" {
+		res.Name = customDistributionBaseName(res.Location)
+	}
+	if res.Name == "" || strings.ContainsAny(res.Name, `/\`) || res.Name[0] == '.' {
+		return res, fmt.Errorf("invalid custom distribution name %q", res.Name)
+	}
+
+	return res, nil
+}
+
+// customDistributionBaseName returns the name of a directory, a tarball or a URL without the tarball extension,
+// like kafka_2.13-3.0.0 for https://example.com/kafka_2.13-3.0.0.tgz.
+func customDistributionBaseName(location string) string {
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" {
+		location = u.Path
+	}
+
+	name := path.Base(filepath.ToSlash(location))
+	for _, ext := range []string{".tgz", ".tar.gz"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+var customVersionPattern = regexp.MustCompile(`^kafka-(\d.*)$`)
+
+// parseCustomDistributionName returns the version and the Scala version of a distribution from its name if possible.
+// Both the Apache names like kafka_2.13-3.0.0 and names like kafka-3.0.0-rc1 are supported, the latter without a Scala version.
+func parseCustomDistributionName(name string) (KafkaVersion, string) {
+	if m := kafkaDistNamePattern.FindStringSubmatch(name); m != nil {
+		return KafkaVersion(m[2]), m[1]
+	}
+	if m := customVersionPattern.FindStringSubmatch(name); m != nil {
+		return KafkaVersion(m[1]), ""
+	}
+	return "", ""
+}
+
+// installCustomDistribution downloads and extracts a custom distribution if necessary.
+func installCustomDistribution(dist CustomDistribution) error {
+	extractedPath := dist.ExtractedPath()
+
+	if dist.Source == customDir {
+		if !isDir(extractedPath) {
+			return fmt.Errorf("custom distribution %s doesn't exist anymore", dist)
+		}
+		return nil
+	}
+
+	lock, err := acquireLock(makeArtifactLockName(extractedPath))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if isDir(extractedPath) {
+		return nil
+	}
+
+	// 1. download the tarball if necessary
+
+	tarball := dist.TarballPath()
+
+	if dist.Source == customURL && !fileExists(tarball) {
+		d, err := newDownloader()
+		if err != nil {
+			return err
+		}
+		if err := d.DownloadURL(tarball, dist.Location); err != nil {
+			return fmt.Errorf("unable to download custom distribution %s. err: %w", dist.Name, err)
+		}
+	}
+
+	// 2. extract it
+
+	if err := checkTarball(tarball); err != nil {
+		return fmt.Errorf("invalid tarball for custom distribution %s. err: %w", dist.Name, err)
+	}
+
+	log.Printf("extracting custom distribution %s", dist.Name)
+
+	if err := extractTarball(extractedPath, tarball); err != nil {
+		return fmt.Errorf("unable to extract custom distribution %s. err: %w", dist.Name, err)
+	}
+
+	return nil
+}
+
+// removeCustomDistributionFiles removes the files kcm created for a custom distribution.
+// A custom directory is never removed, it doesn't belong to kcm.
+func removeCustomDistributionFiles(dist CustomDistribution) error {
+	if dist.Source == customDir {
+		return nil
+	}
+
+	if err := os.RemoveAll(dist.ExtractedPath()); err != nil {
+		return err
+	}
+
+	if dist.Source == customURL {
+		for _, p := range []string{dist.TarballPath(), dist.TarballPath() + ".part", makeChecksumPath(dist.TarballPath())} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//
+// Helpers used for the clusters, whether they use a custom distribution or not.
+//
+
+// makeClusterKafkaPath returns the path of the Kafka distribution used by a cluster.
+func makeClusterKafkaPath(cluster Cluster) string {
+	if cluster.Custom != nil {
+		return cluster.Custom.ExtractedPath()
+	}
+	return clusterDistribution(cluster).ExtractedPath(cluster.Version, cluster.ScalaVersion)
+}
+
+// installClusterKafka downloads and extracts the Kafka distribution used by a cluster if necessary.
+func installClusterKafka(cluster Cluster) error {
+	if cluster.Custom != nil {
+		return installCustomDistribution(*cluster.Custom)
+	}
+	return installKafka(clusterDistribution(cluster), cluster.Version, cluster.ScalaVersion)
+}
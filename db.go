@@ -2,21 +2,36 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 )
 
-func getZookeeperStatus(ctx context.Context) (zookeeperStatus, error) {
+func getZookeeperNodeStatus(ctx context.Context, zookeeper Zookeeper, node ZookeeperNode) (zookeeperNodeStatus, error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	stmt := conn.Prep(`SELECT process_id FROM zookeeper_status LIMIT 1`)
+	var status zookeeperNodeStatus
+	status.zookeeper = zookeeper
+	status.node = node
+
+	stmt := conn.Prep(`SELECT s.process_id, p.start_time, p.cmdline, p.marker
+				FROM zookeeper_node_status s
+				LEFT JOIN process p ON p.id = s.process_id
+				WHERE s.zookeeper_id = $zookeeper_id
+				AND s.node_id = $node_id`)
+	stmt.SetInt64("$zookeeper_id", int64(zookeeper.ID))
+	stmt.SetInt64("$node_id", int64(node.ID))
 
-	var status zookeeperStatus
 	for {
 		if hasNext, err := stmt.Step(); err != nil {
 			return status, err
@@ -24,191 +39,202 @@ func getZookeeperStatus(ctx context.Context) (zookeeperStatus, error) {
 			break
 		}
 
-		status.pid = int(stmt.GetInt64("process_id"))
+		status.process = getProcessIdentityFromStmt(stmt)
 	}
 
 	return status, nil
 }
 
-func setZookeeperStatus(ctx context.Context, status zookeeperStatus) error {
+func setZookeeperNodeStatus(ctx context.Context, status zookeeperNodeStatus) (err error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	stmt := conn.Prep(`INSERT INTO zookeeper_status(process_id) VALUES ($process_id)`)
-	stmt.SetInt64("$process_id", int64(status.pid))
-
-	_, err := stmt.Step()
-	return err
-}
+	defer sqlitex.Save(conn)(&err)
 
-func removeZookeeperStatus(ctx context.Context) error {
-	conn := pool.Get(ctx)
-	defer pool.Put(conn)
+	if err := insertProcess(conn, status.process); err != nil {
+		return err
+	}
 
-	stmt := conn.Prep(`DELETE FROM zookeeper_status`)
+	stmt := conn.Prep(`INSERT INTO zookeeper_node_status(process_id, zookeeper_id, node_id) VALUES ($process_id, $zookeeper_id, $node_id)`)
+	stmt.SetInt64("$process_id", int64(status.process.pid))
+	stmt.SetInt64("$zookeeper_id", int64(status.zookeeper.ID))
+	stmt.SetInt64("$node_id", int64(status.node.ID))
 
-	_, err := stmt.Step()
+	_, err = stmt.Step()
 	return err
 }
 
-func getBrokerStatus(ctx context.Context, cluster Cluster, broker Broker) (brokerStatus, error) {
+func removeZookeeperNodeStatus(ctx context.Context, zookeeper Zookeeper, node ZookeeperNode) (err error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	var status brokerStatus
-	status.cluster = cluster
-	status.broker = broker
-
-	stmt := conn.Prep(`SELECT process_id FROM broker_status
-				WHERE cluster_id = $cluster_id
-				AND broker_id = $broker_id`)
-	stmt.SetInt64("$cluster_id", int64(cluster.ID))
-	stmt.SetInt64("$broker_id", int64(broker.ID))
+	defer sqlitex.Save(conn)(&err)
 
-	for {
-		if hasNext, err := stmt.Step(); err != nil {
-			return status, err
-		} else if !hasNext {
-			break
-		}
+	stmt := conn.Prep(`DELETE FROM process WHERE id IN (
+				SELECT process_id FROM zookeeper_node_status
+				WHERE zookeeper_id = $zookeeper_id
+				AND node_id = $node_id)`)
+	stmt.SetInt64("$zookeeper_id", int64(zookeeper.ID))
+	stmt.SetInt64("$node_id", int64(node.ID))
 
-		status.pid = int(stmt.GetInt64("process_id"))
+	if _, err := stmt.Step(); err != nil {
+		return err
 	}
 
-	return status, nil
-}
-
-func setBrokerStatus(ctx context.Context, status brokerStatus) error {
-	conn := pool.Get(ctx)
-	defer pool.Put(conn)
-
-	stmt := conn.Prep(`INSERT INTO broker_status(process_id, cluster_id, broker_id) VALUES ($process_id, $cluster_id, $broker_id)`)
-	stmt.SetInt64("$process_id", int64(status.pid))
-	stmt.SetInt64("$cluster_id", int64(status.cluster.ID))
-	stmt.SetInt64("$broker_id", int64(status.broker.ID))
+	stmt = conn.Prep(`DELETE FROM zookeeper_node_status
+				WHERE zookeeper_id = $zookeeper_id
+				AND node_id = $node_id`)
+	stmt.SetInt64("$zookeeper_id", int64(zookeeper.ID))
+	stmt.SetInt64("$node_id", int64(node.ID))
 
-	_, err := stmt.Step()
+	_, err = stmt.Step()
 	return err
 }
 
-func removeBrokerStatus(ctx context.Context, cluster Cluster, broker Broker) error {
+func createZookeeper(ctx context.Context, zookeeper Zookeeper) (err error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	stmt := conn.Prep(`DELETE FROM broker_status
-				WHERE cluster_id = $cluster_id
-				AND broker_id = $broker_id`)
-	stmt.SetInt64("$cluster_id", int64(cluster.ID))
-	stmt.SetInt64("$broker_id", int64(broker.ID))
+	defer sqlitex.Save(conn)(&err)
 
-	_, err := stmt.Step()
+	_, err = insertZookeeper(conn, zookeeper)
 	return err
 }
 
-func createCluster(ctx context.Context, cluster Cluster) (err error) {
-	conn := pool.Get(ctx)
-	defer pool.Put(conn)
-
-	defer sqlitex.Save(conn)(&err)
+func insertZookeeper(conn *sqlite.Conn, zookeeper Zookeeper) (int64, error) {
+	// NOTE(vincent): addr and data_dir are those of the first node.
+	// They predate ensembles and are only kept for compatibility.
 
-	// Create cluster row
-	stmt := conn.Prep(`INSERT INTO cluster(name, version) VALUES($name, $version)`)
-	stmt.SetText("$name", string(cluster.Name))
-	stmt.SetText("$version", string(cluster.Version))
+	stmt := conn.Prep(`INSERT INTO zookeeper(name, kind, version, four_letter_words, addr, data_dir)
+				VALUES($name, $kind, $version, $four_letter_words, $addr, $data_dir)`)
+	stmt.SetText("$name", zookeeper.Name)
+	stmt.SetText("$kind", string(zookeeper.Kind))
+	stmt.SetText("$four_letter_words", zookeeper.FourLetterWords)
+	stmt.SetText("$version", zookeeper.Version)
+	stmt.SetText("$addr", zookeeper.Nodes[0].Addr.String())
+	stmt.SetText("$data_dir", zookeeper.Nodes[0].DataDir)
 
 	if _, err := stmt.Step(); err != nil {
-		return err
+		return 0, err
 	}
 
 	id := conn.LastInsertRowID()
 
-	// Create brokers
-
-	for _, broker := range cluster.Brokers {
-		stmt := conn.Prep(`INSERT INTO broker(id, cluster_id, addr) VALUES($id, $cluster_id, $addr)`)
-
-		stmt.SetInt64("$id", int64(broker.ID))
-		stmt.SetInt64("$cluster_id", id)
-		stmt.SetText("$addr", broker.Addr.String())
+	for _, node := range zookeeper.Nodes {
+		stmt := conn.Prep(`INSERT INTO zookeeper_node(id, zookeeper_id, addr, peer_port, election_port, admin_port, data_dir)
+					VALUES($id, $zookeeper_id, $addr, $peer_port, $election_port, $admin_port, $data_dir)`)
+		stmt.SetInt64("$id", int64(node.ID))
+		stmt.SetInt64("$zookeeper_id", id)
+		stmt.SetText("$addr", node.Addr.String())
+		stmt.SetInt64("$peer_port", int64(node.PeerPort))
+		stmt.SetInt64("$election_port", int64(node.ElectionPort))
+		stmt.SetInt64("$admin_port", int64(node.AdminPort))
+		stmt.SetText("$data_dir", node.DataDir)
 
 		if _, err := stmt.Step(); err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return
+	return id, nil
 }
 
-func removeCluster(ctx context.Context, cluster Cluster) (err error) {
+func removeZookeeper(ctx context.Context, zookeeper Zookeeper) (err error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
 	defer sqlitex.Save(conn)(&err)
 
-	stmt := conn.Prep(`DELETE FROM broker WHERE cluster_id = $cluster_id`)
-	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+	for _, q := range []string{
+		`DELETE FROM zookeeper_node_status WHERE zookeeper_id = $zookeeper_id`,
+		`DELETE FROM zookeeper_node WHERE zookeeper_id = $zookeeper_id`,
+		`DELETE FROM zookeeper WHERE id = $zookeeper_id`,
+	} {
+		stmt := conn.Prep(q)
+		stmt.SetInt64("$zookeeper_id", int64(zookeeper.ID))
 
-	if _, err = stmt.Step(); err != nil {
-		return err
+		if _, err = stmt.Step(); err != nil {
+			return err
+		}
 	}
 
-	stmt = conn.Prep(`DELETE FROM cluster WHERE id = $id`)
-	stmt.SetInt64("$id", int64(cluster.ID))
-
-	_, err = stmt.Step()
-	return err
+	return nil
 }
 
-func getFirstClusterFromStmt(stmt *sqlite.Stmt) (*Cluster, error) {
-	clusters, err := getClustersFromStmt(stmt)
-	if err != nil {
-		return nil, err
-	}
-	if len(clusters) == 0 {
-		return nil, nil
-	}
-	return &clusters[0], nil
+func setZookeeperJavaHome(ctx context.Context, zookeeper Zookeeper, javaHome string) error {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	stmt := conn.Prep(`UPDATE zookeeper SET java_home = $java_home WHERE id = $id`)
+	stmt.SetText("$java_home", javaHome)
+	stmt.SetInt64("$id", int64(zookeeper.ID))
+
+	_, err := stmt.Step()
+	return err
 }
 
-func getCluster(ctx context.Context, name ClusterName) (*Cluster, error) {
+// findZookeeperCluster returns the name of a cluster using the Zookeeper, or an empty name if none does.
+func findZookeeperCluster(ctx context.Context, zookeeper Zookeeper) (ClusterName, error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	stmt := conn.Prep(`SELECT b.id AS broker_id, b.addr, c.name, c.id AS cluster_id, c.version
-				FROM cluster c INNER JOIN broker b ON b.cluster_id = c.id
-				WHERE c.name = $name`)
-	stmt.SetText("$name", string(name))
+	var res ClusterName
+	err := sqlitex.Exec(conn, `SELECT c.name FROM cluster c
+				INNER JOIN cluster_zookeeper cz ON cz.cluster_id = c.id
+				WHERE cz.zookeeper_id = ? ORDER BY c.name LIMIT 1`, func(stmt *sqlite.Stmt) error {
+		res = ClusterName(stmt.ColumnText(0))
+		return nil
+	}, zookeeper.ID)
 
-	return getFirstClusterFromStmt(stmt)
+	return res, err
 }
 
-func searchClusters(ctx context.Context, pattern string) ([]Cluster, error) {
+func getZookeeper(ctx context.Context, name string) (*Zookeeper, error) {
 	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	const q = `SELECT b.id AS broker_id, b.addr, c.name, c.id AS cluster_id, c.version
-			FROM cluster c INNER JOIN broker b ON b.cluster_id = c.id`
+	return getZookeeperConn(conn, name)
+}
 
-	var stmt *sqlite.Stmt
-	switch {
-	case pattern != "":
-		stmt = conn.Prep(q + ` WHERE c.name LIKE $pattern`)
-		stmt.SetText("$pattern", "%"+pattern+"%")
+func getZookeeperConn(conn *sqlite.Conn, name string) (*Zookeeper, error) {
+	stmt := conn.Prep(zookeepersQuery + ` WHERE z.name = $name`)
+	stmt.SetText("$name", name)
 
-	default:
-		stmt = conn.Prep(q)
+	zookeepers, err := getZookeepersFromStmt(stmt)
+	if err != nil {
+		return nil, err
+	}
+	if len(zookeepers) == 0 {
+		return nil, nil
 	}
+	return &zookeepers[0], nil
+}
+
+func listZookeepers(ctx context.Context) ([]Zookeeper, error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
 
-	return getClustersFromStmt(stmt)
+	return listZookeepersConn(conn)
 }
 
-func getClustersFromStmt(stmt *sqlite.Stmt) ([]Cluster, error) {
+func listZookeepersConn(conn *sqlite.Conn) ([]Zookeeper, error) {
+	stmt := conn.Prep(zookeepersQuery)
+
+	return getZookeepersFromStmt(stmt)
+}
+
+const zookeepersQuery = `SELECT z.id, z.name, z.kind, z.version, z.four_letter_words, z.java_home,
+			n.id AS node_id, n.addr, n.peer_port, n.election_port, n.admin_port, n.data_dir
+			FROM zookeeper z
+			INNER JOIN zookeeper_node n ON n.zookeeper_id = z.id`
+
+func getZookeepersFromStmt(stmt *sqlite.Stmt) ([]Zookeeper, error) {
 	defer stmt.Reset()
 
 	var (
-		clusters []Cluster
+		zookeepers []Zookeeper
 
-		current *Cluster
+		current *Zookeeper
 	)
 
 	for {
@@ -220,141 +246,1363 @@ func getClustersFromStmt(stmt *sqlite.Stmt) ([]Cluster, error) {
 
 		//
 
-		id := int(stmt.GetInt64("cluster_id"))
+		id := int(stmt.GetInt64("id"))
 
 		switch {
 		case current == nil:
-			current = new(Cluster)
+			current = new(Zookeeper)
 		case id != current.ID:
-			clusters = append(clusters, *current)
-			current = new(Cluster)
+			zookeepers = append(zookeepers, *current)
+			current = new(Zookeeper)
 		}
 
 		current.ID = id
-		current.Name = ClusterName(stmt.GetText("name"))
-		current.Version = KafkaVersion(stmt.GetText("version"))
-		current.Brokers = append(current.Brokers, Broker{
-			ID:   int(stmt.GetInt64("broker_id")),
-			Addr: mustResolveTCPAddr(stmt.GetText("addr")),
+		current.Name = stmt.GetText("name")
+		current.Kind = ZookeeperKind(stmt.GetText("kind"))
+		current.Version = stmt.GetText("version")
+		current.FourLetterWords = stmt.GetText("four_letter_words")
+		current.JavaHome = stmt.GetText("java_home")
+		current.Nodes = append(current.Nodes, ZookeeperNode{
+			ID:           int(stmt.GetInt64("node_id")),
+			Addr:         mustResolveTCPAddr(stmt.GetText("addr")),
+			DataDir:      stmt.GetText("data_dir"),
+			PeerPort:     int(stmt.GetInt64("peer_port")),
+			ElectionPort: int(stmt.GetInt64("election_port")),
+			AdminPort:    int(stmt.GetInt64("admin_port")),
 		})
 	}
 
 	if current != nil {
-		clusters = append(clusters, *current)
+		zookeepers = append(zookeepers, *current)
 	}
 
-	return clusters, nil
+	return zookeepers, nil
 }
 
-func cleanupDatabase() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+// getSharedZookeeper returns the shared Zookeeper node, registering it if necessary.
+func getSharedZookeeper(ctx context.Context, version string) (*Zookeeper, error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	if err := ensureSharedZookeeper(conn, version); err != nil {
+		return nil, err
+	}
+
+	return getZookeeperConn(conn, sharedZookeeperName)
+}
+
+// ensureSharedZookeeper registers the shared Zookeeper node if it doesn't exist yet.
+//
+// The shared node uses the address provided by the -zk-addr flag the first time it's registered;
+// from then on the address stored in the database is used.
+func ensureSharedZookeeper(conn *sqlite.Conn, version string) (err error) {
+	defer sqlitex.Save(conn)(&err)
 
-	// 1. clean up the clusters
+	shared, err := getZookeeperConn(conn, sharedZookeeperName)
+	if err != nil || shared != nil {
+		return err
+	}
 
-	clusters, err := searchClusters(ctx, "")
+	addr, err := net.ResolveTCPAddr("tcp", *globalZkAddr)
 	if err != nil {
 		return err
 	}
 
-	for _, cluster := range clusters {
-		status, err := getClusterStatus(ctx, cluster)
-		if err != nil {
-			return err
-		}
+	shared = &Zookeeper{
+		Name:            sharedZookeeperName,
+		Kind:            zookeeperShared,
+		Version:         version,
+		FourLetterWords: *globalZk4lwWhitelist,
+		Nodes: []ZookeeperNode{
+			{ID: 1, Addr: *addr, DataDir: filepath.Join(dataDir, "zkdata")},
+		},
+	}
 
-		for _, s := range status.brokers {
-			if !s.IsStarted() {
-				if err := removeBrokerStatus(ctx, cluster, s.broker); err != nil {
-					return err
-				}
-			}
-		}
+	used, err := listUsedPortsConn(conn)
+	if err != nil {
+		return err
+	}
+	if err := allocateZookeeperAdminPorts(shared.Nodes, used); err != nil {
+		return err
 	}
 
-	// 2. clean up zookeeper
+	_, err = insertZookeeper(conn, *shared)
+	return err
+}
+
+// listUsedPorts returns the ports attributed to a broker or a Zookeeper node, even if they're not currently in use.
+func listUsedPorts(ctx context.Context) (map[int]bool, error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	return listUsedPortsConn(conn)
+}
 
-	status, err := getZookeeperStatus(ctx)
+func listUsedPortsConn(conn *sqlite.Conn) (map[int]bool, error) {
+	zookeepers, err := listZookeepersConn(conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !status.IsStarted() {
-		if err := removeZookeeperStatus(ctx); err != nil {
-			return err
+	res := make(map[int]bool)
+	for _, zookeeper := range zookeepers {
+		for _, node := range zookeeper.Nodes {
+			res[node.Addr.Port] = true
+			res[node.PeerPort] = true
+			res[node.ElectionPort] = true
+			res[node.AdminPort] = true
 		}
 	}
 
-	return nil
+	// NOTE(vincent): not using searchClusters so that the clusters without brokers don't matter.
+	err = sqlitex.Exec(conn, `SELECT addr, jmx_port FROM broker`, func(stmt *sqlite.Stmt) error {
+		if _, port, err := net.SplitHostPort(stmt.ColumnText(0)); err == nil {
+			p, _ := strconv.Atoi(port)
+			res[p] = true
+		}
+		res[int(stmt.ColumnInt64(1))] = true
+		return nil
+	})
+
+	return res, err
 }
 
-func initializeDatabase(pool *sqlitex.Pool) error {
-	conn := pool.Get(nil)
+func getBrokerStatus(ctx context.Context, cluster Cluster, broker Broker) (brokerStatus, error) {
+	conn := pool.Get(ctx)
 	defer pool.Put(conn)
 
-	if err := sqlitex.ExecTransient(conn, "PRAGMA journal_mode=WAL;", nil); err != nil {
-		return err
-	}
-	if err := sqlitex.ExecTransient(conn, "PRAGMA foreign_keys=ON;", nil); err != nil {
-		return err
-	}
-	if err := sqlitex.ExecScript(conn, schema); err != nil {
-		return err
+	var status brokerStatus
+	status.cluster = cluster
+	status.broker = broker
+
+	stmt := conn.Prep(`SELECT s.process_id, p.start_time, p.cmdline, p.marker
+				FROM broker_status s
+				LEFT JOIN process p ON p.id = s.process_id
+				WHERE s.cluster_id = $cluster_id
+				AND s.broker_id = $broker_id`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+	stmt.SetInt64("$broker_id", int64(broker.ID))
+
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return status, err
+		} else if !hasNext {
+			break
+		}
+
+		status.process = getProcessIdentityFromStmt(stmt)
 	}
-	return nil
+
+	return status, nil
 }
 
-func openDatabase() error {
-	database := filepath.Join(dataDir, "database.db")
-	dsn := fmt.Sprintf("file:%s", database)
+func setBrokerStatus(ctx context.Context, status brokerStatus) (err error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
 
-	var err error
-	pool, err = sqlitex.Open(dsn, 0, 4)
-	if err != nil {
+	defer sqlitex.Save(conn)(&err)
+
+	if err := insertProcess(conn, status.process); err != nil {
 		return err
 	}
 
-	if err := initializeDatabase(pool); err != nil {
+	stmt := conn.Prep(`INSERT INTO broker_status(process_id, cluster_id, broker_id) VALUES ($process_id, $cluster_id, $broker_id)`)
+	stmt.SetInt64("$process_id", int64(status.process.pid))
+	stmt.SetInt64("$cluster_id", int64(status.cluster.ID))
+	stmt.SetInt64("$broker_id", int64(status.broker.ID))
+
+	_, err = stmt.Step()
+	return err
+}
+
+func removeBrokerStatus(ctx context.Context, cluster Cluster, broker Broker) (err error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`DELETE FROM process WHERE id IN (
+				SELECT process_id FROM broker_status
+				WHERE cluster_id = $cluster_id
+				AND broker_id = $broker_id)`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+	stmt.SetInt64("$broker_id", int64(broker.ID))
+
+	if _, err := stmt.Step(); err != nil {
 		return err
 	}
 
-	return nil
+	stmt = conn.Prep(`DELETE FROM broker_status
+				WHERE cluster_id = $cluster_id
+				AND broker_id = $broker_id`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+	stmt.SetInt64("$broker_id", int64(broker.ID))
+
+	_, err = stmt.Step()
+	return err
 }
 
-const schema = `
-PRAGMA auto_vacuum = FULL;
+func createCluster(ctx context.Context, cluster Cluster) (err error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
 
-CREATE TABLE IF NOT EXISTS cluster (
-	id integer NOT NULL,
-	name text NOT NULL,
-	version text NOT NULL,
-	PRIMARY KEY (id)
-);
-CREATE UNIQUE INDEX IF NOT EXISTS cluster_name ON cluster(name);
+	defer sqlitex.Save(conn)(&err)
 
-CREATE TABLE IF NOT EXISTS broker (
-	id integer NOT NULL,
-	cluster_id integer NOT NULL,
-	addr text NOT NULL,
-	PRIMARY KEY (id, cluster_id),
-	FOREIGN KEY (cluster_id) REFERENCES cluster(id) ON DELETE CASCADE
-);
+	_, err = insertCluster(conn, cluster)
+	return err
+}
 
-CREATE TABLE IF NOT EXISTS broker_status (
-	process_id integer NOT NULL,
-	cluster_id integer NOT NULL,
-	broker_id integer NOT NULL,
-	PRIMARY KEY (process_id),
-	FOREIGN KEY (broker_id, cluster_id) REFERENCES broker(id, cluster_id) ON DELETE CASCADE
-);
+func insertCluster(conn *sqlite.Conn, cluster Cluster) (int64, error) {
+	// Create cluster row
+	var custom string
+	if cluster.Custom != nil {
+		if err := ensureCustomDistribution(conn, *cluster.Custom); err != nil {
+			return 0, err
+		}
+		custom = cluster.Custom.Name
+	}
 
-CREATE TABLE IF NOT EXISTS current_context (
-	cluster_id integer NOT NULL,
-	state integer NOT NULL
-);
+	stmt := conn.Prep(`INSERT INTO cluster(name, version, scala_version, distribution, java_home, heap, log_max_file_size, log_max_files, log_separate, custom_distribution)
+				VALUES($name, $version, $scala_version, $distribution, $java_home, $heap, $log_max_file_size, $log_max_files, $log_separate, $custom_distribution)`)
+	stmt.SetText("$name", string(cluster.Name))
+	stmt.SetText("$version", string(cluster.Version))
+	stmt.SetText("$scala_version", cluster.ScalaVersion)
+	stmt.SetText("$distribution", cluster.Distribution)
+	stmt.SetText("$java_home", cluster.JavaHome)
+	stmt.SetText("$heap", cluster.JVM.Heap)
+	stmt.SetText("$log_max_file_size", cluster.Logs.MaxFileSize)
+	stmt.SetInt64("$log_max_files", int64(cluster.Logs.MaxFiles))
+	stmt.SetBool("$log_separate", cluster.Logs.Separate)
+	stmt.SetText("$custom_distribution", custom)
 
-CREATE TABLE IF NOT EXISTS zookeeper_status (
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+
+	id := conn.LastInsertRowID()
+
+	if err := insertJVMSettings(conn, id, 0, cluster.JVM); err != nil {
+		return 0, err
+	}
+	if err := insertPluginPaths(conn, id, cluster.PluginPaths); err != nil {
+		return 0, err
+	}
+	if err := insertLogLevels(conn, id, 0, cluster.LogLevels); err != nil {
+		return 0, err
+	}
+
+	// Attach the cluster to its Zookeeper
+
+	stmt = conn.Prep(`INSERT INTO cluster_zookeeper(cluster_id, zookeeper_id) VALUES($cluster_id, $zookeeper_id)`)
+	stmt.SetInt64("$cluster_id", id)
+	stmt.SetInt64("$zookeeper_id", int64(cluster.Zookeeper.ID))
+
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+
+	// Create brokers
+
+	for _, broker := range cluster.Brokers {
+		if err := insertBroker(conn, id, broker); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+func setClusterJavaHome(ctx context.Context, cluster Cluster, javaHome string) error {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	stmt := conn.Prep(`UPDATE cluster SET java_home = $java_home WHERE id = $id`)
+	stmt.SetText("$java_home", javaHome)
+	stmt.SetInt64("$id", int64(cluster.ID))
+
+	_, err := stmt.Step()
+	return err
+}
+
+func insertBroker(conn *sqlite.Conn, clusterID int64, broker Broker) error {
+	stmt := conn.Prep(`INSERT INTO broker(id, cluster_id, addr, heap, jmx_port) VALUES($id, $cluster_id, $addr, $heap, $jmx_port)`)
+	stmt.SetInt64("$id", int64(broker.ID))
+	stmt.SetInt64("$cluster_id", clusterID)
+	stmt.SetText("$addr", broker.Addr.String())
+	stmt.SetText("$heap", broker.JVM.Heap)
+	stmt.SetInt64("$jmx_port", int64(broker.JMXPort))
+
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	if err := insertJVMSettings(conn, clusterID, broker.ID, broker.JVM); err != nil {
+		return err
+	}
+
+	return insertLogLevels(conn, clusterID, broker.ID, broker.LogLevels)
+}
+
+// insertJVMSettings inserts the JVM options and environment variables of a cluster, or of one of its brokers if brokerID isn't 0.
+// The heap size is stored with the cluster or the broker.
+func insertJVMSettings(conn *sqlite.Conn, clusterID int64, brokerID int, settings JVMSettings) error {
+	for _, kind := range []struct {
+		name   string
+		values []string
+	}{
+		{"option", settings.Options},
+		{"env", settings.Env},
+	} {
+		for i, value := range kind.values {
+			stmt := conn.Prep(`INSERT INTO jvm_setting(cluster_id, broker_id, kind, position, value)
+						VALUES($cluster_id, $broker_id, $kind, $position, $value)`)
+			stmt.SetInt64("$cluster_id", clusterID)
+			stmt.SetInt64("$broker_id", int64(brokerID))
+			stmt.SetText("$kind", kind.name)
+			stmt.SetInt64("$position", int64(i))
+			stmt.SetText("$value", value)
+
+			if _, err := stmt.Step(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// insertPluginPaths inserts the plugin paths of a cluster, they're stored with its JVM settings.
+func insertPluginPaths(conn *sqlite.Conn, clusterID int64, paths []string) error {
+	for i, p := range paths {
+		stmt := conn.Prep(`INSERT INTO jvm_setting(cluster_id, broker_id, kind, position, value)
+					VALUES($cluster_id, 0, 'plugin_path', $position, $value)`)
+		stmt.SetInt64("$cluster_id", clusterID)
+		stmt.SetInt64("$position", int64(i))
+		stmt.SetText("$value", p)
+
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setClusterPluginPaths replaces the plugin paths of a cluster.
+func setClusterPluginPaths(ctx context.Context, cluster Cluster, paths []string) (err error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`DELETE FROM jvm_setting WHERE cluster_id = $cluster_id AND kind = 'plugin_path'`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	return insertPluginPaths(conn, int64(cluster.ID), paths)
+}
+
+// loadJVMSettings reads the JVM options and environment variables of a cluster and its brokers, and its plugin paths.
+func loadJVMSettings(conn *sqlite.Conn, cluster *Cluster) error {
+	const query = `SELECT broker_id, kind, value FROM jvm_setting WHERE cluster_id = ? ORDER BY broker_id, kind, position`
+
+	return sqlitex.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+		settings := &cluster.JVM
+		if brokerID := int(stmt.GetInt64("broker_id")); brokerID > 0 {
+			settings = nil
+			for i := range cluster.Brokers {
+				if cluster.Brokers[i].ID == brokerID {
+					settings = &cluster.Brokers[i].JVM
+				}
+			}
+			if settings == nil {
+				return nil
+			}
+		}
+
+		switch value := stmt.GetText("value"); stmt.GetText("kind") {
+		case "option":
+			settings.Options = append(settings.Options, value)
+		case "env":
+			settings.Env = append(settings.Env, value)
+		case "plugin_path":
+			cluster.PluginPaths = append(cluster.PluginPaths, value)
+		}
+
+		return nil
+	}, cluster.ID)
+}
+
+// insertLogLevels inserts the persistent log levels of a cluster, or of one of its brokers if brokerID isn't 0.
+func insertLogLevels(conn *sqlite.Conn, clusterID int64, brokerID int, levels map[string]string) error {
+	for logger, level := range levels {
+		if err := setLogLevelConn(conn, clusterID, brokerID, logger, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLogLevel records the persistent level of a logger of a cluster, or of one of its brokers if brokerID isn't 0.
+// An empty level removes it.
+func setLogLevel(ctx context.Context, cluster Cluster, brokerID int, logger, level string) error {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	return setLogLevelConn(conn, int64(cluster.ID), brokerID, logger, level)
+}
+
+func setLogLevelConn(conn *sqlite.Conn, clusterID int64, brokerID int, logger, level string) error {
+	var stmt *sqlite.Stmt
+	if level == "" {
+		stmt = conn.Prep(`DELETE FROM log_level WHERE cluster_id = $cluster_id AND broker_id = $broker_id AND logger = $logger`)
+	} else {
+		stmt = conn.Prep(`INSERT OR REPLACE INTO log_level(cluster_id, broker_id, logger, level) VALUES($cluster_id, $broker_id, $logger, $level)`)
+		stmt.SetText("$level", level)
+	}
+	stmt.SetInt64("$cluster_id", clusterID)
+	stmt.SetInt64("$broker_id", int64(brokerID))
+	stmt.SetText("$logger", logger)
+
+	_, err := stmt.Step()
+	return err
+}
+
+// loadLogLevels reads the persistent log levels of a cluster and its brokers.
+func loadLogLevels(conn *sqlite.Conn, cluster *Cluster) error {
+	const query = `SELECT broker_id, logger, level FROM log_level WHERE cluster_id = ?`
+
+	return sqlitex.Exec(conn, query, func(stmt *sqlite.Stmt) error {
+		levels := &cluster.LogLevels
+		if brokerID := int(stmt.GetInt64("broker_id")); brokerID > 0 {
+			levels = nil
+			for i := range cluster.Brokers {
+				if cluster.Brokers[i].ID == brokerID {
+					levels = &cluster.Brokers[i].LogLevels
+				}
+			}
+			if levels == nil {
+				return nil
+			}
+		}
+
+		if *levels == nil {
+			*levels = make(map[string]string)
+		}
+		(*levels)[stmt.GetText("logger")] = stmt.GetText("level")
+
+		return nil
+	}, cluster.ID)
+}
+
+func removeCluster(ctx context.Context, cluster Cluster) (err error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := conn.Prep(`DELETE FROM broker WHERE cluster_id = $cluster_id`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	stmt = conn.Prep(`DELETE FROM jvm_setting WHERE cluster_id = $cluster_id`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	stmt = conn.Prep(`DELETE FROM log_level WHERE cluster_id = $cluster_id`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	stmt = conn.Prep(`DELETE FROM cluster_zookeeper WHERE cluster_id = $cluster_id`)
+	stmt.SetInt64("$cluster_id", int64(cluster.ID))
+
+	if _, err = stmt.Step(); err != nil {
+		return err
+	}
+
+	stmt = conn.Prep(`DELETE FROM cluster WHERE id = $id`)
+	stmt.SetInt64("$id", int64(cluster.ID))
+
+	_, err = stmt.Step()
+	return err
+}
+
+func getFirstClusterFromStmt(conn *sqlite.Conn, stmt *sqlite.Stmt) (*Cluster, error) {
+	clusters, err := getClustersFromStmt(conn, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if len(clusters) == 0 {
+		return nil, nil
+	}
+	return &clusters[0], nil
+}
+
+const clustersQuery = `SELECT b.id AS broker_id, b.addr, b.heap AS broker_heap, b.jmx_port,
+			c.name, c.id AS cluster_id, c.version, c.scala_version, c.distribution, c.java_home, c.heap,
+			c.log_max_file_size, c.log_max_files, c.log_separate, cz.zookeeper_id,
+			cd.name AS custom_name, cd.source AS custom_source, cd.location AS custom_location
+			FROM cluster c
+			INNER JOIN broker b ON b.cluster_id = c.id
+			INNER JOIN cluster_zookeeper cz ON cz.cluster_id = c.id
+			LEFT JOIN custom_distribution cd ON cd.name = c.custom_distribution`
+
+func getCluster(ctx context.Context, name ClusterName) (*Cluster, error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	stmt := conn.Prep(clustersQuery + ` WHERE c.name = $name`)
+	stmt.SetText("$name", string(name))
+
+	return getFirstClusterFromStmt(conn, stmt)
+}
+
+func searchClusters(ctx context.Context, pattern string) ([]Cluster, error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	var stmt *sqlite.Stmt
+	switch {
+	case pattern != "":
+		stmt = conn.Prep(clustersQuery + ` WHERE c.name LIKE $pattern`)
+		stmt.SetText("$pattern", "%"+pattern+"%")
+
+	default:
+		stmt = conn.Prep(clustersQuery)
+	}
+
+	return getClustersFromStmt(conn, stmt)
+}
+
+// listClusterVersions returns the clusters with only their name and versions, including the clusters without brokers.
+// Only the name of their custom distribution is returned.
+func listClusterVersions(ctx context.Context) ([]Cluster, error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	var res []Cluster
+
+	err := sqlitex.Exec(conn, `SELECT name, version, scala_version, distribution, custom_distribution FROM cluster`, func(stmt *sqlite.Stmt) error {
+		cluster := Cluster{
+			Name:         ClusterName(stmt.ColumnText(0)),
+			Version:      KafkaVersion(stmt.ColumnText(1)),
+			ScalaVersion: stmt.ColumnText(2),
+			Distribution: stmt.ColumnText(3),
+		}
+		if custom := stmt.ColumnText(4); custom != "" {
+			cluster.Custom = &CustomDistribution{Name: custom}
+		}
+
+		res = append(res, cluster)
+		return nil
+	})
+
+	return res, err
+}
+
+func getClustersFromStmt(conn *sqlite.Conn, stmt *sqlite.Stmt) ([]Cluster, error) {
+	defer stmt.Reset()
+
+	zookeepers, err := listZookeepersConn(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	getZookeeper := func(id int) Zookeeper {
+		for _, zookeeper := range zookeepers {
+			if zookeeper.ID == id {
+				return zookeeper
+			}
+		}
+		return Zookeeper{}
+	}
+
+	var (
+		clusters []Cluster
+
+		current *Cluster
+	)
+
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return nil, err
+		} else if !hasNext {
+			break
+		}
+
+		//
+
+		id := int(stmt.GetInt64("cluster_id"))
+
+		switch {
+		case current == nil:
+			current = new(Cluster)
+		case id != current.ID:
+			clusters = append(clusters, *current)
+			current = new(Cluster)
+		}
+
+		current.ID = id
+		current.Name = ClusterName(stmt.GetText("name"))
+		current.Version = KafkaVersion(stmt.GetText("version"))
+		current.ScalaVersion = stmt.GetText("scala_version")
+		current.Distribution = stmt.GetText("distribution")
+		current.JavaHome = stmt.GetText("java_home")
+		current.JVM.Heap = stmt.GetText("heap")
+		current.Logs = LogSettings{
+			MaxFileSize: stmt.GetText("log_max_file_size"),
+			MaxFiles:    int(stmt.GetInt64("log_max_files")),
+			Separate:    stmt.GetInt64("log_separate") != 0,
+		}
+		if name := stmt.GetText("custom_name"); name != "" {
+			current.Custom = &CustomDistribution{
+				Name:     name,
+				Source:   customSource(stmt.GetText("custom_source")),
+				Location: stmt.GetText("custom_location"),
+			}
+		}
+		current.Zookeeper = getZookeeper(int(stmt.GetInt64("zookeeper_id")))
+		current.Brokers = append(current.Brokers, Broker{
+			ID:      int(stmt.GetInt64("broker_id")),
+			Addr:    mustResolveTCPAddr(stmt.GetText("addr")),
+			JVM:     JVMSettings{Heap: stmt.GetText("broker_heap")},
+			JMXPort: int(stmt.GetInt64("jmx_port")),
+		})
+	}
+
+	if current != nil {
+		clusters = append(clusters, *current)
+	}
+
+	for i := range clusters {
+		if err := loadJVMSettings(conn, &clusters[i]); err != nil {
+			return nil, err
+		}
+		if err := loadLogLevels(conn, &clusters[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return clusters, nil
+}
+
+// ensureCustomDistribution creates a custom distribution if it doesn't exist yet.
+// An existing custom distribution with the same name must come from the same location.
+func ensureCustomDistribution(conn *sqlite.Conn, dist CustomDistribution) error {
+	existing, err := getCustomDistributionConn(conn, dist.Name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case existing == nil:
+		stmt := conn.Prep(`INSERT INTO custom_distribution(name, source, location) VALUES($name, $source, $location)`)
+		stmt.SetText("$name", dist.Name)
+		stmt.SetText("$source", string(dist.Source))
+		stmt.SetText("$location", dist.Location)
+
+		_, err := stmt.Step()
+		return err
+
+	case *existing != dist:
+		return fmt.Errorf("the custom distribution %s already exists, use -custom-name to choose another name", *existing)
+
+	default:
+		return nil
+	}
+}
+
+func getCustomDistributionConn(conn *sqlite.Conn, name string) (*CustomDistribution, error) {
+	var res *CustomDistribution
+
+	err := sqlitex.Exec(conn, `SELECT name, source, location FROM custom_distribution WHERE name = ?`, func(stmt *sqlite.Stmt) error {
+		res = &CustomDistribution{
+			Name:     stmt.ColumnText(0),
+			Source:   customSource(stmt.ColumnText(1)),
+			Location: stmt.ColumnText(2),
+		}
+		return nil
+	}, name)
+
+	return res, err
+}
+
+// removeUnusedCustomDistribution removes a custom distribution if no cluster uses it anymore and returns true if it did.
+func removeUnusedCustomDistribution(ctx context.Context, name string) (removed bool, err error) {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+
+	var used bool
+	err = sqlitex.Exec(conn, `SELECT 1 FROM cluster WHERE custom_distribution = ?`, func(stmt *sqlite.Stmt) error {
+		used = true
+		return nil
+	}, name)
+	if err != nil || used {
+		return false, err
+	}
+
+	if err := sqlitex.Exec(conn, `DELETE FROM custom_distribution WHERE name = ?`, nil, name); err != nil {
+		return false, err
+	}
+
+	return conn.Changes() > 0, nil
+}
+
+func cleanupDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	// 1. clean up the brokers
+
+	if err := cleanupProcesses(conn, "broker_status"); err != nil {
+		return err
+	}
+
+	// 2. clean up zookeeper
+
+	if err := cleanupProcesses(conn, "zookeeper_node_status"); err != nil {
+		return err
+	}
+
+	// 3. clean up the processes not referenced anymore, for example after a cluster was removed.
+
+	return sqlitex.Exec(conn, `DELETE FROM process
+		WHERE id NOT IN (SELECT process_id FROM broker_status)
+		AND id NOT IN (SELECT process_id FROM zookeeper_node_status)`, nil)
+}
+
+// cleanupProcesses removes the rows of the status table whose process isn't running anymore.
+//
+// A process is also considered not running if its PID is now used by another process.
+func cleanupProcesses(conn *sqlite.Conn, table string) error {
+	var pids []int
+
+	stmt := conn.Prep(`SELECT s.process_id, p.start_time, p.cmdline, p.marker
+		FROM ` + table + ` s
+		LEFT JOIN process p ON p.id = s.process_id`)
+	for {
+		if hasNext, err := stmt.Step(); err != nil {
+			return err
+		} else if !hasNext {
+			break
+		}
+
+		process := getProcessIdentityFromStmt(stmt)
+
+		switch process.State() {
+		case processRunning:
+			continue
+		case processMismatch:
+			log.Printf("process %d is not the one started by kcm anymore, forgetting it", process.pid)
+		}
+
+		pids = append(pids, process.pid)
+	}
+
+	for _, pid := range pids {
+		stmt := conn.Prep(`DELETE FROM ` + table + ` WHERE process_id = $process_id`)
+		stmt.SetInt64("$process_id", int64(pid))
+
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+
+		stmt = conn.Prep(`DELETE FROM process WHERE id = $process_id`)
+		stmt.SetInt64("$process_id", int64(pid))
+
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertProcess saves the identity of a process.
+// An existing row for the same PID can only belong to a dead process so it is replaced.
+func insertProcess(conn *sqlite.Conn, process processIdentity) error {
+	stmt := conn.Prep(`INSERT OR REPLACE INTO process(id, start_time, cmdline, marker) VALUES ($id, $start_time, $cmdline, $marker)`)
+	stmt.SetInt64("$id", int64(process.pid))
+	stmt.SetInt64("$start_time", process.startTime)
+	stmt.SetText("$cmdline", process.cmdline)
+	stmt.SetText("$marker", process.marker)
+
+	_, err := stmt.Step()
+	return err
+}
+
+// getProcessIdentityFromStmt reads the identity of a process from a row
+// with the columns process_id, start_time, cmdline and marker.
+//
+// Processes started by older versions of kcm only have a PID.
+func getProcessIdentityFromStmt(stmt *sqlite.Stmt) processIdentity {
+	return processIdentity{
+		pid:       int(stmt.GetInt64("process_id")),
+		startTime: stmt.GetInt64("start_time"),
+		cmdline:   stmt.GetText("cmdline"),
+		marker:    stmt.GetText("marker"),
+	}
+}
+
+// migration changes the schema or the data of the database.
+//
+// Migrations are applied in order and never change once released, a new migration must be added instead.
+// A function only uses SQL written against the schema as it is at its version, with sqlitex.Exec
+// so that an error is returned instead of a panic.
+type migration struct {
+	version     int
+	description string
+
+	// Either a script or a function
+	script string
+	fn     func(conn *sqlite.Conn) error
+}
+
+var migrations = []migration{
+	// NOTE(vincent): versions of kcm before migrations existed created the tables with CREATE TABLE IF NOT EXISTS,
+	// the first migration works with any of them.
+	{version: 1, description: "create the initial schema", script: schema},
+	{version: 2, description: "move the data of the legacy zookeeper tables", fn: upgradeDatabase},
+	// The existing clusters used the only Scala version kcm supported.
+	{version: 3, description: "add the Scala version of the clusters", script: `ALTER TABLE cluster ADD COLUMN scala_version text NOT NULL DEFAULT '2.12';`},
+	{version: 4, description: "add the custom distributions of Kafka", script: `
+CREATE TABLE custom_distribution (
+	id integer NOT NULL,
+	name text NOT NULL,
+	source text NOT NULL,
+	location text NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX custom_distribution_name ON custom_distribution(name);
+ALTER TABLE cluster ADD COLUMN custom_distribution text NOT NULL DEFAULT '';
+`},
+	// The existing clusters used the only distribution kcm supported.
+	{version: 5, description: "add the distribution of the clusters", script: `ALTER TABLE cluster ADD COLUMN distribution text NOT NULL DEFAULT 'apache';`},
+	// The existing clusters get a Java runtime the next time they start.
+	{version: 6, description: "add the Java runtime of the clusters", script: `ALTER TABLE cluster ADD COLUMN java_home text NOT NULL DEFAULT '';`},
+	{version: 7, description: "add the JVM settings of the clusters and brokers", script: `
+ALTER TABLE cluster ADD COLUMN heap text NOT NULL DEFAULT '';
+ALTER TABLE broker ADD COLUMN heap text NOT NULL DEFAULT '';
+ALTER TABLE broker ADD COLUMN jmx_port integer NOT NULL DEFAULT 0;
+CREATE TABLE jvm_setting (
+	cluster_id integer NOT NULL,
+	broker_id integer NOT NULL,
+	kind text NOT NULL,
+	position integer NOT NULL,
+	value text NOT NULL,
+	PRIMARY KEY (cluster_id, broker_id, kind, position),
+	FOREIGN KEY (cluster_id) REFERENCES cluster(id) ON DELETE CASCADE
+);
+`},
+	{version: 8, description: "add the log settings of the clusters", script: `
+ALTER TABLE cluster ADD COLUMN log_max_file_size text NOT NULL DEFAULT '';
+ALTER TABLE cluster ADD COLUMN log_max_files integer NOT NULL DEFAULT 0;
+ALTER TABLE cluster ADD COLUMN log_separate integer NOT NULL DEFAULT 0;
+`},
+	{version: 9, description: "add the persistent log levels of the clusters and brokers", script: `
+CREATE TABLE log_level (
+	cluster_id integer NOT NULL,
+	broker_id integer NOT NULL,
+	logger text NOT NULL,
+	level text NOT NULL,
+	PRIMARY KEY (cluster_id, broker_id, logger),
+	FOREIGN KEY (cluster_id) REFERENCES cluster(id) ON DELETE CASCADE
+);
+`},
+	// NOTE(vincent): a dedicated node used to be recognized by its name only, which an ensemble can share with a cluster.
+	{version: 10, description: "add the kind of the zookeeper nodes", script: `
+ALTER TABLE zookeeper ADD COLUMN kind text NOT NULL DEFAULT '';
+UPDATE zookeeper SET kind = CASE
+	WHEN name = 'shared' THEN 'shared'
+	WHEN name IN (SELECT name FROM cluster) AND (SELECT COUNT(*) FROM zookeeper_node n WHERE n.zookeeper_id = zookeeper.id) = 1 THEN 'dedicated'
+	ELSE 'ensemble'
+END;
+`},
+	{version: 11, description: "attach the legacy clusters to the shared zookeeper", fn: attachLegacyClusters},
+	// The existing nodes keep the AdminServer disabled and the default four letter words.
+	{version: 12, description: "add the AdminServer port and four letter words of the zookeeper nodes", script: `
+ALTER TABLE zookeeper ADD COLUMN four_letter_words text NOT NULL DEFAULT '';
+ALTER TABLE zookeeper_node ADD COLUMN admin_port integer NOT NULL DEFAULT 0;
+`},
+	// The existing nodes get a Java runtime the next time they start.
+	{version: 13, description: "add the Java runtime of the zookeeper nodes", script: `ALTER TABLE zookeeper ADD COLUMN java_home text NOT NULL DEFAULT '';`},
+}
+
+var errDatabaseTooNew = errors.New("the database was created by a newer version of kcm")
+
+func initializeDatabase(pool *sqlitex.Pool, dryRun bool) ([]migration, error) {
+	conn := pool.Get(nil)
+	defer pool.Put(conn)
+
+	if err := sqlitex.ExecTransient(conn, "PRAGMA journal_mode=WAL;", nil); err != nil {
+		return nil, err
+	}
+	if err := sqlitex.ExecTransient(conn, "PRAGMA foreign_keys=ON;", nil); err != nil {
+		return nil, err
+	}
+	// NOTE(vincent): this only has an effect before the first table is created.
+	if err := sqlitex.ExecTransient(conn, "PRAGMA auto_vacuum = FULL;", nil); err != nil {
+		return nil, err
+	}
+
+	return migrateDatabase(conn, dryRun)
+}
+
+// migrateDatabase applies the pending migrations in a single transaction and returns them.
+// If dryRun is true the pending migrations are only returned.
+func migrateDatabase(conn *sqlite.Conn, dryRun bool) (res []migration, err error) {
+	const script = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version integer NOT NULL,
+	description text NOT NULL,
+	applied_at text NOT NULL,
+	PRIMARY KEY (version)
+);`
+
+	if err := sqlitex.ExecScript(conn, script); err != nil {
+		return nil, err
+	}
+
+	// 1. find the pending migrations
+
+	current, err := getSchemaVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return nil, fmt.Errorf("%w (schema version %d, this version of kcm supports up to %d)", errDatabaseTooNew, current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version > current {
+			res = append(res, m)
+		}
+	}
+
+	if dryRun || len(res) == 0 {
+		return res, nil
+	}
+
+	// 2. apply them
+
+	defer sqlitex.Save(conn)(&err)
+
+	for _, m := range res {
+		if m.script != "" {
+			err = sqlitex.ExecScript(conn, m.script)
+		} else {
+			err = m.fn(conn)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply migration %d (%s). err: %w", m.version, m.description, err)
+		}
+
+		err = sqlitex.Exec(conn, `INSERT INTO schema_version(version, description, applied_at) VALUES(?, ?, ?)`, nil,
+			m.version, m.description, time.Now().Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func getSchemaVersion(conn *sqlite.Conn) (int, error) {
+	var version int
+
+	err := sqlitex.Exec(conn, `SELECT coalesce(max(version), 0) FROM schema_version`, func(stmt *sqlite.Stmt) error {
+		version = int(stmt.ColumnInt64(0))
+		return nil
+	})
+
+	return version, err
+}
+
+// upgradeDatabase moves the data of a database created by an older version of kcm to the current tables.
+func upgradeDatabase(conn *sqlite.Conn) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	// Zookeeper nodes used to be stored directly in the zookeeper table with their status in zookeeper_process.
+	// NOTE(vincent): the legacy zookeeper_status table is carried over by attachLegacyClusters.
+
+	exists, err := tableExists(conn, "zookeeper_process")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	const script = `
+INSERT INTO zookeeper_node(id, zookeeper_id, addr, peer_port, election_port, data_dir)
+	SELECT 1, z.id, z.addr, 0, 0, z.data_dir FROM zookeeper z
+	WHERE z.id NOT IN (SELECT zookeeper_id FROM zookeeper_node);
+
+INSERT INTO zookeeper_node_status(process_id, zookeeper_id, node_id)
+	SELECT process_id, zookeeper_id, 1 FROM zookeeper_process;
+
+DROP TABLE zookeeper_process;
+`
+
+	return sqlitex.ExecScript(conn, script)
+}
+
+// attachLegacyClusters registers the shared Zookeeper node for the clusters created before Zookeeper nodes were stored,
+// and carries over its legacy status. They all used the default Zookeeper version.
+//
+// NOTE(vincent): this used to be done every time the clusters were read, registering the shared node at the
+// default version even when a cluster was about to be created with another version.
+// It writes the tables as they are at this migration, the later ones fill their new columns.
+func attachLegacyClusters(conn *sqlite.Conn) error {
+	var legacy bool
+	err := sqlitex.Exec(conn, `SELECT 1 FROM cluster WHERE id NOT IN (SELECT cluster_id FROM cluster_zookeeper) LIMIT 1`, func(*sqlite.Stmt) error {
+		legacy = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	status, err := tableExists(conn, "zookeeper_status")
+	if err != nil {
+		return err
+	}
+
+	if !legacy && !status {
+		return nil
+	}
+
+	// 1. register the shared node
+
+	var sharedID int64
+	err = sqlitex.Exec(conn, `SELECT id FROM zookeeper WHERE name = ?`, func(stmt *sqlite.Stmt) error {
+		sharedID = stmt.ColumnInt64(0)
+		return nil
+	}, sharedZookeeperName)
+	if err != nil {
+		return err
+	}
+
+	if sharedID == 0 {
+		addr, err := net.ResolveTCPAddr("tcp", *globalZkAddr)
+		if err != nil {
+			return err
+		}
+		nodeDataDir := filepath.Join(dataDir, "zkdata")
+
+		err = sqlitex.Exec(conn, `INSERT INTO zookeeper(name, kind, version, addr, data_dir) VALUES(?, ?, ?, ?, ?)`, nil,
+			sharedZookeeperName, string(zookeeperShared), defaultZookeeperVersion, addr.String(), nodeDataDir)
+		if err != nil {
+			return err
+		}
+		sharedID = conn.LastInsertRowID()
+
+		err = sqlitex.Exec(conn, `INSERT INTO zookeeper_node(id, zookeeper_id, addr, peer_port, election_port, data_dir) VALUES(1, ?, ?, 0, 0, ?)`, nil,
+			sharedID, addr.String(), nodeDataDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 2. older versions of kcm tracked the shared node in the zookeeper_status table, carry it over
+	// so a node started by them is not launched a second time.
+
+	if status {
+		err := sqlitex.Exec(conn, `INSERT INTO zookeeper_node_status(process_id, zookeeper_id, node_id) SELECT process_id, ?, 1 FROM zookeeper_status`, nil, sharedID)
+		if err != nil {
+			return err
+		}
+
+		if err := sqlitex.Exec(conn, `DROP TABLE zookeeper_status`, nil); err != nil {
+			return err
+		}
+	}
+
+	// 3. attach the clusters
+
+	return sqlitex.Exec(conn, `INSERT INTO cluster_zookeeper(cluster_id, zookeeper_id)
+				SELECT c.id, ? FROM cluster c
+				WHERE c.id NOT IN (SELECT cluster_id FROM cluster_zookeeper)`, nil, sharedID)
+}
+
+func tableExists(conn *sqlite.Conn, name string) (bool, error) {
+	var exists bool
+
+	err := sqlitex.Exec(conn, `SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?`, func(stmt *sqlite.Stmt) error {
+		exists = true
+		return nil
+	}, name)
+
+	return exists, err
+}
+
+func makeDatabasePath() string {
+	return filepath.Join(dataDir, "database.db")
+}
+
+func makeBackupDir() string {
+	return filepath.Join(dataDir, "backups")
+}
+
+// makeBackupPath returns the default path of a backup made now, never overwriting an existing backup.
+func makeBackupPath() string {
+	prefix := filepath.Join(makeBackupDir(), "database-"+time.Now().Format("20060102-150405"))
+
+	res := prefix + ".db"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(res); os.IsNotExist(err) {
+			return res
+		}
+		res = fmt.Sprintf("%s-%d.db", prefix, i)
+	}
+}
+
+func openDatabase() error {
+	_, err := openAndMigrateDatabase(false)
+	return err
+}
+
+// openAndMigrateDatabase opens the database and applies the pending migrations, which are returned.
+// If dryRun is true the pending migrations are only returned.
+func openAndMigrateDatabase(dryRun bool) ([]migration, error) {
+	dsn := fmt.Sprintf("file:%s", makeDatabasePath())
+
+	var err error
+	pool, err = sqlitex.Open(dsn, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	return initializeDatabase(pool, dryRun)
+}
+
+func closeDatabase() error {
+	if pool == nil {
+		return nil
+	}
+
+	err := pool.Close()
+	pool = nil
+
+	return err
+}
+
+var errCorruptedDatabase = errors.New("the database is corrupted")
+
+// checkDatabase runs a quick integrity check of the database.
+func checkDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	return checkDatabaseConn(conn)
+}
+
+func checkDatabaseConn(conn *sqlite.Conn) error {
+	var problems []string
+
+	err := sqlitex.ExecTransient(conn, "PRAGMA quick_check;", func(stmt *sqlite.Stmt) error {
+		if result := stmt.ColumnText(0); result != "ok" {
+			problems = append(problems, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w. err: %v", errCorruptedDatabase, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errCorruptedDatabase, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// backupDatabase copies the database to dst, which must not exist.
+func backupDatabase(ctx context.Context, dst string) error {
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// NOTE(vincent): unlike the online backup API, VACUUM INTO always writes a single file without a WAL.
+	if err := sqlitex.ExecTransient(conn, "VACUUM INTO ?;", nil, dst); err != nil {
+		return fmt.Errorf("unable to backup the database to %q. err: %w", dst, err)
+	}
+
+	return nil
+}
+
+// checkBackup checks the backup at path is a usable database.
+func checkBackup(path string) error {
+	conn, err := sqlite.OpenConn(path, sqlite.SQLITE_OPEN_READONLY)
+	if err != nil {
+		return fmt.Errorf("unable to open backup %q. err: %w", path, err)
+	}
+	defer conn.Close()
+
+	if err := checkDatabaseConn(conn); err != nil {
+		return fmt.Errorf("unable to use backup %q. err: %w", path, err)
+	}
+
+	return nil
+}
+
+// restoreDatabase replaces the database with the backup at src.
+//
+// The database must be closed.
+func restoreDatabase(src string) error {
+	srcConn, err := sqlite.OpenConn(src, sqlite.SQLITE_OPEN_READONLY)
+	if err != nil {
+		return fmt.Errorf("unable to open backup %q. err: %w", src, err)
+	}
+	defer srcConn.Close()
+
+	// Copy the backup next to the database then replace the database.
+	// NOTE(vincent): the WAL of the old database must not be applied to the new one.
+
+	tmp := makeDatabasePath() + ".restore"
+	if err := removeDatabaseFiles(tmp); err != nil {
+		return err
+	}
+
+	if err := sqlitex.ExecTransient(srcConn, "VACUUM INTO ?;", nil, tmp); err != nil {
+		return fmt.Errorf("unable to copy backup %q. err: %w", src, err)
+	}
+
+	if err := removeDatabaseFiles(makeDatabasePath()); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, makeDatabasePath())
+}
+
+// moveDatabase moves the database and its WAL files to dst.
+// It returns false if there was no database to move.
+//
+// The database must be closed.
+func moveDatabase(dst string) (bool, error) {
+	if _, err := os.Stat(makeDatabasePath()); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(makeDatabasePath()+suffix, dst+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("unable to move the database to %q. err: %w", dst, err)
+		}
+	}
+
+	return true, nil
+}
+
+// removeDatabaseFiles removes a database and its WAL files.
+func removeDatabaseFiles(path string) error {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS cluster (
+	id integer NOT NULL,
+	name text NOT NULL,
+	version text NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS cluster_name ON cluster(name);
+
+CREATE TABLE IF NOT EXISTS broker (
+	id integer NOT NULL,
+	cluster_id integer NOT NULL,
+	addr text NOT NULL,
+	PRIMARY KEY (id, cluster_id),
+	FOREIGN KEY (cluster_id) REFERENCES cluster(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS broker_status (
+	process_id integer NOT NULL,
+	cluster_id integer NOT NULL,
+	broker_id integer NOT NULL,
+	PRIMARY KEY (process_id),
+	FOREIGN KEY (broker_id, cluster_id) REFERENCES broker(id, cluster_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS current_context (
+	cluster_id integer NOT NULL,
+	state integer NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS zookeeper (
+	id integer NOT NULL,
+	name text NOT NULL,
+	version text NOT NULL,
+	addr text NOT NULL,
+	data_dir text NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS zookeeper_name ON zookeeper(name);
+
+CREATE TABLE IF NOT EXISTS zookeeper_node (
+	id integer NOT NULL,
+	zookeeper_id integer NOT NULL,
+	addr text NOT NULL,
+	peer_port integer NOT NULL,
+	election_port integer NOT NULL,
+	data_dir text NOT NULL,
+	PRIMARY KEY (id, zookeeper_id),
+	FOREIGN KEY (zookeeper_id) REFERENCES zookeeper(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS zookeeper_node_status (
 	process_id integer NOT NULL,
-	PRIMARY KEY (process_id)
+	zookeeper_id integer NOT NULL,
+	node_id integer NOT NULL,
+	PRIMARY KEY (process_id),
+	FOREIGN KEY (node_id, zookeeper_id) REFERENCES zookeeper_node(id, zookeeper_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS process (
+	id integer NOT NULL,
+	start_time integer NOT NULL,
+	cmdline text NOT NULL,
+	marker text NOT NULL,
+	PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS cluster_zookeeper (
+	cluster_id integer NOT NULL,
+	zookeeper_id integer NOT NULL,
+	PRIMARY KEY (cluster_id),
+	FOREIGN KEY (cluster_id) REFERENCES cluster(id) ON DELETE CASCADE,
+	FOREIGN KEY (zookeeper_id) REFERENCES zookeeper(id)
 );
 `
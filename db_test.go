@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// baselineSchema is the schema written by the versions of kcm before migrations existed.
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS cluster (
+	id integer NOT NULL,
+	name text NOT NULL,
+	version text NOT NULL,
+	PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS cluster_name ON cluster(name);
+
+CREATE TABLE IF NOT EXISTS broker (
+	id integer NOT NULL,
+	cluster_id integer NOT NULL,
+	addr text NOT NULL,
+	PRIMARY KEY (id, cluster_id),
+	FOREIGN KEY (cluster_id) REFERENCES cluster(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS broker_status (
+	process_id integer NOT NULL,
+	cluster_id integer NOT NULL,
+	broker_id integer NOT NULL,
+	PRIMARY KEY (process_id),
+	FOREIGN KEY (broker_id, cluster_id) REFERENCES broker(id, cluster_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS current_context (
+	cluster_id integer NOT NULL,
+	state integer NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS zookeeper_status (
+	process_id integer NOT NULL,
+	PRIMARY KEY (process_id)
+);
+`
+
+// makeTestDataDir points dataDir to a temporary directory, the returned function restores it.
+func makeTestDataDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "kcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := dataDir
+	dataDir = dir
+
+	return func() {
+		dataDir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+// makeBaselineDatabase writes a database like the versions of kcm before migrations did,
+// with a cluster a whose broker and shared Zookeeper node are running.
+func makeBaselineDatabase(t *testing.T) {
+	conn, err := sqlite.OpenConn(makeDatabasePath(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const script = `
+INSERT INTO cluster(id, name, version) VALUES(1, 'a', '2.6.0');
+INSERT INTO broker(id, cluster_id, addr) VALUES(1, 1, '127.0.0.1:9092');
+INSERT INTO broker_status(process_id, cluster_id, broker_id) VALUES(4242, 1, 1);
+INSERT INTO zookeeper_status(process_id) VALUES(4343);
+`
+
+	if err := sqlitex.ExecScript(conn, baselineSchema+script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	defer makeTestDataDir(t)()
+
+	makeBaselineDatabase(t)
+
+	if err := openDatabase(); err != nil {
+		t.Fatalf("unable to migrate the database, err: %v", err)
+	}
+	defer closeDatabase()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// 1. the cluster is attached to the shared Zookeeper node
+
+	cluster, err := getCluster(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster == nil || len(cluster.Brokers) != 1 {
+		t.Fatalf("expected cluster a with one broker, got %+v", cluster)
+	}
+
+	shared, err := getZookeeper(ctx, sharedZookeeperName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared == nil || shared.Kind != zookeeperShared || shared.Version != defaultZookeeperVersion {
+		t.Fatalf("expected the shared Zookeeper node at version %s, got %+v", defaultZookeeperVersion, shared)
+	}
+	if cluster.Zookeeper.ID != shared.ID {
+		t.Fatalf("expected cluster a to use the shared Zookeeper node, got %+v", cluster.Zookeeper)
+	}
+
+	// 2. the processes are carried over
+
+	brokerStatus, err := getBrokerStatus(ctx, *cluster, cluster.Brokers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brokerStatus.process.pid != 4242 {
+		t.Fatalf("expected broker process 4242, got %d", brokerStatus.process.pid)
+	}
+
+	nodeStatus, err := getZookeeperNodeStatus(ctx, *shared, shared.Nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeStatus.process.pid != 4343 {
+		t.Fatalf("expected zookeeper process 4343, got %d", nodeStatus.process.pid)
+	}
+
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	exists, err := tableExists(conn, "zookeeper_status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("the legacy zookeeper_status table must be removed")
+	}
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	defer makeTestDataDir(t)()
+
+	makeBaselineDatabase(t)
+
+	conn, err := sqlite.OpenConn(makeDatabasePath(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 1. every migration is applied and recorded
+
+	applied, err := migrateDatabase(conn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("expected %d migrations, got %d", len(migrations), len(applied))
+	}
+
+	version, err := getSchemaVersion(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := migrations[len(migrations)-1].version; version != latest {
+		t.Fatalf("expected schema version %d, got %d", latest, version)
+	}
+
+	// 2. nothing is pending anymore
+
+	applied, err = migrateDatabase(conn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("expected no pending migration, got %d", len(applied))
+	}
+}
+
+func TestMigrateDatabaseError(t *testing.T) {
+	defer makeTestDataDir(t)()
+
+	makeBaselineDatabase(t)
+
+	conn, err := sqlite.OpenConn(makeDatabasePath(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A migration reading a column which doesn't exist yet returns an error, the migrations before it are rolled back.
+
+	previous := migrations
+	defer func() { migrations = previous }()
+
+	migrations = []migration{
+		previous[0],
+		{version: 2, description: "read a missing column", fn: func(conn *sqlite.Conn) error {
+			return sqlitex.Exec(conn, `SELECT kind FROM zookeeper`, nil)
+		}},
+	}
+
+	_, err = migrateDatabase(conn, false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	version, err := getSchemaVersion(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatalf("expected schema version 0, got %d", version)
+	}
+}
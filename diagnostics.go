@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// jvmDiagnostic is a diagnostic run on the JVM of a running broker with kcm jvm.
+type jvmDiagnostic struct {
+	// description is used in the messages, like "thread dump".
+	description string
+	// ext is the extension of the output file.
+	ext string
+	// jcmd returns the jcmd command for a Java major version. path is the output file, for the commands writing it themselves.
+	jcmd func(major int, path string) []string
+	// writesFile is true if jcmd writes the output file itself instead of printing the result.
+	writesFile bool
+}
+
+var jvmDiagnostics = map[string]jvmDiagnostic{
+	"threads": {
+		description: "thread dump",
+		ext:         "txt",
+		jcmd:        func(int, string) []string { return []string{"Thread.print", "-l"} },
+	},
+	"heap": {
+		description: "heap dump",
+		ext:         "hprof",
+		jcmd:        func(_ int, path string) []string { return []string{"GC.heap_dump", path} },
+		writesFile:  true,
+	},
+	"gc": {
+		description: "GC report",
+		ext:         "txt",
+		jcmd: func(major int, _ string) []string {
+			// NOTE(vincent): GC.heap_info only exists since Java 9.
+			if major < 9 {
+				return []string{"GC.class_histogram"}
+			}
+			return []string{"GC.heap_info"}
+		},
+	},
+	"flags": {
+		description: "JVM flags",
+		ext:         "txt",
+		jcmd:        func(int, string) []string { return []string{"VM.flags", "-all"} },
+	},
+}
+
+// makeBrokerDiagnosticPath returns the path of the output file of a diagnostic, like broker1/diagnostics/threads-20201015-153000.txt.
+func makeBrokerDiagnosticPath(cluster Cluster, broker Broker, name string, now time.Time) string {
+	filename := fmt.Sprintf("%s-%s.%s", name, now.Format("20060102-150405"), jvmDiagnostics[name].ext)
+	return filepath.Join(makeBrokerDir(cluster.Name, broker.ID), "diagnostics", filename)
+}
+
+// findJcmd returns the jcmd binary of the Java runtime of a process, or an empty string if it doesn't have one like a JRE.
+// The JRE of a Java 8 JDK is in its jre directory, jcmd is in the JDK.
+func findJcmd(pid int) string {
+	runtime, err := readProcessJavaRuntime(pid)
+	if err != nil {
+		return ""
+	}
+
+	for _, home := range []string{runtime.home, filepath.Dir(runtime.home)} {
+		if p := filepath.Join(home, "bin", "jcmd"); fileExists(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// runJVMDiagnostic runs a diagnostic on a running broker and returns the path of its output file.
+//
+// It uses the jcmd tool of the Java runtime of the broker. Without it only a thread dump can be done:
+// the broker receives a SIGQUIT and the dump is read from its standard output.
+func runJVMDiagnostic(ctx context.Context, cluster Cluster, broker Broker, name string) (string, error) {
+	diagnostic := jvmDiagnostics[name]
+
+	// 1. check the broker is running
+
+	status, err := getBrokerStatus(ctx, cluster, broker)
+	if err != nil {
+		return "", fmt.Errorf("unable to get kafka broker pid. err: %w", err)
+	}
+	if !status.IsStarted() {
+		return "", fmt.Errorf("broker %d is not started", broker.ID)
+	}
+
+	pid := status.process.pid
+
+	// 2. prepare the output file
+
+	path := makeBrokerDiagnosticPath(cluster, broker, name, time.Now())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// 3. run the diagnostic
+
+	jcmd := findJcmd(pid)
+
+	switch {
+	case jcmd != "":
+		var major int
+		if runtime, err := readProcessJavaRuntime(pid); err == nil {
+			major = runtime.Major()
+		}
+
+		args := append([]string{fmt.Sprint(pid)}, diagnostic.jcmd(major, path)...)
+
+		output, err := exec.CommandContext(ctx, jcmd, args...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("jcmd failed: %s. err: %w", bytes.TrimSpace(output), err)
+		}
+
+		if !diagnostic.writesFile {
+			if err := ioutil.WriteFile(path, output, 0644); err != nil {
+				return "", err
+			}
+		}
+
+	case name == "threads":
+		dump, err := dumpThreadsWithSignal(ctx, pid, findBrokerLog(cluster, broker, "stdout"))
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(path, dump, 0644); err != nil {
+			return "", err
+		}
+
+	default:
+		return "", fmt.Errorf("the Java runtime of broker %d has no jcmd, only a thread dump can be done without it", broker.ID)
+	}
+
+	return path, nil
+}
+
+// dumpThreadsWithSignal sends a SIGQUIT to a JVM and returns the thread dump it writes to its standard output, the file stdout.
+func dumpThreadsWithSignal(ctx context.Context, pid int, stdout string) ([]byte, error) {
+	fi, err := os.Stat(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("the standard output of the broker isn't available, restart it to dump its threads. err: %w", err)
+	}
+	offset := fi.Size()
+
+	if err := syscall.Kill(pid, syscall.SIGQUIT); err != nil {
+		return nil, fmt.Errorf("unable to send SIGQUIT to process %d. err: %w", pid, err)
+	}
+
+	// The dump is written in multiple chunks, it's complete once the file stops growing.
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	size := offset
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no thread dump written by process %d", pid)
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(stdout)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.Size() > offset && fi.Size() == size {
+			break
+		}
+		size = fi.Size()
+	}
+
+	f, err := os.Open(stdout)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make([]byte, size-offset)
+	if _, err := f.ReadAt(res, offset); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kafkaDistribution describes a distribution of Kafka: where it's downloaded from, how its archive is laid out and how to run it.
+type kafkaDistribution struct {
+	// Name is used to choose the distribution with create -distribution.
+	Name        string
+	Description string
+	// Kind is the kind of its artifacts in the cache.
+	Kind artifactKind
+
+	// ApacheVersion returns the version of Apache Kafka a version is based on.
+	ApacheVersion func(version KafkaVersion) KafkaVersion
+
+	// UsesCatalog is true if the versions are Apache releases, validated against the catalog and which can be aliases.
+	UsesCatalog bool
+
+	// DefaultScalaVersion returns the Scala version of the build used when none is provided.
+	DefaultScalaVersion func(version KafkaVersion) string
+	// CheckScalaVersion returns an error if a version is not published for a Scala version.
+	CheckScalaVersion func(version KafkaVersion, scala string) error
+
+	// Download locations.
+
+	TarballPath   func(version KafkaVersion, scala string) string
+	ExtractedPath func(version KafkaVersion, scala string) string
+	// Fetch downloads the tarball of a build to dst.
+	Fetch func(d *downloader, dst string, version KafkaVersion, scala string) error
+	// ParseDistName returns the version and the Scala version of an extracted build or a tarball without its extension.
+	// It returns false if the name isn't one of this distribution.
+	ParseDistName func(name string) (KafkaVersion, string, bool)
+
+	// Archive layout, relative to the extracted path.
+
+	// ClasspathRoots are the directories containing the jars needed to run a broker.
+	ClasspathRoots []string
+	ScriptsDir     string
+	// ScriptSuffix is the extension of the scripts, like .sh.
+	ScriptSuffix string
+
+	// MainClass is the class running a broker.
+	MainClass string
+}
+
+// defaultDistribution is the distribution used by the clusters created before the distribution could be chosen.
+const defaultDistribution = "apache"
+
+var kafkaDistributions = map[string]*kafkaDistribution{
+	"apache": {
+		Name:        "apache",
+		Description: "Apache Kafka, from the Apache mirrors",
+		Kind:        kafkaArtifact,
+		UsesCatalog: true,
+
+		ApacheVersion: func(version KafkaVersion) KafkaVersion { return version },
+
+		DefaultScalaVersion: defaultScalaVersion,
+		CheckScalaVersion:   func(KafkaVersion, string) error { return nil },
+
+		TarballPath:   makeKafkaTarballPath,
+		ExtractedPath: makeKafkaExtractedPath,
+		Fetch: func(d *downloader, dst string, version KafkaVersion, scala string) error {
+			return d.Download(dst, fmt.Sprintf("/kafka/%s/%s.tgz", version, makeKafkaDistName(version, scala)))
+		},
+		ParseDistName: func(name string) (KafkaVersion, string, bool) {
+			if !strings.HasPrefix(name, "kafka_") {
+				return "", "", false
+			}
+			version, scala := parseKafkaDistName(name)
+			return version, scala, true
+		},
+
+		ClasspathRoots: []string{"libs"},
+		ScriptsDir:     "bin",
+		ScriptSuffix:   ".sh",
+
+		MainClass: "kafka.Kafka",
+	},
+	"confluent": {
+		Name:        "confluent",
+		Description: "Confluent Community, from packages.confluent.io. The versions are Confluent Platform versions like 6.2.0",
+		Kind:        confluentArtifact,
+
+		ApacheVersion: confluentApacheVersion,
+
+		DefaultScalaVersion: defaultConfluentScalaVersion,
+		CheckScalaVersion:   checkConfluentScalaVersion,
+
+		TarballPath: func(version KafkaVersion, scala string) string {
+			return filepath.Join(cacheDir, makeConfluentDistName(version, scala)+".tar.gz")
+		},
+		ExtractedPath: func(version KafkaVersion, scala string) string {
+			return filepath.Join(dataDir, makeConfluentDistName(version, scala))
+		},
+		Fetch: func(d *downloader, dst string, version KafkaVersion, scala string) error {
+			u := fmt.Sprintf("%s/%s/%s.tar.gz", confluentArchiveURL, minorVersion(version), makeConfluentDistName(version, scala))
+			return d.DownloadURL(dst, u)
+		},
+		ParseDistName: parseConfluentDistName,
+
+		ClasspathRoots: []string{"share/java/kafka"},
+		ScriptsDir:     "bin",
+		ScriptSuffix:   "",
+
+		MainClass: "kafka.Kafka",
+	},
+}
+
+// getKafkaDistribution returns the distribution with this name.
+func getKafkaDistribution(name string) (*kafkaDistribution, error) {
+	if d, ok := kafkaDistributions[name]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q, must be one of %s", name, strings.Join(kafkaDistributionNames(), ", "))
+}
+
+// getKafkaDistributionByKind returns the distribution of an artifact kind, or nil if it's not a Kafka distribution.
+func getKafkaDistributionByKind(kind artifactKind) *kafkaDistribution {
+	for _, d := range kafkaDistributions {
+		if d.Kind == kind {
+			return d
+		}
+	}
+	return nil
+}
+
+func kafkaDistributionNames() []string {
+	res := make([]string, 0, len(kafkaDistributions))
+	for name := range kafkaDistributions {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// clusterDistribution returns the distribution of a cluster.
+// The distribution is validated when the cluster is created so it always exists.
+func clusterDistribution(cluster Cluster) *kafkaDistribution {
+	d, err := getKafkaDistribution(cluster.Distribution)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+//
+// Confluent Community
+//
+
+// confluentArchiveURL contains every release of the Confluent Platform.
+const confluentArchiveURL = "https://packages.confluent.io/archive"
+
+// Confluent Platform 6.0 and later is only published for Scala 2.13, its archives don't contain the Scala version.
+const confluentScala213Version = "6.0"
+
+// confluentApacheVersion returns the minor version of Apache Kafka of a Confluent Platform version:
+// 4.x is based on 1.x, 5.x on 2.x, 6.x on 2.6 and later, and 7.x and later on (x-4).y.
+func confluentApacheVersion(version KafkaVersion) KafkaVersion {
+	parts := strings.SplitN(string(version), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || major < 4 {
+		return version
+	}
+
+	switch major {
+	case 4:
+		return KafkaVersion(fmt.Sprintf("1.%d", minor))
+	case 5:
+		return KafkaVersion(fmt.Sprintf("2.%d", minor))
+	case 6:
+		return KafkaVersion(fmt.Sprintf("2.%d", minor+6))
+	default:
+		return KafkaVersion(fmt.Sprintf("%d.%d", major-4, minor))
+	}
+}
+
+func defaultConfluentScalaVersion(version KafkaVersion) string {
+	if compareVersions(string(version), confluentScala213Version) < 0 {
+		return "2.12"
+	}
+	return "2.13"
+}
+
+func checkConfluentScalaVersion(version KafkaVersion, scala string) error {
+	if compareVersions(string(version), confluentScala213Version) >= 0 && scala != "2.13" {
+		return fmt.Errorf("Confluent Platform %s is only published for Scala 2.13", version)
+	}
+	return nil
+}
+
+// makeConfluentDistName returns the name of a Confluent Community build like confluent-community-6.2.0, the same name Confluent uses.
+func makeConfluentDistName(version KafkaVersion, scala string) string {
+	if compareVersions(string(version), confluentScala213Version) < 0 {
+		return fmt.Sprintf("confluent-community-%s-%s", version, scala)
+	}
+	return fmt.Sprintf("confluent-community-%s", version)
+}
+
+var confluentDistNamePattern = regexp.MustCompile(`^confluent-community-(\d+\.\d+\.\d+)(?:-(\d+\.\d+))?$`)
+
+func parseConfluentDistName(name string) (KafkaVersion, string, bool) {
+	m := confluentDistNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", false
+	}
+
+	version, scala := KafkaVersion(m[1]), m[2]
+	if scala == "" {
+		scala = defaultConfluentScalaVersion(version)
+	}
+
+	return version, scala, true
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+const (
+	// apacheMirrorURL redirects to the closest Apache mirror, only the recent releases are available there.
+	apacheMirrorURL = "https://www.apache.org/dyn/closer.cgi"
+	// apacheArchiveURL contains every release and the checksums.
+	apacheArchiveURL = "https://archive.apache.org/dist"
+)
+
+const (
+	// downloadTimeout is the time to wait for a server to answer a request, and to get a small file like a checksum.
+	downloadTimeout = 30 * time.Second
+	// downloadStallTimeout is the time to wait for more data from a server before aborting a download, which can then be resumed.
+	downloadStallTimeout = time.Minute
+)
+
+// downloader downloads the Kafka and Zookeeper archives from the Apache servers or from mirrors.
+//
+// The mirrors and the HTTP client can be replaced to download from a local server instead.
+type downloader struct {
+	client *http.Client
+
+	// mirrors are the base URLs of mirrors of the Apache distribution directory, tried in order.
+	// If there's none the Apache servers are used.
+	mirrors []string
+
+	// offline forbids any download.
+	offline bool
+}
+
+// newDownloader creates a downloader configured with the global flags.
+func newDownloader() (*downloader, error) {
+	d := &downloader{
+		offline: *globalOffline,
+	}
+
+	for _, mirror := range globalMirrors {
+		d.mirrors = append(d.mirrors, strings.TrimSuffix(mirror, "/"))
+	}
+
+	// NOTE(vincent): the client has no overall timeout since downloading Kafka can take a while on a slow connection,
+	// instead a server must answer within downloadTimeout and a download is aborted when it stalls.
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = downloadTimeout
+
+	// The default transport already uses the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars.
+
+	if *globalProxy != "" {
+		proxyURL, err := url.Parse(*globalProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q. err: %w", *globalProxy, err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	d.client = &http.Client{Transport: transport}
+
+	return d, nil
+}
+
+// urls returns the URLs to download a file from, in order.
+func (d *downloader) urls(filename string) []string {
+	if len(d.mirrors) > 0 {
+		res := make([]string, 0, len(d.mirrors))
+		for _, mirror := range d.mirrors {
+			res = append(res, mirror+filename)
+		}
+		return res
+	}
+
+	params := make(url.Values)
+	params.Set("filename", filename)
+	params.Set("action", "download")
+
+	return []string{
+		apacheMirrorURL + "?" + params.Encode(),
+		apacheArchiveURL + filename,
+	}
+}
+
+// checksumURLs returns the URLs to download the checksum of a file from, in order.
+func (d *downloader) checksumURLs(filename string) []string {
+	if len(d.mirrors) > 0 {
+		res := make([]string, 0, len(d.mirrors))
+		for _, mirror := range d.mirrors {
+			res = append(res, mirror+filename+".sha512")
+		}
+		return res
+	}
+
+	return []string{apacheArchiveURL + filename + ".sha512"}
+}
+
+// Download downloads the file from the mirrors to dst.
+//
+// The file is first downloaded to a temporary file next to dst, which is used to resume an interrupted download.
+// It is only moved to dst once it's verified against the SHA-512 checksum published by Apache and it's a tarball.
+// The checksum is recorded next to dst to detect a corrupted file later.
+func (d *downloader) Download(dst, filename string) error {
+	if d.offline {
+		return fmt.Errorf("%s is not in the cache and kcm is offline, add it with \"kcm artifacts import\"", path.Base(filename))
+	}
+
+	err := d.download(dst, filename, d.urls(filename), d.checksumURLs(filename))
+	if err == errNotFound {
+		return fmt.Errorf("%s not found on any mirror", filename)
+	}
+	return err
+}
+
+// DownloadURL downloads a file from any URL to dst, like Download does.
+// It's verified if a checksum is published next to it, with the .sha512 extension; it must be a tarball in any case.
+func (d *downloader) DownloadURL(dst, u string) error {
+	if d.offline {
+		return fmt.Errorf("%s is not in the cache and kcm is offline", u)
+	}
+
+	err := d.download(dst, u, []string{u}, []string{u + ".sha512"})
+	if err == errNotFound {
+		return fmt.Errorf("%s not found", u)
+	}
+	return err
+}
+
+func (d *downloader) download(dst, name string, urls, checksumURLs []string) error {
+	// 1. get the checksum first so an invalid download is never moved in place
+
+	expected, err := d.fetchChecksum(checksumURLs)
+	if err != nil && err != errNotFound {
+		return err
+	}
+
+	// 2. try each mirror in order
+
+	tmp := dst + ".part"
+
+	for _, u := range urls {
+		// NOTE(vincent): a mirror can fail for many reasons, always try the next one.
+
+		err = d.downloadFile(tmp, u)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			log.Printf("unable to download %s. err: %v", u, err)
+			continue
+		}
+
+		// 3. verify it
+
+		var sum string
+		sum, err = computeChecksum(tmp)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case expected == "":
+			log.Printf("no checksum published for %s, it can't be verified", name)
+
+		case sum != expected:
+			log.Printf("invalid checksum for %s, removing it", u)
+			if err := os.Remove(tmp); err != nil {
+				return err
+			}
+			err = fmt.Errorf("invalid checksum for %s, expected %s got %s", name, expected, sum)
+			continue
+		}
+
+		// NOTE(vincent): without a checksum this is the only thing preventing an error page of a mirror from being cached.
+
+		if err = checkTarball(tmp); err != nil {
+			log.Printf("%s is not a tarball, removing it. err: %v", u, err)
+			if err := os.Remove(tmp); err != nil {
+				return err
+			}
+			err = fmt.Errorf("%s is not a tarball. err: %w", name, err)
+			continue
+		}
+
+		// 4. it's valid, move it in place
+
+		if err := recordChecksum(dst, sum); err != nil {
+			return err
+		}
+
+		return os.Rename(tmp, dst)
+	}
+
+	return err
+}
+
+// fetchChecksum returns the SHA-512 checksum of a file, from the first URL which has it.
+func (d *downloader) fetchChecksum(urls []string) (string, error) {
+	err := errNotFound
+	for _, u := range urls {
+		var sum string
+		sum, err = d.fetchChecksumFrom(u)
+		if err == nil {
+			return sum, nil
+		}
+		if err != errNotFound {
+			log.Printf("unable to get checksum %s. err: %v", u, err)
+		}
+	}
+
+	return "", err
+}
+
+func (d *downloader) fetchChecksumFrom(u string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// NOTE(vincent): servers backed by S3 like packages.confluent.io answer 403 for a missing file.
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		return "", errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return parseChecksum(string(data))
+}
+
+// parseChecksum parses a SHA-512 checksum file. Apache publishes them in two formats:
+//   - <hash>  <file> as written by sha512sum
+//   - <file>: <hash in groups of uppercase hex digits> as written by gpg --print-md
+func parseChecksum(data string) (string, error) {
+	isValid := func(s string) bool {
+		_, err := hex.DecodeString(s)
+		return err == nil && len(s) == 2*sha512.Size
+	}
+
+	if fields := strings.Fields(data); len(fields) > 0 && isValid(fields[0]) {
+		return strings.ToLower(fields[0]), nil
+	}
+
+	if i := strings.IndexByte(data, ':'); i >= 0 {
+		sum := strings.Join(strings.Fields(data[i+1:]), "")
+		if isValid(sum) {
+			return strings.ToLower(sum), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid checksum file %q", data)
+}
+
+// downloadFile downloads the URL to dst. If dst already exists the download is resumed.
+func (d *downloader) downloadFile(dst, u string) error {
+	var offset int64
+	if fi, err := os.Stat(dst); err == nil {
+		offset = fi.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	log.Printf("downloading %s", u)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The file is already complete, the checksum will tell if it's valid.
+		return nil
+
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		log.Printf("resuming download at %s", formatSize(offset))
+		flags |= os.O_APPEND
+
+	case resp.StatusCode == http.StatusOK:
+		// The server doesn't support ranges, start from scratch.
+		offset = 0
+		flags |= os.O_TRUNC
+
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	progress := &progressWriter{
+		written: offset,
+		total:   offset + resp.ContentLength,
+	}
+	if resp.ContentLength < 0 {
+		progress.total = -1
+	}
+	progress.last = progress.step()
+
+	stall := time.AfterFunc(downloadStallTimeout, cancel)
+	defer stall.Stop()
+
+	body := &stallReader{r: resp.Body, timer: stall}
+
+	if _, err := io.Copy(f, io.TeeReader(body, progress)); err != nil {
+		f.Close()
+		return fmt.Errorf("download interrupted, run the command again to resume it. err: %w", err)
+	}
+
+	return f.Close()
+}
+
+// stallReader postpones its timer every time data is read, the timer aborts the download when it fires.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(downloadStallTimeout)
+	return n, err
+}
+
+// progressWriter logs the progress of a download every 10%, or every 10MiB if the size is unknown.
+type progressWriter struct {
+	written int64
+	total   int64
+	last    int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+
+	if step := w.step(); step > w.last {
+		w.last = step
+		if w.total > 0 {
+			log.Printf("downloaded %d%% (%s of %s)", step*10, formatSize(w.written), formatSize(w.total))
+		} else {
+			log.Printf("downloaded %s", formatSize(w.written))
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *progressWriter) step() int64 {
+	if w.total > 0 {
+		return w.written * 10 / w.total
+	}
+	return w.written / (10 << 20)
+}
+
+func formatSize(n int64) string {
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
+
+// downloadArtifact downloads a file to dst with fetch if it doesn't exist.
+//
+// If dst exists but isn't extracted yet it's verified first and downloaded again if it's corrupted.
+// Once extracted the tarball isn't used anymore so there's no need to verify it.
+func downloadArtifact(dst, extractedPath string, fetch func(d *downloader) error) error {
+	// 1. check if it's already downloaded.
+	// If it is we only have to check it's valid.
+
+	fi, err := os.Stat(dst)
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return err
+	case err == nil && fi.IsDir():
+		return fmt.Errorf("path %q is a directory, can't extract it", dst)
+	case err == nil:
+		if _, err := os.Stat(extractedPath); err == nil {
+			return nil
+		}
+
+		err := verifyArtifact(dst)
+		if err == nil {
+			return nil
+		}
+
+		if *globalOffline {
+			return err
+		}
+
+		log.Printf("%v, downloading it again", err)
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+
+	// 2. doesn't exist, download the tarball
+
+	d, err := newDownloader()
+	if err != nil {
+		return err
+	}
+
+	return fetch(d)
+}
+
+//
+// Recorded checksums
+//
+
+func makeChecksumPath(path string) string {
+	return path + ".sha512"
+}
+
+func computeChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordChecksum records the checksum of a file in the sha512sum format, so it can also be checked with sha512sum -c.
+func recordChecksum(path, sum string) error {
+	data := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+	return ioutil.WriteFile(makeChecksumPath(path), []byte(data), 0644)
+}
+
+// verifyArtifact checks a downloaded file against its recorded checksum.
+// Files downloaded by older versions of kcm don't have one and are considered valid.
+func verifyArtifact(path string) error {
+	data, err := ioutil.ReadFile(makeChecksumPath(path))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	expected, err := parseChecksum(string(data))
+	if err != nil {
+		return err
+	}
+
+	sum, err := computeChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	if sum != expected {
+		return fmt.Errorf("%s is corrupted, its checksum doesn't match the recorded one", path)
+	}
+
+	return nil
+}
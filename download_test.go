@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testArchiveName = "/kafka/2.6.0/kafka_2.12-2.6.0.tgz"
+
+// makeTestTarball returns a gzipped tarball big enough to be downloaded in several parts.
+func makeTestTarball(t *testing.T) []byte {
+	content := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	hdr := &tar.Header{
+		Name:     "kafka_2.12-2.6.0/libs/kafka.jar",
+		Mode:     0644,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func makeTestChecksum(data []byte) string {
+	sum := sha512.Sum512(data)
+	return hex.EncodeToString(sum[:]) + "  kafka_2.12-2.6.0.tgz\n"
+}
+
+// newTestMirror returns a mirror serving the files by path, any other path is not found.
+// The Range header of each request of the archive is recorded in ranges.
+func newTestMirror(files map[string][]byte, ranges *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if req.URL.Path == testArchiveName && ranges != nil {
+			*ranges = append(*ranges, req.Header.Get("Range"))
+		}
+
+		http.ServeContent(w, req, filepath.Base(req.URL.Path), time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func newTestDownloader(mirrors ...*httptest.Server) *downloader {
+	d := &downloader{client: http.DefaultClient}
+	for _, mirror := range mirrors {
+		d.mirrors = append(d.mirrors, mirror.URL)
+	}
+	return d
+}
+
+func makeTestDownloadPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "kafka_2.12-2.6.0.tgz")
+}
+
+func assertNotExist(t *testing.T, path string) {
+	t.Helper()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("%s must not exist, err: %v", path, err)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	tarball := makeTestTarball(t)
+
+	var ranges []string
+	mirror := newTestMirror(map[string][]byte{
+		testArchiveName:             tarball,
+		testArchiveName + ".sha512": []byte(makeTestChecksum(tarball)),
+	}, &ranges)
+	defer mirror.Close()
+
+	dst := makeTestDownloadPath(t)
+	defer os.RemoveAll(filepath.Dir(dst))
+
+	// An interrupted download left the first half of the archive.
+
+	half := len(tarball) / 2
+	if err := ioutil.WriteFile(dst+".part", tarball[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newTestDownloader(mirror).Download(dst, testArchiveName); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := []string{"bytes=" + strconv.Itoa(half) + "-"}; len(ranges) != 1 || ranges[0] != exp[0] {
+		t.Fatalf("expected the requests %q, got %q", exp, ranges)
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tarball) {
+		t.Fatalf("the downloaded archive is different from the published one")
+	}
+	assertNotExist(t, dst+".part")
+
+	if err := verifyArtifact(dst); err != nil {
+		t.Fatalf("the recorded checksum must be valid, err: %v", err)
+	}
+}
+
+func TestDownloadUnexpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".sha512") {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	dst := makeTestDownloadPath(t)
+	defer os.RemoveAll(filepath.Dir(dst))
+
+	err := newTestDownloader(srv).Download(dst, testArchiveName)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected an error with the status, got %v", err)
+	}
+	assertNotExist(t, dst)
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	mirror := newTestMirror(nil, nil)
+	defer mirror.Close()
+
+	dst := makeTestDownloadPath(t)
+	defer os.RemoveAll(filepath.Dir(dst))
+
+	err := newTestDownloader(mirror).Download(dst, testArchiveName)
+	if err == nil || !strings.Contains(err.Error(), "not found on any mirror") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	assertNotExist(t, dst)
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	tarball := makeTestTarball(t)
+
+	mirror := newTestMirror(map[string][]byte{
+		testArchiveName:             tarball,
+		testArchiveName + ".sha512": []byte(makeTestChecksum([]byte("another archive"))),
+	}, nil)
+	defer mirror.Close()
+
+	dst := makeTestDownloadPath(t)
+	defer os.RemoveAll(filepath.Dir(dst))
+
+	err := newTestDownloader(mirror).Download(dst, testArchiveName)
+	if err == nil || !strings.Contains(err.Error(), "invalid checksum") {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	assertNotExist(t, dst)
+	assertNotExist(t, dst+".part")
+	assertNotExist(t, makeChecksumPath(dst))
+}
+
+func TestDownloadHTMLPage(t *testing.T) {
+	tarball := makeTestTarball(t)
+
+	// The first mirror answers every request with an error page, with a 200 status.
+	// It doesn't publish checksums so the page can only be detected by its content.
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".sha512") {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>This mirror is down for maintenance</body></html>"))
+	}))
+	defer broken.Close()
+
+	dst := makeTestDownloadPath(t)
+	defer os.RemoveAll(filepath.Dir(dst))
+
+	// 1. with only this mirror the download fails
+
+	err := newTestDownloader(broken).Download(dst, testArchiveName)
+	if err == nil || !strings.Contains(err.Error(), "not a tarball") {
+		t.Fatalf("expected an invalid archive error, got %v", err)
+	}
+	assertNotExist(t, dst)
+	assertNotExist(t, dst+".part")
+
+	// 2. the next mirror is used instead
+
+	mirror := newTestMirror(map[string][]byte{
+		testArchiveName: tarball,
+	}, nil)
+	defer mirror.Close()
+
+	if err := newTestDownloader(broken, mirror).Download(dst, testArchiveName); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, tarball) {
+		t.Fatalf("the downloaded archive is different from the published one")
+	}
+}
@@ -4,5 +4,6 @@ go 1.13
 
 require (
 	crawshaw.io/sqlite v0.3.2
+	github.com/go-zookeeper/zk v1.0.2
 	github.com/peterbourgon/ff v1.6.0
 )
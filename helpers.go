@@ -4,20 +4,19 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // initDirectories initializes the user directories necessary
@@ -74,92 +73,135 @@ func (s *brokerListenAddrs) String() string {
 
 var _ flag.Value = (*brokerListenAddrs)(nil)
 
-func mustResolveTCPAddr(s string) net.TCPAddr {
-	addr, err := net.ResolveTCPAddr("tcp", s)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return *addr
+// stringList is a flag which can be provided multiple times.
+type stringList []string
+
+func (s *stringList) Set(tmp string) error {
+	*s = append(*s, tmp)
+	return nil
 }
 
-func downloadFromApacheArchive(dst, filename string) error {
-	const baseURL = "https://archive.apache.org/dist/"
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
 
-	u := baseURL + filename
+var _ flag.Value = (*stringList)(nil)
 
-	log.Printf("downloading %s", u)
+// parseClusterBroker parses a cluster name optionally followed by a broker id like staging:2.
+// The broker id is 0 if there's none.
+func parseClusterBroker(s string) (ClusterName, int, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return ClusterName(s), 0, nil
+	}
 
-	resp, err := http.Get(u)
-	if err != nil {
-		return err
+	id, err := strconv.Atoi(s[i+1:])
+	if err != nil || id < 1 {
+		return "", 0, fmt.Errorf("invalid broker id in %q, must be like <cluster>:<broker>", s)
 	}
-	defer resp.Body.Close()
 
-	tarball, err := os.Create(dst)
-	if err != nil {
-		return err
+	return ClusterName(s[:i]), id, nil
+}
+
+// splitBrokerArg returns the broker id at the start of args if there's one, and the other arguments.
+// The broker id is 0 if there's none.
+// NOTE(vincent): a logger name is never a number, so the broker is optional.
+func splitBrokerArg(args []string) (int, []string) {
+	if len(args) > 0 {
+		if id, err := strconv.Atoi(args[0]); err == nil {
+			return id, args[1:]
+		}
 	}
+	return 0, args
+}
 
-	_, err = io.Copy(tarball, resp.Body)
+func mustResolveTCPAddr(s string) net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-
-	return nil
+	return *addr
 }
 
-var errNotFound = errors.New("not found")
+// findFreePort returns the first port starting at start which is not in used
+// and on which we can listen on the host.
+func findFreePort(host string, start int, used map[int]bool) (int, error) {
+	for port := start; port < 65536; port++ {
+		if used[port] {
+			continue
+		}
 
-func downloadFromApacheCloser(dst, filename string) error {
-	const baseURL = "https://www.apache.org/dyn/closer.cgi"
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		ln.Close()
 
-	params := make(url.Values)
-	params.Set("filename", filename)
-	params.Set("action", "download")
+		return port, nil
+	}
 
-	log.Printf("downloading %s", baseURL+"?"+params.Encode())
+	return 0, fmt.Errorf("no free port found on %s", host)
+}
 
-	resp, err := http.Get(baseURL + "?" + params.Encode())
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// extractTarball extracts a tar.gz tarball into the dst directory.
+// It always strips the first level.
+//
+// NOTE(vincent): the tarball is extracted next to dst then moved in place,
+// so that a failed extraction is never mistaken for an extracted distribution.
+// The temporary directory is hidden so it's never listed as a distribution either.
+func extractTarball(dst string, src string) error {
+	tmp := makeExtractPath(dst)
 
-	if resp.StatusCode == http.StatusNotFound {
-		return errNotFound
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
 	}
-
-	tarball, err := os.Create(dst)
-	if err != nil {
+	if err := os.MkdirAll(tmp, 0755); err != nil {
 		return err
 	}
 
-	_, err = io.Copy(tarball, resp.Body)
-	if err != nil {
+	if err := extractTarballTo(tmp, src); err != nil {
+		os.RemoveAll(tmp)
 		return err
 	}
 
-	return nil
+	return os.Rename(tmp, dst)
 }
 
-// extractTarball extracts a tar.gz tarball into the dst directory.
-// It always strips the first level.
-func extractTarball(dst string, src string) error {
+func makeExtractPath(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".extract")
+}
+
+func extractTarballTo(dst string, src string) error {
 	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
 	gzf, err := gzip.NewReader(f)
 	if err != nil {
 		return err
 	}
+	defer gzf.Close()
 
 	tr := tar.NewReader(gzf)
 
+	// NOTE(vincent): some archives like the Confluent ones prefix the names with ./
 	stripFirstLevel := func(s string) string {
+		s = strings.TrimPrefix(s, "./")
 		return s[strings.IndexRune(s, '/')+1:]
 	}
 
+	// makePath strips the first level which is always the name of the distribution and not needed.
+	// An entry outside of dst, like ../../.bashrc, is rejected.
+	makePath := func(name string) (string, error) {
+		p := filepath.Join(dst, stripFirstLevel(name))
+		if p != dst && !strings.HasPrefix(p, dst+string(filepath.Separator)) {
+			return "", fmt.Errorf("entry %q is outside of the extraction directory", name)
+		}
+		return p, nil
+	}
+
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -171,18 +213,20 @@ func extractTarball(dst string, src string) error {
 
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			// strip the first level which is always kafka_2.12_<version> and not needed
-			relativePath := stripFirstLevel(hdr.Name)
-			p := filepath.Join(dst, relativePath)
+			p, err := makePath(hdr.Name)
+			if err != nil {
+				return err
+			}
 
 			if err := os.MkdirAll(p, os.FileMode(hdr.Mode)); err != nil {
 				return fmt.Errorf("unable to create directory %q. err: %w", p, err)
 			}
 
 		case tar.TypeReg:
-			// strip the first level which is always kafka_2.12_<version> and not needed
-			relativePath := stripFirstLevel(hdr.Name)
-			p := filepath.Join(dst, relativePath)
+			p, err := makePath(hdr.Name)
+			if err != nil {
+				return err
+			}
 
 			dir := filepath.Dir(p)
 			if err := os.MkdirAll(dir, 0755); err != nil {
@@ -195,6 +239,7 @@ func extractTarball(dst string, src string) error {
 			}
 
 			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
 				return fmt.Errorf("unable to copy file data. err: %w", err)
 			}
 
@@ -206,12 +251,14 @@ func extractTarball(dst string, src string) error {
 }
 
 type backgroundCommand struct {
-	pid int
+	process processIdentity
 }
 
-func runBackgroundCommand(ctx context.Context, dir string, command string, args ...string) (*backgroundCommand, error) {
+// runBackgroundCommand starts a command in the background with a minimal environment, plus the variables in env.
+// Its standard output and error are appended to stdout.log and stderr.log in logDir if it's not empty, they're discarded otherwise.
+func runBackgroundCommand(ctx context.Context, dir string, env []string, logDir string, command string, args ...string) (*backgroundCommand, error) {
 	cmd := exec.Command(command, args...)
-	cmd.Env = []string{"PATH=/usr/bin:/bin"}
+	cmd.Env = append([]string{"PATH=/usr/bin:/bin"}, env...)
 	cmd.Dir = dir
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
@@ -220,6 +267,24 @@ func runBackgroundCommand(ctx context.Context, dir string, command string, args
 	cmd.Stdout = ioutil.Discard
 	cmd.Stderr = ioutil.Discard
 
+	// NOTE(vincent): with a file the process writes to it directly, it keeps working after kcm exits.
+	if logDir != "" {
+		stdout, err := os.OpenFile(filepath.Join(logDir, "stdout.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer stdout.Close()
+
+		stderr, err := os.OpenFile(filepath.Join(logDir, "stderr.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer stderr.Close()
+
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+	}
+
 	// log.Printf("env: %v", cmd.Env)
 	// log.Printf("running %s %v in %s", command, args, dir)
 
@@ -227,52 +292,111 @@ func runBackgroundCommand(ctx context.Context, dir string, command string, args
 		return nil, err
 	}
 
+	// The command has been executed at this point so we can read its identity.
+	process, err := readProcessIdentity(cmd.Process.Pid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the identity of process %d. err: %w", cmd.Process.Pid, err)
+	}
+
 	return &backgroundCommand{
-		pid: cmd.Process.Pid,
+		process: process,
 	}, nil
 }
 
-func constructClasspath(path string) (string, error) {
+// constructClasspath returns a class path with all the jars in the directories, or the jars themselves.
+func constructClasspath(dirs ...string) (string, error) {
 	var cp []string
-	err := filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-		if strings.HasSuffix(fi.Name(), ".jar") {
-			cp = append(cp, path)
-		}
+			if strings.HasSuffix(fi.Name(), ".jar") {
+				cp = append(cp, path)
+			}
 
-		return nil
-	})
-	return strings.Join(cp, ":"), err
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(cp, ":"), nil
 }
 
 func pidExists(pid int) bool {
 	err := syscall.Kill(pid, syscall.Signal(0))
 	switch {
 	case err == syscall.EPERM:
-		// The process should always be owned by the current user so we can manipulate it.
-		// If it's not something is wrong so we crash.
-		log.Fatalf("process %d is not owned by the current user, this should not happen", pid)
+		// The process exists but is owned by another user so it's not one of ours.
+		// Callers must check its identity anyway.
+		return true
 
 	case err == syscall.ESRCH:
 		return false
 
 	case err == nil:
-		return true
+		// A process which exited but hasn't been reaped yet still accepts signals.
+		return !isZombieProcess(pid)
 
 	default:
-		var errno syscall.Errno
-		if errors.As(err, &errno) {
-			log.Printf("errno: %d", errno)
-		}
+		log.Printf("couldn't send signal to process %d. err: %v", pid, err)
+		return false
+	}
+}
 
-		log.Fatalf("couldn't send signal to process %d. err: %v", pid, err)
+// isZombieProcess returns true if the process has exited but hasn't been reaped by its parent.
+func isZombieProcess(pid int) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
 	}
 
-	// unreachable
-	return false
+	// The state follows the command name which is in parenthesis and can contain spaces.
+	stat := string(data)
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return false
+	}
+
+	return stat[i+2] == 'Z'
+}
+
+// terminateProcess sends SIGTERM to a process and waits for it to exit.
+// If it's still running after the timeout it's killed with SIGKILL, in which case killed is true.
+func terminateProcess(pid int, timeout time.Duration) (killed bool, err error) {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return false, fmt.Errorf("unable to send interrupt signal to process %d. err: %w", pid, err)
+	}
+
+	if waitProcessExit(pid, timeout) {
+		return false, nil
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		return true, fmt.Errorf("unable to send kill signal to process %d. err: %w", pid, err)
+	}
+
+	if !waitProcessExit(pid, timeout) {
+		return true, fmt.Errorf("process %d still running after being killed", pid)
+	}
+
+	return true, nil
+}
+
+// waitProcessExit waits until a process doesn't exist anymore.
+// It returns false if the process still exists after the timeout.
+func waitProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !pidExists(pid) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return !pidExists(pid)
 }
 
 // tailFiles tails a file, optionally following changes.
@@ -308,9 +432,33 @@ func tailFiles(follow bool, files ...string) error {
 	return cmd.Run()
 }
 
-func getJavaBinary() string {
-	if *globalJavaHome != "" {
-		return *globalJavaHome + "/bin/java"
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func containsString(values []string, s string) bool {
+	return indexString(values, s) >= 0
+}
+
+func indexString(values []string, s string) int {
+	for i, v := range values {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// orDefault returns s, or def if s is empty.
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
 	}
-	return "java"
+	return s
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestTarball writes a gzipped tarball with the files by name to dir and returns its path.
+func writeTestTarball(t *testing.T, dir string, files map[string]string) string {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "archive.tgz")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestExtractTarball(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestTarball(t, dir, map[string]string{
+		"kafka_2.12-2.6.0/bin/kafka-server-start.sh": "#!/bin/sh",
+		"./kafka_2.12-2.6.0/libs/kafka.jar":          "jar",
+	})
+
+	dst := filepath.Join(dir, "kafka")
+	if err := extractTarball(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, exp := range map[string]string{"bin/kafka-server-start.sh": "#!/bin/sh", "libs/kafka.jar": "jar"} {
+		data, err := ioutil.ReadFile(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != exp {
+			t.Fatalf("expected %q in %s, got %q", exp, path, data)
+		}
+	}
+	assertNotExist(t, makeExtractPath(dst))
+}
+
+func TestExtractTarballOutsideDst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeTestTarball(t, dir, map[string]string{
+		"kafka_2.12-2.6.0/libs/kafka.jar": "jar",
+		"kafka_2.12-2.6.0/../../.bashrc":  "echo pwned",
+	})
+
+	dst := filepath.Join(dir, "dist", "kafka")
+
+	err = extractTarball(dst, src)
+	if err == nil || !strings.Contains(err.Error(), "outside of the extraction directory") {
+		t.Fatalf("expected an error for the entry outside of the directory, got %v", err)
+	}
+
+	// Nothing is written outside of dst and the failed extraction doesn't look installed.
+
+	assertNotExist(t, filepath.Join(dir, ".bashrc"))
+	assertNotExist(t, filepath.Join(dir, "dist", ".bashrc"))
+	assertNotExist(t, dst)
+	assertNotExist(t, makeExtractPath(dst))
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// javaRuntime is a Java installation, either a JDK or a JRE.
+type javaRuntime struct {
+	home string
+	// version is the full version like 1.8.0_292 or 11.0.11.
+	version string
+}
+
+func (r javaRuntime) String() string {
+	return fmt.Sprintf("Java %s (%s)", r.version, r.home)
+}
+
+// Major returns the major version of Java, like 8 for 1.8.0_292.
+func (r javaRuntime) Major() int {
+	return parseJavaMajorVersion(r.version)
+}
+
+func (r javaRuntime) Binary() string {
+	return filepath.Join(r.home, "bin", "java")
+}
+
+func parseJavaMajorVersion(version string) int {
+	version = strings.TrimPrefix(version, "1.")
+	fields := strings.FieldsFunc(version, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(fields[0])
+	return n
+}
+
+// javaRange is the range of Java major versions supported by a version of Kafka.
+type javaRange struct {
+	min int
+	// max is 0 if there's no known maximum.
+	max int
+}
+
+func (r javaRange) Contains(major int) bool {
+	return major >= r.min && (r.max == 0 || major <= r.max)
+}
+
+func (r javaRange) String() string {
+	switch {
+	case r.max == 0:
+		return fmt.Sprintf("Java %d or later", r.min)
+	case r.min == r.max:
+		return fmt.Sprintf("Java %d", r.min)
+	default:
+		return fmt.Sprintf("Java %d to %d", r.min, r.max)
+	}
+}
+
+// javaRangeSince is the range of Java versions supported since a version of Kafka or Zookeeper.
+type javaRangeSince struct {
+	since string
+	javaRange
+}
+
+// findJavaRange returns the range of Java versions supporting a version, each range applies to the versions before the next one.
+func findJavaRange(ranges []javaRangeSince, version string) javaRange {
+	res := ranges[0].javaRange
+	for _, r := range ranges {
+		if compareVersions(version, r.since) >= 0 {
+			res = r.javaRange
+		}
+	}
+	return res
+}
+
+// kafkaJavaRanges are the Java versions supported by the brokers, from the Kafka release notes.
+var kafkaJavaRanges = []javaRangeSince{
+	{"0", javaRange{6, 8}},
+	{"0.9", javaRange{7, 8}},
+	{"2.0", javaRange{8, 8}},
+	{"2.1", javaRange{8, 11}},
+	{"2.6", javaRange{8, 15}},
+	{"2.8", javaRange{8, 16}},
+	{"3.0", javaRange{8, 17}},
+	{"3.6", javaRange{8, 21}},
+	{"4.0", javaRange{17, 0}},
+}
+
+// kafkaJavaRange returns the Java versions supported by a version of Apache Kafka.
+func kafkaJavaRange(version KafkaVersion) javaRange {
+	return findJavaRange(kafkaJavaRanges, string(version))
+}
+
+// zookeeperJavaRanges are the Java versions supported by Zookeeper, from its administrator guides.
+var zookeeperJavaRanges = []javaRangeSince{
+	{"0", javaRange{6, 8}},
+	{"3.5", javaRange{8, 12}},
+	{"3.8", javaRange{8, 17}},
+	{"3.9", javaRange{8, 21}},
+}
+
+// zookeeperJavaRange returns the Java versions supported by a version of Zookeeper.
+func zookeeperJavaRange(version string) javaRange {
+	return findJavaRange(zookeeperJavaRanges, version)
+}
+
+// clusterJavaRange returns the Java versions supported by the Kafka version of a cluster.
+func clusterJavaRange(cluster Cluster) javaRange {
+	return kafkaJavaRange(clusterDistribution(cluster).ApacheVersion(cluster.Version))
+}
+
+// javaSearchPatterns returns the places where Java runtimes are usually installed.
+func javaSearchPatterns() []string {
+	res := []string{
+		"/usr/lib/jvm/*",
+		"/usr/java/*",
+		"/usr/local/java/*",
+		"/opt/java/*",
+		"/opt/*jdk*",
+		"/opt/*jre*",
+		"/Library/Java/JavaVirtualMachines/*/Contents/Home",
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		res = append(res,
+			filepath.Join(home, ".sdkman", "candidates", "java", "*"),
+			filepath.Join(home, ".asdf", "installs", "java", "*"),
+			filepath.Join(home, ".jdks", "*"),
+		)
+	}
+
+	return res
+}
+
+// discoverJavaRuntimes returns the Java runtimes installed, sorted from the newest to the oldest.
+//
+// It looks at JAVA_HOME, the java command in the path used to run the brokers and the usual installation directories,
+// including the ones of sdkman and asdf.
+func discoverJavaRuntimes() []javaRuntime {
+	// 1. find the candidates
+
+	var candidates []string
+
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		candidates = append(candidates, home)
+	}
+	for _, dir := range []string{"/usr/bin", "/bin"} {
+		if p, err := filepath.EvalSymlinks(filepath.Join(dir, "java")); err == nil {
+			candidates = append(candidates, filepath.Dir(filepath.Dir(p)))
+		}
+	}
+	for _, pattern := range javaSearchPatterns() {
+		matches, _ := filepath.Glob(pattern)
+		candidates = append(candidates, matches...)
+	}
+
+	// 2. keep the valid ones.
+	// NOTE(vincent): the same runtime can be found multiple times through symlinks, like the current version of sdkman.
+
+	seen := make(map[string]bool)
+
+	var res []javaRuntime
+	for _, candidate := range candidates {
+		home, err := filepath.EvalSymlinks(candidate)
+		if err != nil || seen[home] {
+			continue
+		}
+		seen[home] = true
+
+		runtime, err := newJavaRuntime(home)
+		if err != nil {
+			continue
+		}
+		res = append(res, runtime)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return compareVersions(javaSortableVersion(res[i].version), javaSortableVersion(res[j].version)) > 0
+	})
+
+	return res
+}
+
+// javaSortableVersion returns a Java version without the 1. prefix of the old versions and with the update number
+// as a regular part, like 8.0.292 for 1.8.0_292.
+func javaSortableVersion(version string) string {
+	return strings.Replace(strings.TrimPrefix(version, "1."), "_", ".", -1)
+}
+
+// newJavaRuntime returns the Java runtime installed in home.
+func newJavaRuntime(home string) (javaRuntime, error) {
+	res := javaRuntime{home: home}
+
+	if fi, err := os.Stat(res.Binary()); err != nil || fi.IsDir() {
+		return res, fmt.Errorf("%q is not a Java runtime, it has no bin/java", home)
+	}
+
+	version, err := readJavaVersion(home)
+	if err != nil {
+		return res, fmt.Errorf("unable to get the version of Java in %q. err: %w", home, err)
+	}
+	res.version = version
+
+	return res, nil
+}
+
+var (
+	javaReleaseVersionPattern = regexp.MustCompile(`^JAVA_VERSION="([^"]+)"`)
+	javaVersionOutputPattern  = regexp.MustCompile(`version "([^"]+)"`)
+)
+
+// readJavaVersion returns the version of the Java runtime in home.
+//
+// It reads the release file of the runtime if there's one, or runs java -version.
+// The release file of a Java 8 JRE embedded in a JDK is in the JDK directory.
+func readJavaVersion(home string) (string, error) {
+	for _, dir := range []string{home, filepath.Dir(home)} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "release"))
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if m := javaReleaseVersionPattern.FindStringSubmatch(scanner.Text()); m != nil {
+				return m[1], nil
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// NOTE(vincent): java -version prints to stderr.
+	output, err := exec.CommandContext(ctx, filepath.Join(home, "bin", "java"), "-version").CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+
+	m := javaVersionOutputPattern.FindSubmatch(output)
+	if m == nil {
+		return "", fmt.Errorf("unexpected output of java -version %q", output)
+	}
+
+	return string(m[1]), nil
+}
+
+// findCompatibleJavaRuntime returns the newest Java runtime in the range, or false if there's none.
+func findCompatibleJavaRuntime(runtimes []javaRuntime, r javaRange) (javaRuntime, bool) {
+	for _, runtime := range runtimes {
+		if r.Contains(runtime.Major()) {
+			return runtime, true
+		}
+	}
+	return javaRuntime{}, false
+}
+
+// parseJavaOption returns the runtime selected with the -java flag of create, either a major version like 11
+// or the path of a Java runtime.
+func parseJavaOption(value string) (javaRuntime, error) {
+	if major, err := strconv.Atoi(value); err == nil {
+		for _, runtime := range discoverJavaRuntimes() {
+			if runtime.Major() == major {
+				return runtime, nil
+			}
+		}
+		return javaRuntime{}, fmt.Errorf("no Java %d runtime found, use the path of a Java runtime instead", major)
+	}
+
+	home, err := filepath.Abs(strings.TrimSuffix(value, filepath.Join("bin", "java")))
+	if err != nil {
+		return javaRuntime{}, err
+	}
+
+	return newJavaRuntime(filepath.Clean(home))
+}
+
+// readProcessJavaRuntime returns the Java runtime of a running process, based on its executable.
+func readProcessJavaRuntime(pid int) (javaRuntime, error) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return javaRuntime{}, err
+	}
+
+	return newJavaRuntime(filepath.Dir(filepath.Dir(exe)))
+}
+
+// resolveClusterJava returns the Java runtime used to run the brokers of a cluster, the java command by default.
+//
+// The -java-home flag overrides the runtime of the cluster. If the cluster has no runtime yet, or if it doesn't
+// exist anymore, a compatible runtime is selected and stored for the next starts.
+func resolveClusterJava(ctx context.Context, cluster Cluster) (string, error) {
+	if *globalJavaHome != "" {
+		return *globalJavaHome, nil
+	}
+
+	if cluster.JavaHome != "" {
+		if _, err := os.Stat(filepath.Join(cluster.JavaHome, "bin", "java")); err == nil {
+			return cluster.JavaHome, nil
+		}
+		log.Printf("the Java runtime %s of cluster %q doesn't exist anymore", cluster.JavaHome, cluster.Name)
+	}
+
+	r := clusterJavaRange(cluster)
+
+	runtime, ok := findCompatibleJavaRuntime(discoverJavaRuntimes(), r)
+	if !ok {
+		return "", fmt.Errorf("no Java runtime compatible with Kafka %s found (it requires %s), install one or use -java-home", cluster.Version, r)
+	}
+
+	if err := setClusterJavaHome(ctx, cluster, runtime.home); err != nil {
+		return "", err
+	}
+	log.Printf("cluster %q now uses %s", cluster.Name, runtime)
+
+	return runtime.home, nil
+}
+
+// resolveZookeeperJava returns the Java runtime used to run the nodes of a Zookeeper ensemble.
+//
+// Like for a cluster, the -java-home flag overrides the runtime of the ensemble. If the ensemble has no runtime yet,
+// or if it doesn't exist anymore, a compatible runtime is selected and stored for the next starts.
+func resolveZookeeperJava(ctx context.Context, zookeeper Zookeeper) (string, error) {
+	if *globalJavaHome != "" {
+		return *globalJavaHome, nil
+	}
+
+	if zookeeper.JavaHome != "" {
+		if _, err := os.Stat(filepath.Join(zookeeper.JavaHome, "bin", "java")); err == nil {
+			return zookeeper.JavaHome, nil
+		}
+		log.Printf("the Java runtime %s of zookeeper %q doesn't exist anymore", zookeeper.JavaHome, zookeeper.Name)
+	}
+
+	r := zookeeperJavaRange(zookeeper.Version)
+
+	runtime, ok := findCompatibleJavaRuntime(discoverJavaRuntimes(), r)
+	if !ok {
+		return "", fmt.Errorf("no Java runtime compatible with Zookeeper %s found (it requires %s), install one or use -java-home", zookeeper.Version, r)
+	}
+
+	if err := setZookeeperJavaHome(ctx, zookeeper, runtime.home); err != nil {
+		return "", err
+	}
+	log.Printf("zookeeper %q now uses %s", zookeeper.Name, runtime)
+
+	return runtime.home, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultBrokerHeap is the maximum heap size of a broker when none is configured.
+const defaultBrokerHeap = "512m"
+
+// JVMSettings are the settings of the JVM running a broker, either for the whole cluster or for a single broker.
+type JVMSettings struct {
+	// Heap is the maximum heap size like 1g, passed with -Xmx.
+	Heap string
+	// Options are passed to the JVM as is, like GC flags or system properties.
+	Options []string
+	// Env are the environment variables like KEY=VALUE added to the ones of the broker.
+	Env []string
+}
+
+func (s JVMSettings) IsEmpty() bool {
+	return s.Heap == "" && len(s.Options) == 0 && len(s.Env) == 0
+}
+
+func (s JVMSettings) String() string {
+	var parts []string
+	if s.Heap != "" {
+		parts = append(parts, "heap:"+s.Heap)
+	}
+	if len(s.Options) > 0 {
+		parts = append(parts, "options:"+strings.Join(s.Options, " "))
+	}
+	if len(s.Env) > 0 {
+		parts = append(parts, "env:"+strings.Join(s.Env, " "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var heapSizePattern = regexp.MustCompile(`^\d+[kKmMgG]?$`)
+
+// Validate returns an error if the heap size or an environment variable is invalid.
+func (s JVMSettings) Validate() error {
+	if s.Heap != "" && !heapSizePattern.MatchString(s.Heap) {
+		return fmt.Errorf("invalid heap size %q, must be like 512m or 2g", s.Heap)
+	}
+	for _, env := range s.Env {
+		if i := strings.IndexByte(env, '='); i <= 0 {
+			return fmt.Errorf("invalid environment variable %q, must be like KEY=VALUE", env)
+		}
+	}
+	return nil
+}
+
+// parseBrokerJVMSettings returns the settings of each broker from flags like 2:-XX:+UseG1GC, prefixed by the broker id.
+// set stores the value in the settings of the broker.
+func parseBrokerJVMSettings(values []string, settings map[int]*JVMSettings, set func(s *JVMSettings, value string)) error {
+	for _, value := range values {
+		i := strings.IndexByte(value, ':')
+		if i < 0 {
+			return fmt.Errorf("invalid broker setting %q, must be prefixed by the broker id like 1:value", value)
+		}
+		id, err := strconv.Atoi(value[:i])
+		if err != nil {
+			return fmt.Errorf("invalid broker id in %q", value)
+		}
+
+		s, ok := settings[id]
+		if !ok {
+			s = new(JVMSettings)
+			settings[id] = s
+		}
+		set(s, value[i+1:])
+	}
+	return nil
+}
+
+// brokerJVMArgs returns the arguments of the JVM running a broker, before its class path.
+// The settings of the broker are applied after the ones of the cluster so they take precedence.
+func brokerJVMArgs(cluster Cluster, broker Broker, opts startOptions) []string {
+	heap := defaultBrokerHeap
+	if cluster.JVM.Heap != "" {
+		heap = cluster.JVM.Heap
+	}
+	if broker.JVM.Heap != "" {
+		heap = broker.JVM.Heap
+	}
+
+	res := []string{"-Xmx" + heap}
+	if runtime, err := newJavaRuntime(cluster.JavaHome); err == nil {
+		res = append(res, gcLogArgs(runtime.Major(), makeBrokerGCLogPath(cluster, broker))...)
+	}
+	if broker.JMXPort > 0 {
+		res = append(res, jmxArgs(broker)...)
+	}
+	if agent, ok := opts.debug[broker.ID]; ok {
+		res = append(res, agent.Arg())
+	}
+	res = append(res, cluster.JVM.Options...)
+	res = append(res, broker.JVM.Options...)
+
+	return res
+}
+
+// gcLogArgs returns the arguments enabling the GC log of a JVM in path, rotated like Kafka does by default.
+// The options changed with Java 9, nothing is returned if the version is unknown.
+func gcLogArgs(major int, path string) []string {
+	switch {
+	case major >= 9:
+		return []string{fmt.Sprintf("-Xlog:gc*:file=%s:time,tags:filecount=%d,filesize=%s", path, gcLogFiles, gcLogFileSize)}
+	case major > 0:
+		return []string{
+			"-Xloggc:" + path,
+			"-verbose:gc", "-XX:+PrintGCDetails", "-XX:+PrintGCDateStamps", "-XX:+PrintGCTimeStamps",
+			"-XX:+UseGCLogFileRotation", fmt.Sprintf("-XX:NumberOfGCLogFiles=%d", gcLogFiles), "-XX:GCLogFileSize=" + gcLogFileSize,
+		}
+	default:
+		return nil
+	}
+}
+
+const (
+	gcLogFiles    = 10
+	gcLogFileSize = "20M"
+)
+
+func makeBrokerGCLogPath(cluster Cluster, broker Broker) string {
+	return filepath.Join(makeBrokerDir(cluster.Name, broker.ID), "gc.log")
+}
+
+// findBrokerGCLog returns the GC log currently written by a broker, or an empty string if there's none.
+// Java 8 adds the number of the file and .current to the name of the file being written.
+func findBrokerGCLog(cluster Cluster, broker Broker) string {
+	path := makeBrokerGCLogPath(cluster, broker)
+	if fileExists(path) {
+		return path
+	}
+	if matches, _ := filepath.Glob(path + ".*.current"); len(matches) > 0 {
+		return matches[0]
+	}
+	return ""
+}
+
+// brokerEnv returns the environment variables added for a broker.
+func brokerEnv(cluster Cluster, broker Broker) []string {
+	var res []string
+	res = append(res, cluster.JVM.Env...)
+	res = append(res, broker.JVM.Env...)
+	return res
+}
+
+// jmxArgs returns the system properties enabling JMX on the port of a broker, without authentication nor TLS.
+// NOTE(vincent): the RMI port is the same as the JMX port so that only one port has to be known by the clients.
+func jmxArgs(broker Broker) []string {
+	host := broker.Addr.IP.String()
+	if broker.Addr.IP == nil || broker.Addr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	return []string{
+		"-Dcom.sun.management.jmxremote",
+		"-Dcom.sun.management.jmxremote.authenticate=false",
+		"-Dcom.sun.management.jmxremote.ssl=false",
+		fmt.Sprintf("-Dcom.sun.management.jmxremote.port=%d", broker.JMXPort),
+		fmt.Sprintf("-Dcom.sun.management.jmxremote.rmi.port=%d", broker.JMXPort),
+		"-Djava.rmi.server.hostname=" + host,
+	}
+}
+
+// allocateJMXPorts sets the JMX port of each broker to the first free port after 9999.
+// The ports already attributed to a broker or a Zookeeper node are never reused, even if they're not currently in use.
+func allocateJMXPorts(ctx context.Context, brokers []Broker) error {
+	used, err := listUsedPorts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, broker := range brokers {
+		used[broker.Addr.Port] = true
+	}
+
+	for i := range brokers {
+		port, err := findFreePort("127.0.0.1", 9999, used)
+		if err != nil {
+			return err
+		}
+		used[port] = true
+
+		brokers[i].JMXPort = port
+	}
+
+	return nil
+}
+
+// debugAgent is the JDWP agent added to a broker started with start -debug.
+type debugAgent struct {
+	port int
+	// suspend makes the JVM wait for a debugger to attach before running the broker.
+	suspend bool
+}
+
+func (a debugAgent) Arg() string {
+	suspend := "n"
+	if a.suspend {
+		suspend = "y"
+	}
+	return fmt.Sprintf("-agentlib:jdwp=transport=dt_socket,server=y,suspend=%s,address=127.0.0.1:%d", suspend, a.port)
+}
+
+var jdwpAgentPattern = regexp.MustCompile(`-agentlib:jdwp=(\S+)`)
+
+// parseDebugAgent returns the JDWP agent in the command line of a broker, or false if there's none.
+func parseDebugAgent(cmdline string) (debugAgent, bool) {
+	m := jdwpAgentPattern.FindStringSubmatch(cmdline)
+	if m == nil {
+		return debugAgent{}, false
+	}
+
+	// NOTE(vincent): the JVM suspends by default.
+	res := debugAgent{suspend: true}
+
+	for _, option := range strings.Split(m[1], ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "address":
+			res.port, _ = strconv.Atoi(parts[1][strings.LastIndexByte(parts[1], ':')+1:])
+		case "suspend":
+			res.suspend = parts[1] == "y"
+		}
+	}
+
+	return res, res.port > 0
+}
+
+// allocateDebugAgents returns a JDWP agent for each broker on the first free ports starting at 5005.
+// The ports of the brokers of the cluster are never used.
+func allocateDebugAgents(cluster Cluster, brokers []Broker, suspend bool) (map[int]debugAgent, error) {
+	used := make(map[int]bool)
+	for _, broker := range cluster.Brokers {
+		used[broker.Addr.Port] = true
+		used[broker.JMXPort] = true
+	}
+
+	res := make(map[int]debugAgent, len(brokers))
+	for _, broker := range brokers {
+		port, err := findFreePort("127.0.0.1", 5005, used)
+		if err != nil {
+			return nil, err
+		}
+		used[port] = true
+
+		res[broker.ID] = debugAgent{port: port, suspend: suspend}
+	}
+
+	return res, nil
+}
@@ -6,26 +6,78 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"syscall"
+	"regexp"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
-func makeKafkaExtractedPath(version KafkaVersion) string {
-	return filepath.Join(dataDir, "kafka_"+string(version))
+// legacyScalaVersion is the Scala version of the Kafka builds used by versions of kcm before the Scala version could be chosen.
+const legacyScalaVersion = "2.12"
+
+var scalaVersionPattern = regexp.MustCompile(`^\d+\.\d+$`)
+
+// defaultScalaVersion returns the Scala version of the Kafka build used when none is provided.
+//
+// Old releases were only published for old versions of Scala and recent ones recommend Scala 2.13.
+func defaultScalaVersion(version KafkaVersion) string {
+	switch {
+	case compareVersions(string(version), "0.8.2") < 0:
+		return "2.10"
+	case compareVersions(string(version), "0.10.2") < 0:
+		return "2.11"
+	case compareVersions(string(version), "3.0") < 0:
+		return "2.12"
+	default:
+		return "2.13"
+	}
+}
+
+// NOTE(vincent): older versions of kcm only used the Scala 2.12 builds and didn't include the Scala version in the paths.
+// Their paths are still used if they exist, a broker may be running from them.
+
+func makeKafkaExtractedPath(version KafkaVersion, scala string) string {
+	if scala == legacyScalaVersion {
+		if legacyPath := filepath.Join(dataDir, "kafka_"+string(version)); isDir(legacyPath) {
+			return legacyPath
+		}
+	}
+	return filepath.Join(dataDir, makeKafkaDistName(version, scala))
+}
+
+func makeKafkaTarballPath(version KafkaVersion, scala string) string {
+	if scala == legacyScalaVersion {
+		if legacyPath := filepath.Join(cacheDir, "kafka_"+string(version)+".tar.gz"); fileExists(legacyPath) {
+			return legacyPath
+		}
+	}
+	return filepath.Join(cacheDir, makeKafkaDistName(version, scala)+".tgz")
+}
+
+// makeKafkaDistName returns the name of a Kafka build like kafka_2.13-2.6.0, the same name Apache uses.
+func makeKafkaDistName(version KafkaVersion, scala string) string {
+	return fmt.Sprintf("kafka_%s-%s", scala, version)
 }
 
-func makeKafkaTarballPath(version KafkaVersion) string {
-	return filepath.Join(cacheDir, "kafka_"+string(version)+".tar.gz")
+var kafkaDistNamePattern = regexp.MustCompile(`^kafka_(\d+\.\d+)-(.+)$`)
+
+// parseKafkaDistName returns the version and the Scala version of a Kafka build from its name, like kafka_2.13-2.6.0.
+// The names without a Scala version used by older versions of kcm are Scala 2.12 builds.
+func parseKafkaDistName(name string) (KafkaVersion, string) {
+	if m := kafkaDistNamePattern.FindStringSubmatch(name); m != nil {
+		return KafkaVersion(m[2]), m[1]
+	}
+	return KafkaVersion(strings.TrimPrefix(name, "kafka_")), legacyScalaVersion
 }
 
 // extractKafkaArchive extracts a tarball of Kafka to the kcm data directory.
 // This assumes the tarball exists.
-func extractKafkaArchive(version KafkaVersion) error {
+func extractKafkaArchive(dist *kafkaDistribution, version KafkaVersion, scala string) error {
 	// 1. check if it's already extracted.
 	// If it is we don't have to do anything.
 
-	extractedPath := makeKafkaExtractedPath(version)
+	extractedPath := dist.ExtractedPath(version, scala)
 
 	fi, err := os.Stat(extractedPath)
 	switch {
@@ -39,80 +91,247 @@ func extractKafkaArchive(version KafkaVersion) error {
 
 	// 2. doesn't exist, extract the tarball
 
-	return extractTarball(extractedPath, makeKafkaTarballPath(version))
+	return extractTarball(extractedPath, dist.TarballPath(version, scala))
 }
 
 // downloadKafkaArchive downloads a Kafka tarball if it doesn't exist.
-func downloadKafkaArchive(version KafkaVersion) error {
-	// 1. check if it's already downloaded.
-	// If it is we don't have to do anything.
+func downloadKafkaArchive(dist *kafkaDistribution, version KafkaVersion, scala string) error {
+	dst := dist.TarballPath(version, scala)
 
-	p := makeKafkaTarballPath(version)
+	return downloadArtifact(dst, dist.ExtractedPath(version, scala), func(d *downloader) error {
+		return dist.Fetch(d, dst, version, scala)
+	})
+}
 
-	fi, err := os.Stat(p)
-	switch {
-	case err != nil && !os.IsNotExist(err):
+// installKafka downloads and extracts Kafka if necessary.
+func installKafka(dist *kafkaDistribution, version KafkaVersion, scala string) error {
+	lock, err := acquireLock(makeArtifactLockName(dist.ExtractedPath(version, scala)))
+	if err != nil {
 		return err
-	case err == nil && fi.IsDir():
-		return fmt.Errorf("path %q is a directory, can't extract it", p)
-	case err == nil:
-		return nil
 	}
+	defer lock.Release()
 
-	// 2. doesn't exist, download the tarball
-
-	filename := fmt.Sprintf("/kafka/%s/kafka_2.12-%s.tgz", version, version)
-	err = downloadFromApacheCloser(p, filename)
-	if err == nil {
-		return nil
+	if err := downloadKafkaArchive(dist, version, scala); err != nil {
+		return fmt.Errorf("unable to download archive. err: %w", err)
 	}
-	if err != nil && err != errNotFound {
-		return err
+	if err := extractKafkaArchive(dist, version, scala); err != nil {
+		return fmt.Errorf("unable to extract archive. err: %w", err)
 	}
 
-	filename = fmt.Sprintf("/kafka/%s/kafka_2.12-%s.tgz", version, version)
-	return downloadFromApacheArchive(p, filename)
+	return nil
 }
 
 func makeBrokerDir(name ClusterName, id int) string {
 	return filepath.Join(dataDir, string(name), fmt.Sprintf("broker%d", id))
 }
 
-func writeKafkaLog4jConfig(cluster Cluster, broker Broker) error {
-	const tpl = `log4j.rootLogger=INFO, F
-log4j.appender.F=org.apache.log4j.FileAppender
-log4j.appender.F.file={{ .LogFile }}
-log4j.appender.F.layout=org.apache.log4j.PatternLayout
-log4j.appender.F.layout.ConversionPattern=%d{ISO8601} - %-5p [%t:%C{1}@%L] - %m%n`
+// kafkaLoggingTemplates are the templates of the logging config of the brokers, by logging backend.
+var kafkaLoggingTemplates = map[loggingBackend]string{
+	loggingLog4j: `log4j.rootLogger={{ .RootLevel }}, F
+{{- range .Appenders }}
+
+log4j.appender.{{ .Name }}=org.apache.log4j.RollingFileAppender
+log4j.appender.{{ .Name }}.File={{ .File }}
+log4j.appender.{{ .Name }}.MaxFileSize={{ .MaxFileSize }}
+log4j.appender.{{ .Name }}.MaxBackupIndex={{ .MaxFiles }}
+log4j.appender.{{ .Name }}.layout=org.apache.log4j.PatternLayout
+log4j.appender.{{ .Name }}.layout.ConversionPattern=%d{ISO8601} - %-5p [%t:%C{1}@%L] - %m%n
+{{- end }}
+{{- if .Loggers }}
+{{ range .Loggers }}
+log4j.logger.{{ .Name }}={{ .Level }}{{ if .Appender }}, {{ .Appender }}
+log4j.additivity.{{ .Name }}=false{{ end }}
+{{- end }}
+{{- end }}
+`,
+	loggingLog4j2: `status=warn
+rootLogger.level={{ .RootLevel }}
+rootLogger.appenderRef.F.ref=F
+{{- range .Appenders }}
+
+appender.{{ .Name }}.type=RollingFile
+appender.{{ .Name }}.name={{ .Name }}
+appender.{{ .Name }}.fileName={{ .File }}
+appender.{{ .Name }}.filePattern={{ .File }}.%i
+appender.{{ .Name }}.layout.type=PatternLayout
+appender.{{ .Name }}.layout.pattern=%d{ISO8601} - %-5p [%t:%C{1}@%L] - %m%n
+appender.{{ .Name }}.policies.type=Policies
+appender.{{ .Name }}.policies.size.type=SizeBasedTriggeringPolicy
+appender.{{ .Name }}.policies.size.size={{ .MaxFileSize }}
+appender.{{ .Name }}.strategy.type=DefaultRolloverStrategy
+appender.{{ .Name }}.strategy.max={{ .MaxFiles }}
+{{- end }}
+{{- if .Loggers }}
+{{ range $i, $logger := .Loggers }}
+logger.l{{ $i }}.name={{ .Name }}
+logger.l{{ $i }}.level={{ .Level }}
+{{- if .Appender }}
+logger.l{{ $i }}.additivity=false
+logger.l{{ $i }}.appenderRef.{{ .Appender }}.ref={{ .Appender }}
+{{- end }}
+{{- end }}
+{{- end }}
+`,
+}
+
+// kafkaLogger is a logger of a broker with its own level, written to its own appender if set instead of the root one.
+type kafkaLogger struct {
+	Name     string
+	Level    string
+	Appender string
+}
+
+// writeKafkaLoggingConfig writes the logging config of a broker for the logging backend of its distribution and returns its path.
+// The log files are rolled once they reach the maximum size of the cluster, with the separate controller, state change
+// and request log files of Kafka if enabled.
+func writeKafkaLoggingConfig(cluster Cluster, broker Broker, backend loggingBackend) (string, error) {
+	tpl, ok := kafkaLoggingTemplates[backend]
+	if !ok {
+		return "", fmt.Errorf("the logging backend %s of the Kafka distribution isn't supported", backend)
+	}
 
 	tmpl, err := template.New("root").Parse(tpl)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	//
 
 	brokerPath := makeBrokerDir(cluster.Name, broker.ID)
 
-	p := filepath.Join(brokerPath, "log4j.properties")
+	p := filepath.Join(brokerPath, backend.ConfigFile())
 	f, err := os.Create(p)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer f.Close()
 
 	//
 
-	data := struct {
-		LogFile string
-	}{
-		LogFile: filepath.Join(brokerPath, "kafka.log"),
+	type appender struct {
+		Name        string
+		File        string
+		MaxFileSize string
+		MaxFiles    int
 	}
 
-	return tmpl.Execute(f, data)
+	var data struct {
+		RootLevel string
+		Appenders []appender
+		Loggers   []kafkaLogger
+	}
+	data.RootLevel = "INFO"
+
+	addAppender := func(name, file string) {
+		data.Appenders = append(data.Appenders, appender{
+			Name:        name,
+			File:        filepath.Join(brokerPath, file),
+			MaxFileSize: cluster.Logs.maxFileSize(),
+			MaxFiles:    cluster.Logs.maxFiles(),
+		})
+	}
+
+	addAppender("F", brokerLogFiles["kafka"])
+	if cluster.Logs.Separate {
+		addAppender("controller", brokerLogFiles["controller"])
+		addAppender("stateChange", brokerLogFiles["state-change"])
+		addAppender("request", brokerLogFiles["request"])
+
+		// Same as the default config of Kafka.
+		data.Loggers = append(data.Loggers,
+			kafkaLogger{Name: "kafka.controller", Level: "TRACE", Appender: "controller"},
+			kafkaLogger{Name: "state.change.logger", Level: "INFO", Appender: "stateChange"},
+			kafkaLogger{Name: "kafka.request.logger", Level: "WARN", Appender: "request"},
+			kafkaLogger{Name: "kafka.network.RequestChannel$", Level: "WARN", Appender: "request"},
+		)
+	}
+
+	// The persistent levels set with kcm loglevel override the default ones.
+
+	levels := brokerLogLevels(cluster, broker)
+	for _, name := range sortedLoggers(levels) {
+		if name == rootLogger {
+			data.RootLevel = levels[name]
+			continue
+		}
+
+		found := false
+		for i := range data.Loggers {
+			if data.Loggers[i].Name == name {
+				data.Loggers[i].Level = levels[name]
+				found = true
+			}
+		}
+		if !found {
+			data.Loggers = append(data.Loggers, kafkaLogger{Name: name, Level: levels[name]})
+		}
+	}
+
+	if err := tmpl.Execute(f, data); err != nil {
+		return "", err
+	}
+
+	return p, nil
 }
 
 func writeKafkaConfig(cluster Cluster, broker Broker) error {
-	const tpl = `broker.id={{ .BrokerID }}
+	// NOTE(vincent): the kcm.* comments are not used by Kafka, they allow kcm to rebuild its database from the config files.
+
+	const tpl = `# Generated by kcm
+# kcm.kafka.path={{ .KafkaPath }}
+{{- if or .Custom (ne .Distribution "apache") }}
+# kcm.kafka.distribution={{ .Distribution }}
+# kcm.kafka.version={{ .Version }}
+# kcm.kafka.scala={{ .Scala }}
+{{- end }}
+{{- if .JavaHome }}
+# kcm.java.home={{ .JavaHome }}
+{{- end }}
+{{- if .JVM.Heap }}
+# kcm.jvm.heap={{ .JVM.Heap }}
+{{- end }}
+{{- range $i, $v := .JVM.Options }}
+# kcm.jvm.option.{{ $i }}={{ $v }}
+{{- end }}
+{{- range $i, $v := .JVM.Env }}
+# kcm.jvm.env.{{ $i }}={{ $v }}
+{{- end }}
+{{- if .BrokerJVM.Heap }}
+# kcm.broker.jvm.heap={{ .BrokerJVM.Heap }}
+{{- end }}
+{{- range $i, $v := .BrokerJVM.Options }}
+# kcm.broker.jvm.option.{{ $i }}={{ $v }}
+{{- end }}
+{{- range $i, $v := .BrokerJVM.Env }}
+# kcm.broker.jvm.env.{{ $i }}={{ $v }}
+{{- end }}
+{{- if .JMXPort }}
+# kcm.broker.jmx.port={{ .JMXPort }}
+{{- end }}
+{{- range $i, $v := .PluginPaths }}
+# kcm.plugin.path.{{ $i }}={{ $v }}
+{{- end }}
+{{- if .Logs.MaxFileSize }}
+# kcm.log.max.file.size={{ .Logs.MaxFileSize }}
+{{- end }}
+{{- if .Logs.MaxFiles }}
+# kcm.log.max.files={{ .Logs.MaxFiles }}
+{{- end }}
+{{- if .Logs.Separate }}
+# kcm.log.separate=true
+{{- end }}
+{{- range $logger, $level := .LogLevels }}
+# kcm.log.level.{{ $logger }}={{ $level }}
+{{- end }}
+{{- range $logger, $level := .BrokerLogLevels }}
+# kcm.broker.log.level.{{ $logger }}={{ $level }}
+{{- end }}
+{{- if .Custom }}
+# kcm.custom.name={{ .Custom.Name }}
+# kcm.custom.source={{ .Custom.Source }}
+# kcm.custom.location={{ .Custom.Location }}
+{{- end }}
+broker.id={{ .BrokerID }}
 listeners=PLAINTEXT://{{ .Addr }}
 log.dirs={{ .LogDir }}
 offsets.topic.replication.factor=1
@@ -145,29 +364,64 @@ group.initial.rebalance.delay.ms=0
 	//
 
 	data := struct {
-		BrokerID int
-		Addr     string
-		LogDir   string
-		ZkAddr   string
-		ZkPrefix string
+		KafkaPath       string
+		Version         KafkaVersion
+		Scala           string
+		Distribution    string
+		JavaHome        string
+		JVM             JVMSettings
+		BrokerJVM       JVMSettings
+		JMXPort         int
+		PluginPaths     []string
+		Logs            LogSettings
+		LogLevels       map[string]string
+		BrokerLogLevels map[string]string
+		Custom          *CustomDistribution
+		BrokerID        int
+		Addr            string
+		LogDir          string
+		ZkAddr          string
+		ZkPrefix        string
 	}{
-		BrokerID: broker.ID,
-		Addr:     broker.Addr.String(),
-		LogDir:   filepath.Join(path, "data"),
-		ZkAddr:   *globalZkAddr,
-		ZkPrefix: string(cluster.Name),
+		KafkaPath:       makeClusterKafkaPath(cluster),
+		Version:         cluster.Version,
+		Scala:           cluster.ScalaVersion,
+		Distribution:    cluster.Distribution,
+		JavaHome:        cluster.JavaHome,
+		JVM:             cluster.JVM,
+		BrokerJVM:       broker.JVM,
+		JMXPort:         broker.JMXPort,
+		PluginPaths:     cluster.PluginPaths,
+		Logs:            cluster.Logs,
+		LogLevels:       cluster.LogLevels,
+		BrokerLogLevels: broker.LogLevels,
+		Custom:          cluster.Custom,
+		BrokerID:        broker.ID,
+		Addr:            broker.Addr.String(),
+		LogDir:          filepath.Join(path, "data"),
+		ZkAddr:          cluster.Zookeeper.ConnectString(),
+		ZkPrefix:        string(cluster.Name),
 	}
 
 	return tmpl.Execute(f, data)
 }
 
-func startBroker(ctx context.Context, cluster Cluster, broker Broker) error {
+// startOptions controls how the brokers are started.
+type startOptions struct {
+	// debug are the JDWP agents of the brokers started with a debugger, by broker id.
+	debug map[int]debugAgent
+}
+
+func startBroker(ctx context.Context, cluster Cluster, broker Broker, opts startOptions) error {
 	// 1. check if the cluster is already started.
 	status, err := getBrokerStatus(ctx, cluster, broker)
 	if err != nil {
 		return fmt.Errorf("unable to get kafka broker pid. err: %w", err)
 	}
 	if status.IsStarted() {
+		if _, ok := opts.debug[broker.ID]; ok {
+			log.Printf("broker %d is already started without a debugger, stop it first", broker.ID)
+		}
 		return nil
 	}
 
@@ -179,11 +433,8 @@ func startBroker(ctx context.Context, cluster Cluster, broker Broker) error {
 
 	// 3. download and extract kafka if necessary
 
-	if err := downloadKafkaArchive(cluster.Version); err != nil {
-		return fmt.Errorf("unable to download archive. err: %w", err)
-	}
-	if err := extractKafkaArchive(cluster.Version); err != nil {
-		return fmt.Errorf("unable to extract archive. err: %w", err)
+	if err := installClusterKafka(cluster); err != nil {
+		return err
 	}
 
 	// 4. write the kafka configuration files
@@ -191,37 +442,62 @@ func startBroker(ctx context.Context, cluster Cluster, broker Broker) error {
 	if err := writeKafkaConfig(cluster, broker); err != nil {
 		return err
 	}
-	if err := writeKafkaLog4jConfig(cluster, broker); err != nil {
+	backend, err := detectKafkaLoggingBackend(cluster)
+	if err != nil {
+		return err
+	}
+	loggingConfig, err := writeKafkaLoggingConfig(cluster, broker, backend)
+	if err != nil {
 		return err
 	}
 
 	// 5. prepare the command line to run kafka.
 	// NOTE(vincent): we don't use the provided shell script, instead we build the proper command line ourselves.
 
-	extractedPath := makeKafkaExtractedPath(cluster.Version)
+	extractedPath := makeClusterKafkaPath(cluster)
 	config := filepath.Join(makeBrokerDir(cluster.Name, broker.ID), "server.properties")
-	log4jConfig := filepath.Join(makeBrokerDir(cluster.Name, broker.ID), "log4j.properties")
 
-	cp, err := constructClasspath(filepath.Join(extractedPath, "libs"))
+	dist := clusterDistribution(cluster)
+
+	cp, err := makeClusterClasspath(cluster)
 	if err != nil {
 		return err
 	}
 
 	// 6. finally run the command. This doesn't block.
+	// The process marker is only used to identify the process later.
+
+	marker := makeBrokerProcessMarker(cluster, broker)
+
+	args := brokerJVMArgs(cluster, broker, opts)
+	args = append(args,
+		"-cp", cp,
+		backend.JVMProperty(loggingConfig),
+		marker,
+		dist.MainClass, config,
+	)
 
-	bg, err := runBackgroundCommand(ctx, extractedPath,
-		getJavaBinary(), "-Xmx512m", "-cp", cp,
-		"-Dlog4j.configuration=file:"+log4jConfig,
-		"kafka.Kafka", config,
+	// The standard output is kept for the thread dumps of kcm jvm threads.
+	bg, err := runBackgroundCommand(ctx, extractedPath, brokerEnv(cluster, broker), makeBrokerDir(cluster.Name, broker.ID),
+		filepath.Join(cluster.JavaHome, "bin", "java"), args...,
 	)
 	if err != nil {
 		return err
 	}
+	bg.process.marker = marker
+
+	if agent, ok := opts.debug[broker.ID]; ok {
+		if agent.suspend {
+			log.Printf("broker %d is waiting for a debugger on 127.0.0.1:%d", broker.ID, agent.port)
+		} else {
+			log.Printf("broker %d debugger listening on 127.0.0.1:%d", broker.ID, agent.port)
+		}
+	}
 
 	// 7. update the broker status
 
 	newStatus := brokerStatus{
-		pid:     bg.pid,
+		process: bg.process,
 		cluster: cluster,
 		broker:  broker,
 	}
@@ -233,33 +509,36 @@ func startBroker(ctx context.Context, cluster Cluster, broker Broker) error {
 	return nil
 }
 
-func stopBroker(ctx context.Context, cluster Cluster, broker Broker) error {
+// stopBroker stops a broker and waits for it to exit, killing it if it's still running after the timeout.
+// It returns a description of how the broker was stopped.
+func stopBroker(ctx context.Context, cluster Cluster, broker Broker, opts stopOptions) (string, error) {
 	// 1. check if the broker is started.
 	status, err := getBrokerStatus(ctx, cluster, broker)
 	if err != nil {
-		return fmt.Errorf("unable to get kafka broker pid. err: %w", err)
+		return "", fmt.Errorf("unable to get kafka broker pid. err: %w", err)
 	}
 	if !status.IsValid() || !status.IsStarted() {
-		return nil
+		return "not started", nil
 	}
 
-	// 2. terminate the broker
-	if err := syscall.Kill(status.pid, syscall.Signal(15)); err != nil {
-		return fmt.Errorf("unable to send interrupt signal to broker %d. err: %w", broker.ID, err)
-	}
+	// 2. terminate the broker and wait for it to exit
+
+	start := time.Now()
 
-	// 3. wait for the broker to be terminated
-	for status.IsStarted() {
-		log.Printf("waiting 1s for broker %d to terminate", broker.ID)
-		time.Sleep(1 * time.Second)
+	killed, err := terminateProcess(status.process.pid, opts.timeout)
+	if err != nil {
+		return "", fmt.Errorf("unable to stop broker %d. err: %w", broker.ID, err)
 	}
 
-	// 4. broker terminated, remove its status
+	// 3. broker terminated, remove its status
 	if err := removeBrokerStatus(ctx, cluster, broker); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	if killed {
+		return fmt.Sprintf("killed after %s", opts.timeout), nil
+	}
+	return fmt.Sprintf("stopped in %s", time.Since(start).Round(100*time.Millisecond)), nil
 }
 
 func removeBrokerData(cluster Cluster, broker Broker) error {
@@ -268,9 +547,64 @@ func removeBrokerData(cluster Cluster, broker Broker) error {
 	return os.RemoveAll(dir)
 }
 
-func stopCluster(ctx context.Context, cluster Cluster) error {
+// getClusterController returns the id of the controller broker of a cluster, or 0 if it can't be determined.
+func getClusterController(ctx context.Context, cluster Cluster) int {
+	// The Zookeeper client doesn't give up if Zookeeper is not reachable so don't wait for too long.
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	browser, err := newZkBrowser(cluster)
+	if err != nil {
+		return 0
+	}
+	defer browser.Close()
+
+	var id int
+	err = browser.Run(ctx, func() (err error) {
+		id, err = browser.Controller()
+		return err
+	})
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+// selectBrokers returns the broker of a cluster with the id, or all its brokers if the id is 0.
+func selectBrokers(cluster Cluster, id int) ([]Broker, error) {
+	if id == 0 {
+		return cluster.Brokers, nil
+	}
+
 	for _, broker := range cluster.Brokers {
-		if err := stopBroker(ctx, cluster, broker); err != nil {
+		if broker.ID == id {
+			return []Broker{broker}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("broker %d doesn't exist in cluster %q", id, cluster.Name)
+}
+
+// forEachBroker runs fn concurrently for every broker and returns the first error.
+func forEachBroker(brokers []Broker, fn func(broker Broker) error) error {
+	errs := make(chan error, len(brokers))
+
+	var wg sync.WaitGroup
+	for _, broker := range brokers {
+		wg.Add(1)
+		go func(broker Broker) {
+			defer wg.Done()
+			errs <- fn(broker)
+		}(broker)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
 			return err
 		}
 	}
@@ -278,12 +612,70 @@ func stopCluster(ctx context.Context, cluster Cluster) error {
 	return nil
 }
 
-func startCluster(ctx context.Context, cluster Cluster) error {
+// stopCluster stops all brokers of a cluster concurrently.
+// The controller is stopped last to avoid electing a new one multiple times.
+func stopCluster(ctx context.Context, cluster Cluster, opts stopOptions) error {
+	controllerID := getClusterController(ctx, cluster)
+
+	var (
+		brokers    []Broker
+		controller []Broker
+	)
 	for _, broker := range cluster.Brokers {
-		if err := startBroker(ctx, cluster, broker); err != nil {
+		if broker.ID == controllerID {
+			controller = append(controller, broker)
+		} else {
+			brokers = append(brokers, broker)
+		}
+	}
+
+	stop := func(broker Broker) error {
+		res, err := stopBroker(ctx, cluster, broker, opts)
+		if err != nil {
 			return err
 		}
+
+		if broker.ID == controllerID {
+			log.Printf("broker %d (controller) %s", broker.ID, res)
+		} else {
+			log.Printf("broker %d %s", broker.ID, res)
+		}
+
+		return nil
 	}
 
-	return nil
+	if err := forEachBroker(brokers, stop); err != nil {
+		return err
+	}
+
+	return forEachBroker(controller, stop)
+}
+
+// prepareCluster finds the Java runtime of a cluster and downloads and extracts Kafka once before starting the brokers.
+// It returns the cluster with its Java runtime.
+func prepareCluster(ctx context.Context, cluster Cluster) (Cluster, error) {
+	javaHome, err := resolveClusterJava(ctx, cluster)
+	if err != nil {
+		return cluster, err
+	}
+	cluster.JavaHome = javaHome
+
+	if err := installClusterKafka(cluster); err != nil {
+		return cluster, err
+	}
+
+	return cluster, nil
+}
+
+// startCluster starts all brokers of a cluster concurrently, the cluster must be prepared with prepareCluster.
+func startCluster(ctx context.Context, cluster Cluster, opts startOptions) error {
+	return forEachBroker(cluster.Brokers, func(broker Broker) error {
+		if err := startBroker(ctx, cluster, broker, opts); err != nil {
+			return fmt.Errorf("unable to start broker %d. err: %w", broker.ID, err)
+		}
+
+		log.Printf("broker %d started", broker.ID)
+
+		return nil
+	})
 }
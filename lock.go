@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// fileLock is an exclusive lock shared by all kcm processes.
+//
+// It's backed by flock(2) so it's released by the kernel if kcm dies while holding it.
+// Lock files are never removed: removing one while another process waits on it would let two processes hold the lock.
+type fileLock struct {
+	f *os.File
+}
+
+func makeLockPath(name string) string {
+	return filepath.Join(dataDir, "locks", name+".lock")
+}
+
+// zookeeperLockName is the name of the lock held while a Zookeeper node is started or stopped.
+const zookeeperLockName = "zookeeper"
+
+// registryLockName is the name of the lock held while a cluster or a Zookeeper ensemble is registered or removed.
+// The ports are allocated from the ones already registered, two commands must not allocate them at the same time.
+const registryLockName = "registry"
+
+func makeClusterLockName(name ClusterName) string {
+	return "cluster-" + string(name)
+}
+
+// makeArtifactLockName returns the name of the lock held while a version of Kafka or Zookeeper is installed or removed,
+// based on the path it's extracted to.
+func makeArtifactLockName(extractedPath string) string {
+	return "artifact-" + filepath.Base(extractedPath)
+}
+
+// acquireLock takes the lock with the given name, waiting at most for the duration of the -lock-timeout flag.
+func acquireLock(name string) (*fileLock, error) {
+	path := makeLockPath(name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file %q. err: %w", path, err)
+	}
+
+	// NOTE(vincent): flock can't wait with a timeout so we poll instead.
+
+	deadline := time.Now().Add(*globalLockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return &fileLock{f: f}, nil
+
+		case err != syscall.EWOULDBLOCK && err != syscall.EINTR:
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %q. err: %w", path, err)
+
+		case time.Now().After(deadline):
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %q after %s, another kcm command is probably running", name, *globalLockTimeout)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Release releases the lock. Closing the file is enough to release it.
+// Releasing it again does nothing.
+func (l *fileLock) Release() {
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
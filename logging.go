@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// loggingBackend is the logging library used by a Kafka or Zookeeper distribution, it decides the config file written by kcm.
+type loggingBackend string
+
+const (
+	// loggingLog4j is log4j 1.x or reload4j, used by Kafka before 4.0 and Zookeeper before 3.8.
+	loggingLog4j loggingBackend = "log4j"
+	// loggingLog4j2 is used by Kafka since 4.0.
+	loggingLog4j2 loggingBackend = "log4j2"
+	// loggingLogback is used by Zookeeper since 3.8.
+	loggingLogback loggingBackend = "logback"
+)
+
+// ConfigFile returns the name of the config file of the backend.
+func (b loggingBackend) ConfigFile() string {
+	switch b {
+	case loggingLog4j2:
+		return "log4j2.properties"
+	case loggingLogback:
+		return "logback.xml"
+	default:
+		return "log4j.properties"
+	}
+}
+
+// JVMProperty returns the system property making the backend use the config file path.
+func (b loggingBackend) JVMProperty(path string) string {
+	switch b {
+	case loggingLog4j2:
+		return "-Dlog4j2.configurationFile=" + path
+	case loggingLogback:
+		return "-Dlogback.configurationFile=" + path
+	default:
+		return "-Dlog4j.configuration=file:" + path
+	}
+}
+
+// detectLoggingBackend returns the logging backend of a distribution from the jars in its directories.
+//
+// NOTE(vincent): the jars are used instead of the version so that custom distributions work too.
+// Kafka 4.x still ships the log4j 1.x bridge of log4j2, so log4j2 is checked first.
+func detectLoggingBackend(dirs ...string) (loggingBackend, error) {
+	cp, err := constructClasspath(dirs...)
+	if err != nil {
+		return "", fmt.Errorf("unable to list the jars of the distribution. err: %w", err)
+	}
+
+	var hasLogback bool
+	for _, jar := range strings.Split(cp, ":") {
+		name := filepath.Base(jar)
+		switch {
+		case strings.HasPrefix(name, "log4j-core-2"):
+			return loggingLog4j2, nil
+		case strings.HasPrefix(name, "logback-classic-"):
+			hasLogback = true
+		}
+	}
+
+	if hasLogback {
+		return loggingLogback, nil
+	}
+	return loggingLog4j, nil
+}
+
+// detectKafkaLoggingBackend returns the logging backend of the Kafka distribution of a cluster, which must be installed.
+func detectKafkaLoggingBackend(cluster Cluster) (loggingBackend, error) {
+	extractedPath := makeClusterKafkaPath(cluster)
+
+	var dirs []string
+	for _, root := range clusterDistribution(cluster).ClasspathRoots {
+		dirs = append(dirs, filepath.Join(extractedPath, root))
+	}
+
+	return detectLoggingBackend(dirs...)
+}
+
+// detectZookeeperLoggingBackend returns the logging backend of the distribution of a Zookeeper, which must be installed.
+func detectZookeeperLoggingBackend(zookeeper Zookeeper) (loggingBackend, error) {
+	return detectLoggingBackend(filepath.Join(makeZookeeperExtractedPath(zookeeper.Version), "lib"))
+}
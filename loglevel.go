@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// logLevels are the levels accepted by kcm loglevel set, the ones supported by the broker-loggers API.
+var logLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// defaultLogLevel removes the persistent level of a logger, it then uses the level of its parent again.
+const defaultLogLevel = "default"
+
+// rootLogger is the name of the root logger in the broker-loggers API, it's also accepted by kcm loglevel.
+const rootLogger = "root"
+
+// dynamicLogLevelsVersion is the first Kafka version changing the log levels of a running broker with the broker-loggers API (KIP-412).
+const dynamicLogLevelsVersion = "2.4.0"
+
+// parseLogLevel returns the level in upper case, or an empty string for defaultLogLevel.
+func parseLogLevel(level string) (string, error) {
+	if strings.EqualFold(level, defaultLogLevel) {
+		return "", nil
+	}
+
+	res := strings.ToUpper(level)
+	if !containsString(logLevels, res) {
+		return "", fmt.Errorf("invalid log level %q, must be one of %s or %s", level, strings.Join(logLevels, ", "), defaultLogLevel)
+	}
+	return res, nil
+}
+
+// validateLoggerName returns an error if a logger name can't be written in a logging config.
+func validateLoggerName(logger string) error {
+	if logger == "" || strings.ContainsAny(logger, "= \t\n") {
+		return fmt.Errorf("invalid logger name %q", logger)
+	}
+	return nil
+}
+
+func sortedLoggers(levels map[string]string) []string {
+	res := make([]string, 0, len(levels))
+	for logger := range levels {
+		res = append(res, logger)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// brokerLogLevels returns the persistent log levels of a broker, the ones of the broker take precedence over the ones of the cluster.
+func brokerLogLevels(cluster Cluster, broker Broker) map[string]string {
+	res := make(map[string]string, len(cluster.LogLevels)+len(broker.LogLevels))
+	for logger, level := range cluster.LogLevels {
+		res[logger] = level
+	}
+	for logger, level := range broker.LogLevels {
+		res[logger] = level
+	}
+	return res
+}
+
+// supportsDynamicLogLevels returns true if the brokers of a cluster can change their log levels while running.
+func supportsDynamicLogLevels(cluster Cluster) bool {
+	version := clusterDistribution(cluster).ApacheVersion(cluster.Version)
+	return compareVersions(string(version), dynamicLogLevelsVersion) >= 0
+}
+
+// runKafkaConfigs runs the kafka-configs script of a cluster on the broker-loggers of a broker and returns its output.
+func runKafkaConfigs(ctx context.Context, cluster Cluster, broker Broker, args ...string) ([]byte, error) {
+	dist := clusterDistribution(cluster)
+	script := filepath.Join(makeClusterKafkaPath(cluster), dist.ScriptsDir, "kafka-configs"+dist.ScriptSuffix)
+
+	args = append([]string{
+		"--bootstrap-server", broker.Addr.String(),
+		"--entity-type", "broker-loggers",
+		"--entity-name", fmt.Sprint(broker.ID),
+	}, args...)
+
+	cmd := exec.CommandContext(ctx, script, args...)
+	cmd.Env = append(os.Environ(), "JAVA_HOME="+cluster.JavaHome)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("kafka-configs failed: %s. err: %w", bytes.TrimSpace(output), err)
+	}
+
+	return output, nil
+}
+
+var brokerLoggerPattern = regexp.MustCompile(`^\s+(\S+)=(\S+)`)
+
+// describeBrokerLogLevels returns the levels of the loggers of a running broker.
+// A logger appears once it has been used by the broker.
+func describeBrokerLogLevels(ctx context.Context, cluster Cluster, broker Broker) (map[string]string, error) {
+	output, err := runKafkaConfigs(ctx, cluster, broker, "--describe")
+	if err != nil {
+		return nil, err
+	}
+
+	// The loggers are listed like "  kafka.controller=TRACE sensitive=false synonyms={}".
+
+	res := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if m := brokerLoggerPattern.FindStringSubmatch(scanner.Text()); m != nil {
+			res[m[1]] = m[2]
+		}
+	}
+
+	return res, scanner.Err()
+}
+
+// alterBrokerLogLevel changes the level of a logger of a running broker. An empty level resets it to the level of the root logger.
+func alterBrokerLogLevel(ctx context.Context, cluster Cluster, broker Broker, logger, level string) error {
+	var err error
+	if level == "" {
+		_, err = runKafkaConfigs(ctx, cluster, broker, "--alter", "--delete-config", logger)
+	} else {
+		_, err = runKafkaConfigs(ctx, cluster, broker, "--alter", "--add-config", logger+"="+level)
+	}
+	return err
+}
+
+// restartBroker stops a running broker and starts it again, then waits for it to accept connections.
+// The configuration files of the broker are written again when it starts.
+func restartBroker(ctx context.Context, cluster Cluster, broker Broker, opts stopOptions, timeout time.Duration) error {
+	// 1. a broker started with start -debug keeps its debugger
+
+	status, err := getBrokerStatus(ctx, cluster, broker)
+	if err != nil {
+		return fmt.Errorf("unable to get kafka broker pid. err: %w", err)
+	}
+
+	var startOpts startOptions
+	if agent, ok := parseDebugAgent(status.process.cmdline); ok {
+		// NOTE(vincent): waiting for a debugger would stall the rolling restart.
+		if agent.suspend {
+			log.Printf("broker %d waited for a debugger when it started, it won't wait again", broker.ID)
+			agent.suspend = false
+		}
+		startOpts.debug = map[int]debugAgent{broker.ID: agent}
+	}
+
+	// 2. restart it.
+	// NOTE(vincent): the Zookeeper lock is held until the broker is registered again, otherwise kcm stop or kcm zk stop
+	// could find Zookeeper unused while the broker is down.
+
+	restart := func() error {
+		lock, err := acquireLock(zookeeperLockName)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+
+		res, err := stopBroker(ctx, cluster, broker, opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("broker %d %s", broker.ID, res)
+
+		if err := startBroker(ctx, cluster, broker, startOpts); err != nil {
+			return fmt.Errorf("unable to start broker %d. err: %w", broker.ID, err)
+		}
+
+		return nil
+	}
+
+	if err := restart(); err != nil {
+		return err
+	}
+
+	if err := waitForBroker(ctx, broker, timeout); err != nil {
+		return err
+	}
+	log.Printf("broker %d started", broker.ID)
+
+	return nil
+}
+
+// waitForBroker waits for a broker to accept connections, so that the brokers of a rolling restart are never all down.
+func waitForBroker(ctx context.Context, broker Broker, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		conn, err := net.DialTimeout("tcp", broker.Addr.String(), time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("broker %d doesn't accept connections after %s", broker.ID, timeout)
+		case <-ticker.C:
+		}
+	}
+}
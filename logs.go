@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// defaultLogMaxFileSize is the size of a broker log file before it's rolled when none is configured.
+	defaultLogMaxFileSize = "100MB"
+	// defaultLogMaxFiles is the number of rolled files kept for each broker log file when none is configured.
+	defaultLogMaxFiles = 10
+)
+
+// LogSettings are the settings of the log files of the brokers of a cluster.
+type LogSettings struct {
+	// MaxFileSize is the size of a log file before it's rolled, like 100MB.
+	MaxFileSize string
+	// MaxFiles is the number of rolled files kept for each log file.
+	MaxFiles int
+	// Separate writes the controller, state change and request logs in their own files like Kafka does, instead of kafka.log.
+	Separate bool
+}
+
+func (s LogSettings) IsEmpty() bool {
+	return s.MaxFileSize == "" && s.MaxFiles == 0 && !s.Separate
+}
+
+func (s LogSettings) String() string {
+	var parts []string
+	if s.MaxFileSize != "" {
+		parts = append(parts, "max file size:"+s.MaxFileSize)
+	}
+	if s.MaxFiles > 0 {
+		parts = append(parts, fmt.Sprintf("max files:%d", s.MaxFiles))
+	}
+	if s.Separate {
+		parts = append(parts, "separate files")
+	}
+	return strings.Join(parts, ", ")
+}
+
+var logFileSizePattern = regexp.MustCompile(`^\d+(KB|MB|GB)$`)
+
+// Validate returns an error if the maximum size or number of files is invalid.
+func (s LogSettings) Validate() error {
+	if s.MaxFileSize != "" && !logFileSizePattern.MatchString(s.MaxFileSize) {
+		return fmt.Errorf("invalid log file size %q, must be like 100MB or 1GB", s.MaxFileSize)
+	}
+	if s.MaxFiles < 0 {
+		return fmt.Errorf("invalid number of log files %d", s.MaxFiles)
+	}
+	return nil
+}
+
+func (s LogSettings) maxFileSize() string {
+	if s.MaxFileSize == "" {
+		return defaultLogMaxFileSize
+	}
+	return s.MaxFileSize
+}
+
+func (s LogSettings) maxFiles() int {
+	if s.MaxFiles == 0 {
+		return defaultLogMaxFiles
+	}
+	return s.MaxFiles
+}
+
+// brokerLogFiles are the log files of a broker which can be printed with kcm logs -file, by name.
+// The gc log is handled separately since its name depends on the Java runtime.
+var brokerLogFiles = map[string]string{
+	"kafka":        "kafka.log",
+	"controller":   "controller.log",
+	"state-change": "state-change.log",
+	"request":      "kafka-request.log",
+	"stdout":       "stdout.log",
+	"stderr":       "stderr.log",
+}
+
+// zookeeperLogFiles are the log files of a Zookeeper node, by the name of the matching broker log file.
+var zookeeperLogFiles = map[string]string{
+	"kafka":  "zookeeper.log",
+	"stdout": "stdout.log",
+	"stderr": "stderr.log",
+}
+
+// logFileNames returns the names accepted by kcm logs -file.
+func logFileNames() []string {
+	res := []string{"gc"}
+	for name := range brokerLogFiles {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func makeBrokerLogPath(cluster Cluster, broker Broker, file string) string {
+	return filepath.Join(makeBrokerDir(cluster.Name, broker.ID), file)
+}
+
+// findBrokerLog returns the path of a log file of a broker by its name, or an empty string if there's none.
+func findBrokerLog(cluster Cluster, broker Broker, name string) string {
+	if name == "gc" {
+		return findBrokerGCLog(cluster, broker)
+	}
+
+	file, ok := brokerLogFiles[name]
+	if !ok {
+		return ""
+	}
+	return makeBrokerLogPath(cluster, broker, file)
+}
+
+// findZookeeperLog returns the path of a log file of a Zookeeper node by its name, or an empty string if there's none.
+func findZookeeperLog(zookeeper Zookeeper, node ZookeeperNode, name string) string {
+	file, ok := zookeeperLogFiles[name]
+	if !ok {
+		return ""
+	}
+	return filepath.Join(makeZookeeperNodeDir(zookeeper, node), file)
+}
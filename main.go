@@ -2,19 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"github.com/peterbourgon/ff"
 	"github.com/peterbourgon/ff/ffcli"
 )
 
@@ -29,24 +33,103 @@ var (
 
 	//
 
-	globalFlags    = flag.NewFlagSet("kcm", flag.ExitOnError)
-	globalJavaHome = globalFlags.String("java-home", "", "Use this Java distribution instead of the default one")
-	globalZkAddr   = globalFlags.String("zk-addr", "127.0.0.1:2181", "The address used by the Zookeeper node")
-
-	createFlags       = flag.NewFlagSet("create", flag.ExitOnError)
-	createBrokers     = createFlags.Int("brokers", 3, "the number of brokers to add to the cluster")
-	createBrokerAddrs brokerListenAddrs
-
-	stopFlags = flag.NewFlagSet("stop", flag.ExitOnError)
-	stopZk    = stopFlags.Bool("zk", false, "Stop Zookeeper too")
+	globalFlags       = flag.NewFlagSet("kcm", flag.ExitOnError)
+	globalJavaHome    = globalFlags.String("java-home", "", "Use this Java distribution instead of the default one")
+	globalMirrors     stringList
+	globalOffline     = globalFlags.Bool("offline", false, "Never download anything, only use the Kafka and Zookeeper archives already in the cache")
+	globalProxy       = globalFlags.String("proxy", "", "The HTTP proxy used to download the Kafka and Zookeeper archives, instead of the one in the HTTP_PROXY and HTTPS_PROXY env vars")
+	globalLockTimeout = globalFlags.Duration("lock-timeout", 2*time.Minute, "The time to wait for another kcm command working on the same cluster or Zookeeper to finish")
+	globalZkAddr      = globalFlags.String("zk-addr", "127.0.0.1:2181", "The address used by the shared Zookeeper node when it's first registered")
+
+	globalZkAdminPort    = globalFlags.Int("zk-admin-port", 0, "The first port of the AdminServer of the Zookeeper nodes created (0 disables it). Each node gets the next free port")
+	globalZk4lwWhitelist = globalFlags.String("zk-4lw-whitelist", defaultZk4lwWhitelist, "The four letter words commands enabled on the Zookeeper nodes created")
+
+	createFlags        = flag.NewFlagSet("create", flag.ExitOnError)
+	createBrokers      = createFlags.Int("brokers", 3, "the number of brokers to add to the cluster")
+	createBrokerAddrs  brokerListenAddrs
+	createZk           = createFlags.String("zk", "shared", "the Zookeeper node used by the cluster: shared, dedicated or the name of an ensemble")
+	createZkVersion    = createFlags.String("zk-version", "", "the Zookeeper version to use (defaults to "+defaultZookeeperVersion+")")
+	createScala        = createFlags.String("scala", "", "the Scala version of the Kafka build to use (defaults to the one recommended for the Kafka version)")
+	createFetch        = createFlags.Bool("fetch", false, "download and extract Kafka and Zookeeper right away instead of at the first start")
+	createFromDir      = createFlags.String("from-dir", "", "use the extracted Kafka distribution in this directory, like a local build")
+	createFromTarball  = createFlags.String("from-tarball", "", "use the Kafka distribution in this tarball")
+	createFromURL      = createFlags.String("from-url", "", "use the Kafka distribution tarball at this URL, like a release candidate")
+	createDistribution = createFlags.String("distribution", defaultDistribution, "the distribution of Kafka: "+strings.Join(kafkaDistributionNames(), ", "))
+	createCustomName   = createFlags.String("custom-name", "", "the name of the custom distribution created with -from-dir, -from-tarball or -from-url (defaults to its file name)")
+	createHeap         = createFlags.String("heap", "", "the maximum heap size of the brokers like 1g (defaults to "+defaultBrokerHeap+")")
+	createJVMOpts      stringList
+	createEnv          stringList
+	createBrokerHeap   stringList
+	createBrokerOpts   stringList
+	createBrokerEnv    stringList
+	createPluginPaths  stringList
+	createJMX          = createFlags.Bool("jmx", false, "enable JMX on the brokers, each one gets a free port starting at 9999")
+	createLogMaxSize   = createFlags.String("log-max-size", "", "the size of a broker log file before it's rolled like 100MB (defaults to "+defaultLogMaxFileSize+")")
+	createLogMaxFiles  = createFlags.Int("log-max-files", 0, fmt.Sprintf("the number of rolled files kept for each broker log file (defaults to %d)", defaultLogMaxFiles))
+	createSeparateLogs = createFlags.Bool("separate-logs", false, "write the controller, state change and request logs of the brokers in their own files, like Kafka does")
+	createJava         = createFlags.String("java", "", "the Java runtime used by the brokers: a major version like 11 or the path of a Java runtime (defaults to the newest one supported by the Kafka version)")
+
+	startFlags   = flag.NewFlagSet("start", flag.ExitOnError)
+	startDebug   = startFlags.Bool("debug", false, "start the brokers with a JDWP agent to attach a Java debugger, on the first free ports starting at 5005")
+	startSuspend = startFlags.Bool("suspend", false, "with -debug, wait for a debugger to attach before running the brokers")
+
+	logLevelSetFlags        = flag.NewFlagSet("set", flag.ExitOnError)
+	logLevelSetStopTimeout  = logLevelSetFlags.Duration("stop-timeout", 30*time.Second, "Before Kafka 2.4, the time to wait for a broker to terminate before killing it")
+	logLevelSetStartTimeout = logLevelSetFlags.Duration("start-timeout", 2*time.Minute, "Before Kafka 2.4, the time to wait for a restarted broker to accept connections")
+
+	stopFlags     = flag.NewFlagSet("stop", flag.ExitOnError)
+	stopZk        = stopFlags.Bool("zk", false, "Stop Zookeeper too")
+	stopForce     = stopFlags.Bool("force", false, "Stop Zookeeper even if clusters using it are running")
+	stopTimeout   = stopFlags.Duration("timeout", 30*time.Second, "The time to wait for a broker to terminate before killing it")
+	stopZkTimeout = stopFlags.Duration("zk-timeout", 10*time.Second, "The time to wait for Zookeeper to terminate before killing it")
 
 	logsFlags  = flag.NewFlagSet("logs", flag.ExitOnError)
 	logsZk     = logsFlags.Bool("zk", false, "Print the Zookeeper logs too")
 	logsFollow = logsFlags.Bool("follow", false, "Follow the logs as changes are made")
+	logsFile   = logsFlags.String("file", "kafka", "The log file to print: "+strings.Join(logFileNames(), ", "))
+
+	psFlags   = flag.NewFlagSet("ps", flag.ExitOnError)
+	psAdopt   = psFlags.Bool("adopt", false, "Track the processes again in the database")
+	psKill    = psFlags.Bool("kill", false, "Stop the processes not tracked in the database")
+	psTimeout = psFlags.Duration("timeout", 30*time.Second, "The time to wait for a process to terminate before killing it")
+
+	fetchFlags        = flag.NewFlagSet("fetch", flag.ExitOnError)
+	fetchZk           = fetchFlags.Bool("zk", false, "Fetch Zookeeper versions instead of Kafka versions")
+	fetchDistribution = fetchFlags.String("distribution", defaultDistribution, "the distribution of Kafka: "+strings.Join(kafkaDistributionNames(), ", "))
+	fetchScala        = fetchFlags.String("scala", "", "The Scala version of the Kafka builds to fetch (defaults to the one recommended for each Kafka version)")
+
+	versionsFlags     = flag.NewFlagSet("versions", flag.ExitOnError)
+	versionsAvailable = versionsFlags.Bool("available", false, "List the Kafka versions which can be used instead")
+	versionsRefresh   = versionsFlags.Bool("refresh", false, "Refresh the list of Kafka versions which can be used from the mirrors")
+	versionsZk        = versionsFlags.Bool("zk", false, "List the Zookeeper versions which can be used instead of the Kafka versions, with -available")
+
+	pruneFlags  = flag.NewFlagSet("prune", flag.ExitOnError)
+	pruneDryRun = pruneFlags.Bool("dry-run", false, "Print what would be removed without removing anything")
+
+	dbMigrateFlags  = flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbMigrateDryRun = dbMigrateFlags.Bool("dry-run", false, "Print the pending migrations without applying them")
+
+	zkRmFlags     = flag.NewFlagSet("rm", flag.ExitOnError)
+	zkRmRecursive = zkRmFlags.Bool("r", false, "Remove the znode and all its children")
+
+	zkStopFlags   = flag.NewFlagSet("stop", flag.ExitOnError)
+	zkStopForce   = zkStopFlags.Bool("force", false, "Stop Zookeeper even if clusters using it are running")
+	zkStopTimeout = zkStopFlags.Duration("timeout", 10*time.Second, "The time to wait for a node to terminate before killing it")
+
+	zkCreateEnsembleFlags   = flag.NewFlagSet("create-ensemble", flag.ExitOnError)
+	zkCreateEnsembleNodes   = zkCreateEnsembleFlags.Int("nodes", 3, "the number of nodes in the ensemble")
+	zkCreateEnsembleVersion = zkCreateEnsembleFlags.String("version", defaultZookeeperVersion, "the Zookeeper version to use")
 )
 
 func init() {
+	globalFlags.Var(&globalMirrors, "mirror", "The base URL of a mirror of the Apache distribution directory (can be provided multiple times, tried in order)")
 	createFlags.Var(&createBrokerAddrs, "broker-addr", "the address of a broker (can be provided multiple times)")
+	createFlags.Var(&createJVMOpts, "jvm-opt", "an option passed to the JVM of the brokers like -XX:+UseG1GC or -Dkey=value (can be provided multiple times)")
+	createFlags.Var(&createEnv, "env", "an environment variable of the brokers like KEY=VALUE (can be provided multiple times)")
+	createFlags.Var(&createBrokerHeap, "broker-heap", "the maximum heap size of one broker, prefixed by its id like 2:1g (can be provided multiple times)")
+	createFlags.Var(&createBrokerOpts, "broker-jvm-opt", "an option passed to the JVM of one broker, prefixed by its id like 2:-XX:+UseG1GC (can be provided multiple times)")
+	createFlags.Var(&createPluginPaths, "plugin-path", "a directory of jars or a jar added to the class path of the brokers, like an authorizer (can be provided multiple times)")
+	createFlags.Var(&createBrokerEnv, "broker-env", "an environment variable of one broker, prefixed by its id like 2:KEY=VALUE (can be provided multiple times)")
 }
 
 func printCluster(cluster *Cluster) {
@@ -59,12 +142,129 @@ func printCluster(cluster *Cluster) {
 }
 
 func runCreateCluster(name ClusterName, version string) error {
+	dist, err := getKafkaDistribution(*createDistribution)
+	if err != nil {
+		return err
+	}
+
+	custom, err := getCreateCustomDistribution(dist)
+	if err != nil {
+		return err
+	}
+
+	// NOTE(vincent): the catalog may have to be refreshed from the network, do it before starting the timeout.
+
+	var resolvedVersion KafkaVersion
+	var scala string
+
+	switch {
+	case custom != nil:
+		// A custom distribution doesn't have to be a release, its version is only informative.
+		resolvedVersion, scala = parseCustomDistributionName(custom.Name)
+		if v, s, ok := dist.ParseDistName(custom.Name); resolvedVersion == "" && !dist.UsesCatalog && ok {
+			// The names of the Apache builds are already supported.
+			resolvedVersion, scala = v, s
+		}
+		if version != "" {
+			resolvedVersion = KafkaVersion(version)
+		}
+		if resolvedVersion == "" {
+			return fmt.Errorf("unable to find the Kafka version of the custom distribution %q, provide it after the cluster name", custom.Name)
+		}
+
+	case version == "":
+		return fmt.Errorf("Usage: kcm create <name> <version>")
+
+	default:
+		resolvedVersion, err = resolveKafkaVersion(dist, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *createZkVersion != "" {
+		if err := validateZookeeperVersion(*createZkVersion); err != nil {
+			return err
+		}
+	}
+
+	jvm, brokerJVM, err := getCreateJVMSettings()
+	if err != nil {
+		return err
+	}
+
+	logs := LogSettings{
+		MaxFileSize: *createLogMaxSize,
+		MaxFiles:    *createLogMaxFiles,
+		Separate:    *createSeparateLogs,
+	}
+	if err := logs.Validate(); err != nil {
+		return err
+	}
+
+	// NOTE(vincent): finding the Java runtimes can run java -version, do it before starting the timeout too.
+
+	javaHome, err := selectCreateJavaRuntime(kafkaJavaRange(dist.ApacheVersion(resolvedVersion)))
+	if err != nil {
+		return err
+	}
+
+	var pluginPaths []string
+	for _, p := range createPluginPaths {
+		path, err := normalizePluginPath(p)
+		if err != nil {
+			return err
+		}
+		pluginPaths = append(pluginPaths, path)
+	}
+
+	// Another kcm command could be allocating the same ports or removing the Zookeeper used.
+	lock, err := acquireLock(registryLockName)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
 	//
 
-	tmp := Cluster{Name: ClusterName(name), Version: KafkaVersion(version)}
+	if *createScala != "" {
+		scala = *createScala
+	}
+	if scala == "" {
+		scala = dist.DefaultScalaVersion(resolvedVersion)
+	}
+	if !scalaVersionPattern.MatchString(scala) {
+		return fmt.Errorf("invalid Scala version %q, must be like 2.13", scala)
+	}
+	if custom == nil {
+		if err := dist.CheckScalaVersion(resolvedVersion, scala); err != nil {
+			return err
+		}
+	}
+
+	tmp := Cluster{
+		Name:         ClusterName(name),
+		Version:      resolvedVersion,
+		ScalaVersion: scala,
+		Distribution: dist.Name,
+		JavaHome:     javaHome,
+		Custom:       custom,
+		JVM:          jvm,
+		PluginPaths:  pluginPaths,
+		Logs:         logs,
+	}
+
+	existing, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		log.Printf("cluster named %q already exists", name)
+		return nil
+	}
 
 	switch {
 	case len(createBrokerAddrs) > 0:
@@ -89,7 +289,82 @@ func runCreateCluster(name ClusterName, version string) error {
 		}
 	}
 
+	// The broker ids start at 1.
+	for id, settings := range brokerJVM {
+		if id < 1 || id > len(tmp.Brokers) {
+			return fmt.Errorf("broker %d doesn't exist, the cluster has %d brokers", id, len(tmp.Brokers))
+		}
+		tmp.Brokers[id-1].JVM = *settings
+	}
+
+	if *createJMX {
+		if err := allocateJMXPorts(ctx, tmp.Brokers); err != nil {
+			return err
+		}
+	}
+
+	zookeeperVersion := *createZkVersion
+	if zookeeperVersion == "" {
+		zookeeperVersion = defaultZookeeperVersion
+	}
+
+	switch *createZk {
+	case "shared":
+		zookeeper, err := getSharedZookeeper(ctx, zookeeperVersion)
+		if err != nil {
+			return err
+		}
+		if *createZkVersion != "" && zookeeper.Version != *createZkVersion {
+			return fmt.Errorf("the shared Zookeeper node uses version %s, use -zk dedicated to use version %s", zookeeper.Version, *createZkVersion)
+		}
+
+		tmp.Zookeeper = *zookeeper
+
+	case "dedicated":
+		zookeeper, err := newZookeeper(ctx, string(name), zookeeperDedicated, zookeeperVersion, 1)
+		if err != nil {
+			return err
+		}
+
+		if err := createZookeeper(ctx, zookeeper); err != nil {
+			if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
+				return fmt.Errorf("a Zookeeper node named %q already exists", zookeeper.Name)
+			}
+			return err
+		}
+
+		created, err := getZookeeper(ctx, zookeeper.Name)
+		if err != nil {
+			return err
+		}
+
+		tmp.Zookeeper = *created
+
+	default:
+		zookeeper, err := getZookeeper(ctx, *createZk)
+		if err != nil {
+			return err
+		}
+		if zookeeper == nil {
+			return fmt.Errorf("Zookeeper %q doesn't exist, must be shared, dedicated or the name of an ensemble", *createZk)
+		}
+		if zookeeper.Kind == zookeeperDedicated {
+			return fmt.Errorf("Zookeeper %q is dedicated to the cluster %q, use -zk shared or an ensemble", zookeeper.Name, zookeeper.Name)
+		}
+		if *createZkVersion != "" && zookeeper.Version != *createZkVersion {
+			return fmt.Errorf("the Zookeeper ensemble %q uses version %s", zookeeper.Name, zookeeper.Version)
+		}
+
+		tmp.Zookeeper = *zookeeper
+	}
+
 	if err := createCluster(ctx, tmp); err != nil {
+		if *createZk == "dedicated" {
+			if err := removeZookeeper(ctx, tmp.Zookeeper); err != nil {
+				log.Printf("unable to remove the dedicated Zookeeper node. err: %v", err)
+			}
+		}
+
 		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
 			log.Printf("cluster named %q already exists", name)
 			return nil
@@ -106,11 +381,153 @@ func runCreateCluster(name ClusterName, version string) error {
 
 	printCluster(cluster)
 
+	// Downloading can take a while, it doesn't need the database.
+
+	lock.Release()
+
+	if *createFetch {
+		if err := installZookeeper(cluster.Zookeeper.Version); err != nil {
+			return fmt.Errorf("cluster %q was created but Zookeeper can't be fetched. err: %w", name, err)
+		}
+		if err := installClusterKafka(*cluster); err != nil {
+			return fmt.Errorf("cluster %q was created but Kafka can't be fetched. err: %w", name, err)
+		}
+		log.Printf("fetched %s %s (Scala %s) and zookeeper %s", clusterDistribution(*cluster).Kind, cluster.Version, cluster.ScalaVersion, cluster.Zookeeper.Version)
+	}
+
 	return nil
 }
 
+// getCreateCustomDistribution returns the custom distribution provided to create, or nil if there's none.
+func getCreateCustomDistribution(dist *kafkaDistribution) (*CustomDistribution, error) {
+	var (
+		source   customSource
+		location string
+		n        int
+	)
+	for _, f := range []struct {
+		source customSource
+		value  string
+	}{
+		{customDir, *createFromDir},
+		{customTarball, *createFromTarball},
+		{customURL, *createFromURL},
+	} {
+		if f.value != "" {
+			source, location = f.source, f.value
+			n++
+		}
+	}
+
+	switch {
+	case n == 0 && *createCustomName != "":
+		return nil, fmt.Errorf("-custom-name requires one of -from-dir, -from-tarball or -from-url")
+	case n == 0:
+		return nil, nil
+	case n > 1:
+		return nil, fmt.Errorf("only one of -from-dir, -from-tarball or -from-url can be used")
+	}
+
+	res, err := newCustomDistribution(*createCustomName, source, location, dist)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// getCreateJVMSettings returns the JVM settings provided to create for the cluster and for each broker.
+func getCreateJVMSettings() (JVMSettings, map[int]*JVMSettings, error) {
+	res := JVMSettings{
+		Heap:    *createHeap,
+		Options: createJVMOpts,
+		Env:     createEnv,
+	}
+	if err := res.Validate(); err != nil {
+		return res, nil, err
+	}
+
+	brokers := make(map[int]*JVMSettings)
+
+	if err := parseBrokerJVMSettings(createBrokerHeap, brokers, func(s *JVMSettings, v string) { s.Heap = v }); err != nil {
+		return res, nil, err
+	}
+	if err := parseBrokerJVMSettings(createBrokerOpts, brokers, func(s *JVMSettings, v string) { s.Options = append(s.Options, v) }); err != nil {
+		return res, nil, err
+	}
+	if err := parseBrokerJVMSettings(createBrokerEnv, brokers, func(s *JVMSettings, v string) { s.Env = append(s.Env, v) }); err != nil {
+		return res, nil, err
+	}
+
+	for id, settings := range brokers {
+		if err := settings.Validate(); err != nil {
+			return res, nil, fmt.Errorf("broker %d: %w", id, err)
+		}
+	}
+
+	return res, brokers, nil
+}
+
+// selectCreateJavaRuntime returns the Java runtime chosen with the -java flag, or the newest one in the range.
+// If no runtime is compatible the cluster is created anyway, a runtime is selected again when it's started.
+func selectCreateJavaRuntime(r javaRange) (string, error) {
+	if *createJava != "" {
+		runtime, err := parseJavaOption(*createJava)
+		if err != nil {
+			return "", err
+		}
+		if !r.Contains(runtime.Major()) {
+			log.Printf("WARNING: %s is not supported by this Kafka version, it requires %s", runtime, r)
+		}
+		return runtime.home, nil
+	}
+
+	runtime, ok := findCompatibleJavaRuntime(discoverJavaRuntimes(), r)
+	if !ok {
+		log.Printf("WARNING: no Java runtime found, this Kafka version requires %s", r)
+		return "", nil
+	}
+	log.Printf("using %s", runtime)
+
+	return runtime.home, nil
+}
+
+// resolveKafkaVersion validates a Kafka version against the catalog, resolving aliases like latest or 2.6.
+// The versions of the distributions other than Apache Kafka can't be aliases.
+func resolveKafkaVersion(dist *kafkaDistribution, version string) (KafkaVersion, error) {
+	if !dist.UsesCatalog {
+		if !releasePattern.MatchString(version) {
+			return "", fmt.Errorf("invalid %s version %q, must be a release like 6.2.0", dist.Name, version)
+		}
+		return KafkaVersion(version), nil
+	}
+
+	catalog, err := loadKafkaCatalog(false)
+	if err != nil {
+		return "", fmt.Errorf("unable to load the catalog of Kafka versions. err: %w", err)
+	}
+
+	res, err := catalog.Resolve(version)
+	if err != nil {
+		return "", err
+	}
+
+	if string(res) != version {
+		log.Printf("using Kafka %s for %s", res, version)
+	}
+
+	return res, nil
+}
+
 func runRemoveCluster(name ClusterName) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	// Another kcm command could be working on the same cluster.
+	lock, err := acquireLock(makeClusterLockName(name))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
 
 	//
@@ -128,13 +545,11 @@ func runRemoveCluster(name ClusterName) error {
 
 	log.Printf("removing cluster %q", cluster.Name)
 
-	for _, broker := range cluster.Brokers {
-		log.Printf("stopping broker %d", broker.ID)
-		if err := stopBroker(ctx, *cluster, broker); err != nil {
-			return err
-		}
-		log.Printf("broker %d stopped", broker.ID)
+	if err := stopCluster(ctx, *cluster, stopOptions{timeout: 10 * time.Second}); err != nil {
+		return err
+	}
 
+	for _, broker := range cluster.Brokers {
 		log.Printf("removing broker %d data", broker.ID)
 		if err := removeBrokerData(*cluster, broker); err != nil {
 			return err
@@ -145,11 +560,59 @@ func runRemoveCluster(name ClusterName) error {
 		return err
 	}
 
+	// A dedicated Zookeeper node is not useful without its cluster.
+	// NOTE(vincent): older versions of kcm allowed other clusters to use it, those keep it.
+
+	if zookeeper := cluster.Zookeeper; zookeeper.IsDedicatedTo(cluster.Name) {
+		user, err := findZookeeperCluster(ctx, zookeeper)
+		if err != nil {
+			return err
+		}
+		if user != "" {
+			log.Printf("zookeeper %q is used by cluster %q, keeping it", zookeeper.Name, user)
+		} else if err := removeDedicatedZookeeper(ctx, zookeeper); err != nil {
+			return err
+		}
+	}
+
+	// Same for a custom distribution once no cluster uses it.
+
+	if custom := cluster.Custom; custom != nil {
+		removed, err := removeUnusedCustomDistribution(ctx, custom.Name)
+		if err != nil {
+			return err
+		}
+		if removed {
+			if err := removeCustomDistributionFiles(*custom); err != nil {
+				return err
+			}
+			log.Printf("custom distribution %q removed", custom.Name)
+		}
+	}
+
 	log.Printf("removed cluster %q", cluster.Name)
 
 	return nil
 }
 
+// removeDedicatedZookeeper stops the dedicated Zookeeper node of a removed cluster and removes it.
+func removeDedicatedZookeeper(ctx context.Context, zookeeper Zookeeper) error {
+	log.Printf("stopping zookeeper %q", zookeeper.Name)
+	if err := stopZookeeper(ctx, zookeeper, stopOptions{timeout: 10 * time.Second}); err != nil {
+		return err
+	}
+	log.Printf("removing zookeeper %q data", zookeeper.Name)
+	if err := removeZookeeperData(zookeeper); err != nil {
+		return err
+	}
+	if err := removeZookeeper(ctx, zookeeper); err != nil {
+		return err
+	}
+	log.Printf("zookeeper %q removed", zookeeper.Name)
+
+	return nil
+}
+
 func runListClusters(pattern string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -171,31 +634,32 @@ func runListClusters(pattern string) error {
 	return nil
 }
 
-func runStatus(name ClusterName) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	// print zookeeper's status.
-
-	status, err := getZookeeperStatus(ctx)
+func printZookeeperStatus(ctx context.Context, zookeeper Zookeeper, clusters []Cluster) error {
+	status, err := getZookeeperStatus(ctx, zookeeper)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Zookeeper")
+	var names []string
+	for _, cluster := range clusters {
+		if cluster.Zookeeper.ID == zookeeper.ID {
+			names = append(names, string(cluster.Name))
+		}
+	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
-	fmt.Fprintf(w, "version\t%s\t\n", zookeeperVersion)
-	if status.IsStarted() {
-		fmt.Fprintf(w, "status\tpid:%d\t\n", status.pid)
+	if len(names) > 0 {
+		log.Printf("Zookeeper %q (version %s, clusters: %s)", zookeeper.Name, zookeeper.Version, strings.Join(names, ", "))
 	} else {
-		fmt.Fprintf(w, "status\tnot started\t\n")
+		log.Printf("Zookeeper %q (version %s)", zookeeper.Name, zookeeper.Version)
 	}
-	w.Flush()
+	log.Printf("%v\n", status)
 
-	log.Println()
+	return nil
+}
 
-	//
+func runStatus(name ClusterName) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 
 	switch {
 	case name != "":
@@ -207,10 +671,19 @@ func runStatus(name ClusterName) error {
 			return fmt.Errorf("cluster %q doesn't exist", name)
 		}
 
+		// print zookeeper's status.
+
+		if err := printZookeeperStatus(ctx, cluster.Zookeeper, []Cluster{*cluster}); err != nil {
+			return err
+		}
+
+		//
+
 		status, err := getClusterStatus(ctx, *cluster)
 		if err != nil {
 			return err
 		}
+		log.Printf("Cluster #%d %q (zookeeper %q)", cluster.ID, cluster.Name, cluster.Zookeeper.Name)
 		log.Printf("%v", status)
 
 	default:
@@ -219,8 +692,23 @@ func runStatus(name ClusterName) error {
 			return err
 		}
 
+		// print the status of every zookeeper node.
+
+		zookeepers, err := listZookeepers(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, zookeeper := range zookeepers {
+			if err := printZookeeperStatus(ctx, zookeeper, clusters); err != nil {
+				return err
+			}
+		}
+
+		//
+
 		for _, cluster := range clusters {
-			log.Printf("Cluster #%d %q", cluster.ID, cluster.Name)
+			log.Printf("Cluster #%d %q (zookeeper %q)", cluster.ID, cluster.Name, cluster.Zookeeper.Name)
 
 			status, err := getClusterStatus(ctx, cluster)
 			if err != nil {
@@ -233,7 +721,15 @@ func runStatus(name ClusterName) error {
 	return nil
 }
 
-func runStart(name ClusterName) error {
+// runStart starts a cluster. With -debug brokerID is the broker started with a debugger, 0 for all of them.
+func runStart(name ClusterName, brokerID int) error {
+	// Another kcm command could be working on the same cluster.
+	lock, err := acquireLock(makeClusterLockName(name))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
@@ -248,32 +744,75 @@ func runStart(name ClusterName) error {
 		return nil
 	}
 
-	// Start zookeeper first.
+	var opts startOptions
+
+	if *startDebug {
+		brokers, err := selectBrokers(*cluster, brokerID)
+		if err != nil {
+			return err
+		}
+
+		opts.debug, err = allocateDebugAgents(*cluster, brokers, *startSuspend)
+		if err != nil {
+			return err
+		}
+	}
 
 	ctx = context.Background()
 
-	if err := startZookeeper(ctx); err != nil {
+	// 1. install Zookeeper and Kafka and find their Java runtimes first, the downloads can be long
+
+	zookeeper, err := prepareZookeeper(ctx, cluster.Zookeeper)
+	if err != nil {
 		return err
 	}
-	log.Printf("launched zookeeper")
 
-	// set up a cancelable context to stop the cluster
-	//
-
-	if err := startCluster(ctx, *cluster); err != nil {
+	prepared, err := prepareCluster(ctx, *cluster)
+	if err != nil {
 		return err
 	}
-	log.Printf("launched cluster %q", cluster.Name)
 
-	return nil
-}
+	// 2. start zookeeper then the brokers.
+	// NOTE(vincent): the Zookeeper lock is held until the brokers are registered, otherwise kcm stop or kcm zk stop
+	// could find Zookeeper unused and stop it under the starting cluster.
 
-func runStop(name ClusterName) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	zkLock, err := acquireLock(zookeeperLockName)
+	if err != nil {
+		return err
+	}
+	defer zkLock.Release()
+
+	for _, node := range zookeeper.Nodes {
+		if err := startZookeeperNode(ctx, zookeeper, node); err != nil {
+			return err
+		}
+	}
+	log.Printf("launched zookeeper %q", cluster.Zookeeper.Name)
+
+	if err := startCluster(ctx, prepared, opts); err != nil {
+		return err
+	}
+	log.Printf("launched cluster %q", cluster.Name)
+
+	return nil
+}
+
+func runStop(name ClusterName) error {
+	// Leave enough time for the brokers and zookeeper to be killed if they don't terminate.
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute+4*(*stopTimeout)+2*(*stopZkTimeout)+*globalLockTimeout)
 	defer cancel()
 
+	// zookeepers contains the Zookeeper nodes used by the stopped clusters.
+	var zookeepers []Zookeeper
+
 	switch {
 	case name != "":
+		lock, err := acquireLock(makeClusterLockName(name))
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+
 		cluster, err := getCluster(ctx, name)
 		if err != nil {
 			return err
@@ -284,11 +823,13 @@ func runStop(name ClusterName) error {
 		}
 
 		log.Printf("stopping cluster %q", cluster.Name)
-		if err := stopCluster(ctx, *cluster); err != nil {
+		if err := stopCluster(ctx, *cluster, stopOptions{timeout: *stopTimeout}); err != nil {
 			return err
 		}
 		log.Printf("stopped cluster %q", cluster.Name)
 
+		zookeepers = append(zookeepers, cluster.Zookeeper)
+
 	default:
 		clusters, err := searchClusters(ctx, "")
 		if err != nil {
@@ -296,20 +837,46 @@ func runStop(name ClusterName) error {
 		}
 
 		for _, cluster := range clusters {
-			log.Printf("stopping cluster %q", cluster.Name)
-			if err := stopCluster(ctx, cluster); err != nil {
+			// Another kcm command could have changed or removed the cluster since it was listed, read it again once locked.
+			err := func() error {
+				lock, err := acquireLock(makeClusterLockName(cluster.Name))
+				if err != nil {
+					return err
+				}
+				defer lock.Release()
+
+				current, err := getCluster(ctx, cluster.Name)
+				if err != nil || current == nil {
+					return err
+				}
+
+				log.Printf("stopping cluster %q", current.Name)
+				if err := stopCluster(ctx, *current, stopOptions{timeout: *stopTimeout}); err != nil {
+					return err
+				}
+				log.Printf("stopped cluster %q", current.Name)
+
+				return nil
+			}()
+			if err != nil {
 				return err
 			}
-			log.Printf("stopped cluster %q", cluster.Name)
+		}
+
+		zookeepers, err = listZookeepers(ctx)
+		if err != nil {
+			return err
 		}
 	}
 
 	if *stopZk {
-		log.Printf("stopping zookeeper")
-		if err := stopZookeeper(ctx); err != nil {
-			return err
+		for _, zookeeper := range zookeepers {
+			log.Printf("stopping zookeeper %q", zookeeper.Name)
+			if err := stopZookeeper(ctx, zookeeper, stopOptions{force: *stopForce, timeout: *stopZkTimeout}); err != nil {
+				return err
+			}
+			log.Printf("stopped zookeeper %q", zookeeper.Name)
 		}
-		log.Printf("stopped zookeeper")
 	}
 
 	return nil
@@ -322,11 +889,17 @@ func runLogs(name ClusterName) error {
 	// files contains all files that need to be tailed
 	var files []string
 
-	addBrokerLog := func(cluster Cluster, broker Broker) {
-		dir := makeBrokerDir(cluster.Name, broker.ID)
-		logFile := filepath.Join(dir, "kafka.log")
+	// zookeepers contains the Zookeeper nodes used by the clusters.
+	var zookeepers []Zookeeper
+
+	if *logsFile != "gc" && brokerLogFiles[*logsFile] == "" {
+		return fmt.Errorf("invalid log file %q, must be one of %s", *logsFile, strings.Join(logFileNames(), ", "))
+	}
 
-		files = append(files, logFile)
+	addBrokerLog := func(cluster Cluster, broker Broker) {
+		if p := findBrokerLog(cluster, broker, *logsFile); p != "" {
+			files = append(files, p)
+		}
 	}
 
 	switch {
@@ -344,6 +917,8 @@ func runLogs(name ClusterName) error {
 			addBrokerLog(*cluster, broker)
 		}
 
+		zookeepers = append(zookeepers, cluster.Zookeeper)
+
 	default:
 		clusters, err := searchClusters(ctx, "")
 		if err != nil {
@@ -355,10 +930,22 @@ func runLogs(name ClusterName) error {
 				addBrokerLog(cluster, broker)
 			}
 		}
+
+		zookeepers, err = listZookeepers(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
 	if *logsZk {
-		files = append(files, filepath.Join(dataDir, "zookeeper.log"))
+		for _, zookeeper := range zookeepers {
+			for _, node := range zookeeper.Nodes {
+				// The Zookeeper nodes only have some of the log files of the brokers.
+				if p := findZookeeperLog(zookeeper, node, *logsFile); p != "" {
+					files = append(files, p)
+				}
+			}
+		}
 	}
 
 	return tailFiles(*logsFollow, files...)
@@ -380,16 +967,13 @@ func runScript(args []string) error {
 	}
 
 	// The script is not in the path, it needs to be absolute.
-	kafkaPath := makeKafkaExtractedPath(cluster.Version)
+	kafkaPath := makeClusterKafkaPath(*cluster)
 
 	// We allow a user to use either the full name with the .sh extension like kafka-topics.sh
-	// or the name without the extension.
-	originalCommand := filepath.Join(kafkaPath, "bin", args[0])
-	scriptName := args[0]
-	if !strings.HasSuffix(scriptName, ".sh") {
-		scriptName += ".sh"
-		originalCommand += ".sh"
-	}
+	// or the name without the extension, whatever the extension used by the distribution.
+	dist := clusterDistribution(*cluster)
+	scriptName := strings.TrimSuffix(args[0], ".sh")
+	originalCommand := filepath.Join(kafkaPath, dist.ScriptsDir, scriptName+dist.ScriptSuffix)
 
 	// Kafka has scripts with two main ways of providing the connection parameters for the cluster:
 	// * the zookeeper node address and prefix
@@ -400,7 +984,7 @@ func runScript(args []string) error {
 	switch requirement := kafkaScriptsRequirements[scriptName]; requirement.connect {
 	case kafkaScriptZookeeper:
 		// Prepend the list of arguments with the zookeeper connection string.
-		zkAddr := *globalZkAddr + "/" + string(name)
+		zkAddr := cluster.Zookeeper.ConnectString() + "/" + string(name)
 		args = append([]string{requirement.FlagName(), zkAddr}, args[1:]...)
 
 	case kafkaScriptKafka:
@@ -428,173 +1012,2059 @@ func runScript(args []string) error {
 	return cmd.Run()
 }
 
-func main() {
-	log.SetFlags(0)
+// zkBrowseTimeout is the time to wait for Zookeeper to answer the zk commands.
+const zkBrowseTimeout = 10 * time.Second
 
-	// Initialize all necessary directories
-	if err := initDirectories(); err != nil {
-		log.Fatal(err)
-	}
+func runZk(action string, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 
-	// Open and maybe initialize the database
-	if err := openDatabase(); err != nil {
-		log.Fatal(err)
+	name := ClusterName(args[0])
+
+	p := "/"
+	if len(args) > 1 {
+		p = args[1]
 	}
 
-	// it's possible the host has rebooted and the database is out of sync
-	// so we clean up the database if necessary.
+	cluster, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		return fmt.Errorf("cluster %q doesn't exist", name)
+	}
 
-	if err := cleanupDatabase(); err != nil {
-		log.Fatal(err)
+	browser, err := newZkBrowser(*cluster)
+	if err != nil {
+		return err
 	}
+	defer browser.Close()
 
-	//
+	// The Zookeeper client doesn't give up if Zookeeper is not reachable so don't wait forever.
 
-	createCmd := &ffcli.Command{
-		Name:      "create",
-		Usage:     "create <name> <version>",
-		FlagSet:   createFlags,
-		ShortHelp: "create a Kafka cluster with a unique name using the specified version",
-		Exec: func(args []string) error {
-			if len(args) < 2 {
-				return fmt.Errorf("Usage: kcm create <name> <version>")
-			}
-			return runCreateCluster(ClusterName(args[0]), args[1])
-		},
+	ctx, cancel = context.WithTimeout(context.Background(), zkBrowseTimeout)
+	defer cancel()
+
+	err = browser.Run(ctx, func() error {
+		switch action {
+		case "ls":
+			return browser.List(os.Stdout, p)
+		case "get":
+			return browser.Get(os.Stdout, p)
+		case "stat":
+			return browser.Stat(os.Stdout, p)
+		case "tree":
+			return browser.Tree(os.Stdout, p)
+		case "rm":
+			return browser.Remove(p, *zkRmRecursive)
+		default:
+			panic(fmt.Errorf("unknown zk action %q", action))
+		}
+	})
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("zookeeper %q didn't answer in %s, is it started?", cluster.Zookeeper.Name, zkBrowseTimeout)
 	}
 
-	removeCmd := &ffcli.Command{
-		Name:      "remove",
-		Usage:     "remove <name>",
-		ShortHelp: "remove a Kafka cluster",
-		Exec: func(args []string) error {
-			if len(args) < 1 {
-				return fmt.Errorf("Usage: kcm remove <name>")
-			}
-			return runRemoveCluster(ClusterName(args[0]))
-		},
+	return err
+}
+
+func runZkCreateEnsemble(name string) error {
+	if *zkCreateEnsembleNodes < 1 {
+		return fmt.Errorf("an ensemble needs at least one node")
 	}
 
-	listCmd := &ffcli.Command{
-		Name:      "list",
-		Usage:     "list [pattern]",
-		ShortHelp: "list the existing Kafka clusters",
-		LongHelp: `list the existing Kafka clusters.
+	// NOTE(vincent): the catalog may have to be refreshed from the network, do it before starting the timeout.
+	if err := validateZookeeperVersion(*zkCreateEnsembleVersion); err != nil {
+		return err
+	}
 
-The list can be filtered using the "pattern" argument which is a regex.`,
-		Exec: func(args []string) error {
-			if len(args) == 0 {
-				return runListClusters("")
-			}
-			return runListClusters(args[0])
-		},
+	// Another kcm command could be allocating the same ports.
+	lock, err := acquireLock(registryLockName)
+	if err != nil {
+		return err
 	}
+	defer lock.Release()
 
-	statusCmd := &ffcli.Command{
-		Name:      "status",
-		Usage:     "status",
-		ShortHelp: "print the status of the current kafka cluster, if any",
-		Exec: func(args []string) error {
-			if len(args) < 1 {
-				return runStatus("")
-			}
-			return runStatus(ClusterName(args[0]))
-		},
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	zookeeper, err := newZookeeper(ctx, name, zookeeperEnsemble, *zkCreateEnsembleVersion, *zkCreateEnsembleNodes)
+	if err != nil {
+		return err
 	}
 
-	startCmd := &ffcli.Command{
-		Name:      "start",
-		Usage:     "start <cluster>",
-		ShortHelp: "start a cluster",
-		Exec: func(args []string) error {
-			if len(args) < 1 {
-				return fmt.Errorf("Usage: kcm start <cluster>")
-			}
-			return runStart(ClusterName(args[0]))
-		},
+	if err := createZookeeper(ctx, zookeeper); err != nil {
+		if sqlite.ErrCode(err) == sqlite.SQLITE_CONSTRAINT_UNIQUE {
+			log.Printf("Zookeeper named %q already exists", name)
+			return nil
+		}
+		return err
 	}
 
-	stopCmd := &ffcli.Command{
-		Name:      "stop",
-		FlagSet:   stopFlags,
-		Usage:     "stop [cluster]",
-		ShortHelp: "stop a cluster (or all)",
-		Exec: func(args []string) error {
-			if len(args) < 1 {
-				return runStop("")
-			}
-			return runStop(ClusterName(args[0]))
-		},
+	log.Printf("created Zookeeper ensemble %q", name)
+	log.Printf("Use it with: kcm create -zk %s <name> <version>", name)
+
+	return nil
+}
+
+func runZkRemove(name string) error {
+	// NOTE(vincent): the locks make sure another kcm command doesn't attach a cluster to the ensemble
+	// or start it between the check and the removal.
+
+	registryLock, err := acquireLock(registryLockName)
+	if err != nil {
+		return err
 	}
+	defer registryLock.Release()
 
-	logsCmd := &ffcli.Command{
-		Name:      "logs",
-		FlagSet:   logsFlags,
-		Usage:     "logs [cluster]",
-		ShortHelp: "print the logs for a cluster (or all)",
-		Exec: func(args []string) error {
-			if len(args) < 1 {
-				return runLogs("")
-			}
-			return runLogs(ClusterName(args[0]))
-		},
+	lock, err := acquireLock(zookeeperLockName)
+	if err != nil {
+		return err
 	}
+	defer lock.Release()
 
-	runScriptCmd := &ffcli.Command{
-		Name:      "run-script",
-		Usage:     "run-script <cluster> <script name>",
-		ShortHelp: "run a kafka script on a cluster",
-		LongHelp: `Run a kafka script on a cluster.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
 
-This is a wrapper to run things like kafka-topics.sh or kafka-consumer-groups.sh with the correct cluster information
-already provided.
+	zookeeper, err := getZookeeper(ctx, name)
+	if err != nil {
+		return err
+	}
+	if zookeeper == nil {
+		return fmt.Errorf("Zookeeper %q doesn't exist", name)
+	}
 
-For example this:
+	user, err := findZookeeperCluster(ctx, *zookeeper)
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		return fmt.Errorf("Zookeeper %q is used by cluster %q", name, user)
+	}
 
-	$ kcm run-script staging kafka-topics.sh --describe
+	log.Printf("stopping zookeeper %q", zookeeper.Name)
+	for _, node := range zookeeper.Nodes {
+		if err := stopZookeeperNode(ctx, *zookeeper, node, stopOptions{timeout: 10 * time.Second}); err != nil {
+			return err
+		}
+	}
+	if err := removeZookeeperData(*zookeeper); err != nil {
+		return err
+	}
+	if err := removeZookeeper(ctx, *zookeeper); err != nil {
+		return err
+	}
 
-Would be equivalent to running this:
+	log.Printf("removed zookeeper %q", zookeeper.Name)
 
-	$ kafka-topics.sh --zookeeper localhost:2181/staging --describe
+	return nil
+}
 
-Or this:
+// runZkLifecycle starts or stops a Zookeeper ensemble, or a single one of its nodes.
+func runZkLifecycle(start bool, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
 
-	$ kcm run-script staging kafka-consumer-groups.sh --list
+	zookeeper, err := getZookeeper(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if zookeeper == nil {
+		return fmt.Errorf("Zookeeper %q doesn't exist", args[0])
+	}
 
-Would be equivalent to running this:
+	nodes := zookeeper.Nodes
+	if len(args) > 1 {
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid node id %q. err: %w", args[1], err)
+		}
 
-    $ kafka-consumer-groups.sh --bootstrap-servers localhost:9092 --list`,
-		Exec: func(args []string) error {
-			if len(args) < 2 {
-				return fmt.Errorf("Usage: kcm run-script <cluster> <script name>")
+		nodes = nil
+		for _, node := range zookeeper.Nodes {
+			if node.ID == id {
+				nodes = append(nodes, node)
 			}
-			return runScript(args)
-		},
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("Zookeeper %q has no node %d", zookeeper.Name, id)
+		}
 	}
 
-	versionCmd := &ffcli.Command{
-		Name:      "version",
-		Usage:     "version",
-		ShortHelp: "print the version information (necessary to report bugs)",
-		Exec: func([]string) error {
-			log.Printf("kcm version %s, commit %s", gVersion, gCommit)
-			return nil
-		},
+	if start {
+		if err := startZookeeperNodes(ctx, *zookeeper, nodes); err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			log.Printf("launched zookeeper %q node %d", zookeeper.Name, node.ID)
+		}
+		return nil
 	}
 
-	rootCmd := &ffcli.Command{
-		Usage:     "kcm <subcommand> [flag] [args...]",
-		FlagSet:   globalFlags,
-		ShortHelp: "manage Kafka clusters for local development and testing",
-		Subcommands: []*ffcli.Command{
-			createCmd, removeCmd, listCmd, statusCmd,
-			startCmd, stopCmd, logsCmd,
-			runScriptCmd,
-			versionCmd,
-		},
-		Exec: func([]string) error {
-			return flag.ErrHelp
-		},
+	// Stopping a single member of an ensemble is allowed while clusters are running, it's how failures are tested.
+
+	opts := stopOptions{
+		force:   *zkStopForce || (len(args) > 1 && zookeeper.IsEnsemble()),
+		timeout: *zkStopTimeout,
+	}
+	if err := stopZookeeperNodes(ctx, *zookeeper, nodes, opts); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		log.Printf("stopped zookeeper %q node %d", zookeeper.Name, node.ID)
+	}
+
+	return nil
+}
+
+// psState is the state of a process found by scanning /proc compared to the database.
+type psState int
+
+const (
+	// psTracked means the process is the one recorded in the database.
+	psTracked psState = iota
+	// psUntracked means the broker or Zookeeper node exists but the process isn't recorded.
+	psUntracked
+	// psUnknown means the broker or Zookeeper node doesn't exist in the database anymore.
+	psUnknown
+)
+
+func runPs() error {
+	if *psAdopt && *psKill {
+		return fmt.Errorf("-adopt and -kill can't be used together")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 1. find the processes and what they're running
+
+	processes, err := findKcmProcesses()
+	if err != nil {
+		return err
+	}
+	if len(processes) == 0 {
+		log.Printf("no process found")
+		return nil
+	}
+
+	clusters, err := searchClusters(ctx, "")
+	if err != nil {
+		return err
+	}
+	zookeepers, err := listZookeepers(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 2. compare them to the database, adopting them if asked to
+
+	states := make([]psState, len(processes))
+	for i, p := range processes {
+		var state psState
+		if *psAdopt {
+			state, err = adoptProcess(p)
+		} else {
+			state, err = getPsState(ctx, p, clusters, zookeepers, false)
+		}
+		if err != nil {
+			return err
+		}
+		states[i] = state
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for i, p := range processes {
+		var s string
+		switch states[i] {
+		case psTracked:
+			s = "tracked"
+		case psUntracked:
+			s = "not tracked"
+		case psUnknown:
+			s = "unknown"
+		}
+
+		fmt.Fprintf(w, "pid:%d\t%s\t%s\t\n", p.process.pid, p, s)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// 3. kill the processes not tracked if asked to
+
+	if !*psKill {
+		return nil
+	}
+
+	for i, p := range processes {
+		if states[i] == psTracked {
+			continue
+		}
+
+		killed, err := terminateProcess(p.process.pid, *psTimeout)
+		switch {
+		case err != nil:
+			return fmt.Errorf("unable to stop %s. err: %w", p, err)
+		case killed:
+			log.Printf("%s killed after %s", p, *psTimeout)
+		default:
+			log.Printf("%s stopped", p)
+		}
+	}
+
+	return nil
+}
+
+// adoptProcess returns the state of a process launched by kcm, recording it in the database if it isn't tracked.
+//
+// It holds the lock start and stop take for the process, the cluster lock for a broker and the Zookeeper lock for a Zookeeper node,
+// so the status can't change between the time it's read and the time it's rewritten.
+func adoptProcess(p kcmProcess) (psState, error) {
+	lockName := zookeeperLockName
+	if p.IsBroker() {
+		lockName = makeClusterLockName(p.clusterName)
+	}
+
+	lock, err := acquireLock(lockName)
+	if err != nil {
+		return psUnknown, err
+	}
+	defer lock.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// NOTE(vincent): the clusters and ensembles are read again under the lock in case one was removed in the meantime.
+
+	clusters, err := searchClusters(ctx, "")
+	if err != nil {
+		return psUnknown, err
+	}
+	zookeepers, err := listZookeepers(ctx)
+	if err != nil {
+		return psUnknown, err
+	}
+
+	return getPsState(ctx, p, clusters, zookeepers, true)
+}
+
+// getPsState returns the state of a process launched by kcm.
+// The caller must hold the lock of the process if adopt is true, see adoptProcess.
+// If adopt is true and the process isn't tracked, it's recorded in the database.
+func getPsState(ctx context.Context, p kcmProcess, clusters []Cluster, zookeepers []Zookeeper, adopt bool) (psState, error) {
+	if p.IsBroker() {
+		for _, cluster := range clusters {
+			if cluster.Name != p.clusterName {
+				continue
+			}
+
+			for _, broker := range cluster.Brokers {
+				if broker.ID != p.brokerID {
+					continue
+				}
+
+				status, err := getBrokerStatus(ctx, cluster, broker)
+				if err != nil {
+					return psUnknown, err
+				}
+
+				switch {
+				case status.IsStarted() && status.process.pid == p.process.pid:
+					return psTracked, nil
+				case !adopt:
+					return psUntracked, nil
+				case status.IsStarted():
+					log.Printf("not adopting %s, pid %d is already tracked", p, status.process.pid)
+					return psUntracked, nil
+				}
+
+				// Adopt the process
+
+				if err := removeBrokerStatus(ctx, cluster, broker); err != nil {
+					return psUnknown, err
+				}
+				if err := setBrokerStatus(ctx, brokerStatus{process: p.process, cluster: cluster, broker: broker}); err != nil {
+					return psUnknown, err
+				}
+
+				log.Printf("adopted %s", p)
+
+				return psTracked, nil
+			}
+		}
+
+		return psUnknown, nil
+	}
+
+	for _, zookeeper := range zookeepers {
+		if zookeeper.Name != p.zookeeperName {
+			continue
+		}
+
+		for _, node := range zookeeper.Nodes {
+			if node.ID != p.nodeID {
+				continue
+			}
+
+			status, err := getZookeeperNodeStatus(ctx, zookeeper, node)
+			if err != nil {
+				return psUnknown, err
+			}
+
+			switch {
+			case status.IsStarted() && status.process.pid == p.process.pid:
+				return psTracked, nil
+			case !adopt:
+				return psUntracked, nil
+			case status.IsStarted():
+				log.Printf("not adopting %s, pid %d is already tracked", p, status.process.pid)
+				return psUntracked, nil
+			}
+
+			// Adopt the process
+
+			if err := removeZookeeperNodeStatus(ctx, zookeeper, node); err != nil {
+				return psUnknown, err
+			}
+			if err := setZookeeperNodeStatus(ctx, zookeeperNodeStatus{process: p.process, zookeeper: zookeeper, node: node}); err != nil {
+				return psUnknown, err
+			}
+
+			log.Printf("adopted %s", p)
+
+			return psTracked, nil
+		}
+	}
+
+	return psUnknown, nil
+}
+
+// setupDatabase opens the database, applying the pending migrations, and checks it.
+func setupDatabase() error {
+	if err := openDatabase(); err != nil {
+		return err
+	}
+	if err := checkDatabase(); err != nil {
+		return err
+	}
+
+	// it's possible the host has rebooted and the database is out of sync
+	// so we clean up the database if necessary.
+
+	if err := cleanupDatabase(); err != nil {
+		return fmt.Errorf("unable to clean up the database. err: %w", err)
+	}
+
+	return nil
+}
+
+// requireDatabase sets up the database before running a command and its subcommands.
+// The commands fail if the database is unusable.
+func requireDatabase(cmd *ffcli.Command) {
+	exec := cmd.Exec
+	cmd.Exec = func(args []string) error {
+		err := setupDatabase()
+		switch {
+		case errors.Is(err, errDatabaseTooNew):
+			return err
+		case err != nil:
+			return fmt.Errorf("the database is unusable, use \"kcm db repair\", \"kcm db rebuild\" or \"kcm db restore\". err: %w", err)
+		}
+
+		return exec(args)
+	}
+
+	for _, subcommand := range cmd.Subcommands {
+		requireDatabase(subcommand)
+	}
+}
+
+func runDbMigrate() error {
+	pending, err := openAndMigrateDatabase(*dbMigrateDryRun)
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+
+	switch {
+	case len(pending) == 0:
+		log.Printf("the database is up to date (schema version %d)", latest)
+
+	case *dbMigrateDryRun:
+		for _, m := range pending {
+			log.Printf("pending migration %d: %s", m.version, m.description)
+		}
+
+	default:
+		for _, m := range pending {
+			log.Printf("applied migration %d: %s", m.version, m.description)
+		}
+		log.Printf("the database is up to date (schema version %d)", latest)
+	}
+
+	return nil
+}
+
+func runDbRepair() error {
+	databaseErr := setupDatabase()
+	if databaseErr != nil && !errors.Is(databaseErr, errCorruptedDatabase) {
+		return fmt.Errorf("unable to open the database, use \"kcm db rebuild\" or \"kcm db restore\". err: %w", databaseErr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	// 1. corrupted indexes are the only corruption SQLite can fix by itself
+
+	if databaseErr != nil {
+		log.Printf("%v, reindexing", databaseErr)
+
+		if err := sqlitex.ExecTransient(conn, "REINDEX;", nil); err != nil {
+			return fmt.Errorf("unable to reindex the database, use \"kcm db rebuild\" or \"kcm db restore\". err: %w", err)
+		}
+		if err := checkDatabaseConn(conn); err != nil {
+			return fmt.Errorf("unable to repair the database, use \"kcm db rebuild\" or \"kcm db restore\". err: %w", err)
+		}
+	}
+
+	// 2. add what's missing from the files on disk
+
+	if err := repairDatabase(conn); err != nil {
+		return err
+	}
+
+	log.Printf("repaired the database")
+
+	return nil
+}
+
+func runDbRebuild() error {
+	// 1. move the current database out of the way, it can still be restored later
+
+	if err := closeDatabase(); err != nil {
+		log.Printf("unable to close the database. err: %v", err)
+	}
+
+	backup := makeBackupPath()
+	moved, err := moveDatabase(backup)
+	if err != nil {
+		return err
+	}
+	if moved {
+		log.Printf("moved the database to %s", backup)
+	}
+
+	// 2. rebuild it from scratch
+
+	if err := openDatabase(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn := pool.Get(ctx)
+	defer pool.Put(conn)
+
+	if err := repairDatabase(conn); err != nil {
+		return err
+	}
+
+	log.Printf("rebuilt the database, use \"kcm ps -adopt\" to track the processes still running")
+
+	return nil
+}
+
+func runDbBackup(args []string) error {
+	// A corrupted database can still be backed up.
+	if pool == nil {
+		if err := setupDatabase(); err != nil && !errors.Is(err, errCorruptedDatabase) {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dst := makeBackupPath()
+	if len(args) > 0 {
+		dst = args[0]
+	}
+
+	if err := backupDatabase(ctx, dst); err != nil {
+		return err
+	}
+
+	log.Printf("backed up the database to %s", dst)
+
+	return nil
+}
+
+func runDbRestore(src string) error {
+	// 1. check the backup is usable
+
+	if err := checkBackup(src); err != nil {
+		return err
+	}
+
+	// 2. keep a copy of the current database if it's usable
+
+	if databaseErr := setupDatabase(); databaseErr == nil || errors.Is(databaseErr, errDatabaseTooNew) {
+		backup := makeBackupPath()
+		if err := runDbBackup([]string{backup}); err != nil {
+			return err
+		}
+	}
+
+	// 3. replace it
+
+	if err := closeDatabase(); err != nil {
+		log.Printf("unable to close the database. err: %v", err)
+	}
+
+	if err := restoreDatabase(src); err != nil {
+		return err
+	}
+
+	// 4. the backup can come from an older version of kcm and the processes it tracks are likely gone
+
+	if err := openDatabase(); err != nil {
+		return err
+	}
+	if err := cleanupDatabase(); err != nil {
+		return err
+	}
+
+	log.Printf("restored the database from %s", src)
+
+	return nil
+}
+
+func runVersions() error {
+	if *versionsAvailable || *versionsRefresh {
+		return runVersionsAvailable()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	users, err := getArtifactUsers(ctx)
+	if err != nil {
+		return err
+	}
+	artifacts, err := findArtifacts(users)
+	if err != nil {
+		return err
+	}
+
+	formatOptionalSize := func(n int64) string {
+		if n < 0 {
+			return "-"
+		}
+		return formatSize(n)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, a := range artifacts {
+		usedBy := "not used"
+		if a.IsUsed() {
+			usedBy = "used by " + strings.Join(a.usedBy, ", ")
+		}
+
+		var scala string
+		if a.scala != "" {
+			scala = "scala:" + a.scala
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\tarchive:%s\textracted:%s\t%s\t\n",
+			a.kind, a.version, scala,
+			formatOptionalSize(a.tarballSize), formatOptionalSize(a.extractedSize),
+			usedBy,
+		)
+	}
+
+	return w.Flush()
+}
+
+// runJVMDiagnostics runs a diagnostic on the running brokers of a cluster, or on one broker if brokerID isn't 0.
+func runJVMDiagnostics(diagnostic string, name ClusterName, brokerID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	cluster, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		return fmt.Errorf("cluster %q doesn't exist", name)
+	}
+
+	brokers, err := selectBrokers(*cluster, brokerID)
+	if err != nil {
+		return err
+	}
+
+	for _, broker := range brokers {
+		path, err := runJVMDiagnostic(ctx, *cluster, broker, diagnostic)
+		if err != nil {
+			if brokerID > 0 {
+				return err
+			}
+			log.Printf("skipping broker %d: %v", broker.ID, err)
+			continue
+		}
+		log.Printf("wrote %s of broker %d to %s", jvmDiagnostics[diagnostic].description, broker.ID, path)
+	}
+
+	return nil
+}
+
+func runPluginsList(name ClusterName) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cluster, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		return fmt.Errorf("cluster %q doesn't exist", name)
+	}
+
+	// 1. the plugin paths and their jars
+
+	if len(cluster.PluginPaths) == 0 {
+		log.Printf("cluster %q has no plugin path", name)
+	}
+	for _, p := range cluster.PluginPaths {
+		if _, err := os.Stat(p); err != nil {
+			log.Printf("%s (doesn't exist)", p)
+			continue
+		}
+		log.Printf("%s", p)
+		if !isDir(p) {
+			continue
+		}
+
+		jars, err := findPluginJars(Cluster{PluginPaths: []string{p}})
+		if err != nil {
+			return err
+		}
+		for _, jar := range jars {
+			log.Printf("  %s", jar)
+		}
+	}
+
+	// 2. the class path used by the next start
+
+	if !isDir(makeClusterKafkaPath(*cluster)) {
+		log.Printf("\nKafka isn't extracted yet, the class path is resolved when the cluster starts")
+		return nil
+	}
+
+	cp, err := makeClusterClasspath(*cluster)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("\nClass path")
+	for _, jar := range strings.Split(cp, ":") {
+		log.Printf("  %s", jar)
+	}
+
+	// 3. the brokers started before a change
+
+	status, err := getClusterStatus(ctx, *cluster)
+	if err != nil {
+		return err
+	}
+	for _, s := range status.brokers {
+		if s.IsStarted() && processClasspath(s.process.cmdline) != cp {
+			log.Printf("\nbroker %d was started with another class path, restart it to use the changes", s.broker.ID)
+		}
+	}
+
+	return nil
+}
+
+// runPluginsEdit adds or removes plugin paths of a cluster. They're used by the next start.
+func runPluginsEdit(name ClusterName, add bool, paths []string) error {
+	lock, err := acquireLock(makeClusterLockName(name))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cluster, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		return fmt.Errorf("cluster %q doesn't exist", name)
+	}
+
+	res := cluster.PluginPaths
+
+	for _, p := range paths {
+		var path string
+		if add {
+			path, err = normalizePluginPath(p)
+		} else {
+			// NOTE(vincent): a plugin path can be removed even if it doesn't exist anymore.
+			path, err = filepath.Abs(p)
+		}
+		if err != nil {
+			return err
+		}
+
+		i := indexString(res, path)
+		switch {
+		case add && i >= 0:
+			log.Printf("%s is already a plugin path of cluster %q", path, name)
+		case add:
+			res = append(res, path)
+			log.Printf("added plugin path %s", path)
+		case i < 0:
+			return fmt.Errorf("%s is not a plugin path of cluster %q", path, name)
+		default:
+			res = append(res[:i:i], res[i+1:]...)
+			log.Printf("removed plugin path %s", path)
+		}
+	}
+
+	if err := setClusterPluginPaths(ctx, *cluster, res); err != nil {
+		return err
+	}
+
+	log.Printf("the plugin paths are used the next time the brokers start")
+
+	return nil
+}
+
+func runLogLevelGet(name ClusterName, brokerID int, logger string) error {
+	// NOTE(vincent): kafka-configs runs a JVM for each broker, it can take a few seconds.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	cluster, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		return fmt.Errorf("cluster %q doesn't exist", name)
+	}
+
+	brokers, err := selectBrokers(*cluster, brokerID)
+	if err != nil {
+		return err
+	}
+
+	dynamic := supportsDynamicLogLevels(*cluster)
+	javaResolved := false
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, broker := range brokers {
+		persistent := brokerLogLevels(*cluster, broker)
+
+		loggers := sortedLoggers(persistent)
+		if logger != "" {
+			loggers = []string{logger}
+		}
+		if len(loggers) == 0 {
+			fmt.Fprintf(w, "Broker %d\tno persistent log level\t\t\t\n", broker.ID)
+			continue
+		}
+
+		status, err := getBrokerStatus(ctx, *cluster, broker)
+		if err != nil {
+			return fmt.Errorf("unable to get kafka broker pid. err: %w", err)
+		}
+
+		// The running levels are only known for the started brokers, either from the broker itself
+		// or from the persistent levels it was started with.
+
+		var running map[string]string
+		switch {
+		case !status.IsStarted():
+		case dynamic:
+			// kafka-configs runs on the Java runtime of the cluster, like in loglevel set.
+			if !javaResolved {
+				javaHome, err := resolveClusterJava(ctx, *cluster)
+				if err != nil {
+					return err
+				}
+				cluster.JavaHome = javaHome
+				javaResolved = true
+			}
+
+			running, err = describeBrokerLogLevels(ctx, *cluster, broker)
+			if err != nil {
+				return fmt.Errorf("unable to get the log levels of broker %d. err: %w", broker.ID, err)
+			}
+		default:
+			running = persistent
+		}
+
+		for _, l := range loggers {
+			level := "not started"
+			if status.IsStarted() {
+				level = orDefault(running[l], "-")
+			}
+			fmt.Fprintf(w, "Broker %d\t%s\t%s\tpersistent:%s\t\n", broker.ID, l, level, orDefault(persistent[l], "-"))
+		}
+	}
+
+	return w.Flush()
+}
+
+func runLogLevelSet(name ClusterName, brokerID int, logger, level string) error {
+	if err := validateLoggerName(logger); err != nil {
+		return err
+	}
+	level, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	lock, err := acquireLock(makeClusterLockName(name))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Leave enough time for a rolling restart.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	cluster, err := getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		return fmt.Errorf("cluster %q doesn't exist", name)
+	}
+
+	if _, err := selectBrokers(*cluster, brokerID); err != nil {
+		return err
+	}
+
+	// 1. record the persistent level, it's written to the logging config every time the brokers start
+
+	if err := setLogLevel(ctx, *cluster, brokerID, logger, level); err != nil {
+		return err
+	}
+	if level == "" {
+		log.Printf("removed the persistent level of %s", logger)
+	} else {
+		log.Printf("set the persistent level of %s to %s", logger, level)
+	}
+
+	cluster, err = getCluster(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// 2. apply it to the started brokers. A broker level can still override a cluster level, so the level
+	// applied is the one the broker would start with.
+
+	brokers, err := selectBrokers(*cluster, brokerID)
+	if err != nil {
+		return err
+	}
+
+	var started []Broker
+	for _, broker := range brokers {
+		status, err := getBrokerStatus(ctx, *cluster, broker)
+		if err != nil {
+			return fmt.Errorf("unable to get kafka broker pid. err: %w", err)
+		}
+		if status.IsStarted() {
+			started = append(started, broker)
+		} else {
+			log.Printf("broker %d is not started, the level is used the next time it starts", broker.ID)
+		}
+	}
+	if len(started) == 0 {
+		return nil
+	}
+
+	javaHome, err := resolveClusterJava(ctx, *cluster)
+	if err != nil {
+		return err
+	}
+	cluster.JavaHome = javaHome
+
+	if supportsDynamicLogLevels(*cluster) {
+		return forEachBroker(started, func(broker Broker) error {
+			effective := brokerLogLevels(*cluster, broker)[logger]
+			if err := alterBrokerLogLevel(ctx, *cluster, broker, logger, effective); err != nil {
+				return fmt.Errorf("unable to change the log level of broker %d. err: %w", broker.ID, err)
+			}
+
+			log.Printf("broker %d: %s is now %s", broker.ID, logger, orDefault(effective, "at the level of the root logger"))
+			return nil
+		})
+	}
+
+	// NOTE(vincent): the brokers before 2.4 read their levels only when they start, restart them one at a time
+	// so that the cluster stays available.
+
+	log.Printf("Kafka %s can't change the log levels of a running broker, restarting the brokers one at a time", cluster.Version)
+
+	for _, broker := range started {
+		if err := restartBroker(ctx, *cluster, broker, stopOptions{timeout: *logLevelSetStopTimeout}, *logLevelSetStartTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runJava() error {
+	// NOTE(vincent): finding the Java runtimes can run java -version, do it before starting the timeout.
+	runtimes := discoverJavaRuntimes()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clusters, err := searchClusters(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	usedBy := make(map[string][]string)
+	for _, cluster := range clusters {
+		usedBy[cluster.JavaHome] = append(usedBy[cluster.JavaHome], string(cluster.Name))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, runtime := range runtimes {
+		s := "not used"
+		if names := usedBy[runtime.home]; len(names) > 0 {
+			s = "used by " + strings.Join(names, ", ")
+		}
+		fmt.Fprintf(w, "Java %d\t%s\t%s\t%s\t\n", runtime.Major(), runtime.version, runtime.home, s)
+	}
+
+	return w.Flush()
+}
+
+func runVersionsAvailable() error {
+	if *versionsZk {
+		versions, err := loadZookeeperVersions(*versionsRefresh)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			fmt.Println(version)
+		}
+
+		return nil
+	}
+
+	catalog, err := loadKafkaCatalog(*versionsRefresh)
+	if err != nil {
+		return err
+	}
+
+	aliases := make(map[KafkaVersion][]string)
+	aliases[catalog.Latest()] = append(aliases[catalog.Latest()], "latest")
+	aliases[catalog.LTS()] = append(aliases[catalog.LTS()], "lts")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, version := range catalog.versions {
+		fmt.Fprintf(w, "%s\t%s\n", version, strings.Join(aliases[version], ", "))
+	}
+
+	return w.Flush()
+}
+
+func runFetch(versions []string) error {
+	if *fetchScala != "" && !scalaVersionPattern.MatchString(*fetchScala) {
+		return fmt.Errorf("invalid Scala version %q, must be like 2.13", *fetchScala)
+	}
+
+	dist, err := getKafkaDistribution(*fetchDistribution)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		var key artifactKey
+
+		switch {
+		case *fetchZk:
+			if err := validateZookeeperVersion(version); err != nil {
+				return err
+			}
+
+			key = artifactKey{kind: zookeeperArtifact, version: version}
+			if err := installZookeeper(version); err != nil {
+				return fmt.Errorf("unable to fetch %s. err: %w", key, err)
+			}
+
+		default:
+			resolvedVersion, err := resolveKafkaVersion(dist, version)
+			if err != nil {
+				return err
+			}
+
+			scala := *fetchScala
+			if scala == "" {
+				scala = dist.DefaultScalaVersion(resolvedVersion)
+			}
+			if err := dist.CheckScalaVersion(resolvedVersion, scala); err != nil {
+				return err
+			}
+
+			key = artifactKey{kind: dist.Kind, version: string(resolvedVersion), scala: scala}
+			if err := installKafka(dist, resolvedVersion, scala); err != nil {
+				return fmt.Errorf("unable to fetch %s. err: %w", key, err)
+			}
+		}
+
+		log.Printf("fetched %s", key)
+	}
+
+	return nil
+}
+
+func runPrune() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	users, err := getArtifactUsers(ctx)
+	if err != nil {
+		return err
+	}
+	artifacts, err := findArtifacts(users)
+	if err != nil {
+		return err
+	}
+
+	var freed int64
+	for _, a := range artifacts {
+		if a.IsUsed() {
+			continue
+		}
+
+		var size int64
+		if a.IsCached() {
+			size += a.tarballSize
+		}
+		if a.IsExtracted() {
+			size += a.extractedSize
+		}
+
+		if *pruneDryRun {
+			log.Printf("would remove %s (%s)", a, formatSize(size))
+		} else {
+			removed, err := removeUnusedArtifact(a)
+			if err != nil {
+				return fmt.Errorf("unable to remove %s. err: %w", a, err)
+			}
+			if !removed {
+				log.Printf("kept %s, it's used now", a)
+				continue
+			}
+			log.Printf("removed %s (%s)", a, formatSize(size))
+		}
+
+		freed += size
+	}
+
+	switch {
+	case freed == 0:
+		log.Printf("nothing to remove")
+	case *pruneDryRun:
+		log.Printf("would free %s", formatSize(freed))
+	default:
+		log.Printf("freed %s", formatSize(freed))
+	}
+
+	return nil
+}
+
+func runArtifactsExport(dst string, versions []string) error {
+	// 1. find the archives to export, all of them by default
+
+	artifacts, err := findArtifacts(nil)
+	if err != nil {
+		return err
+	}
+
+	var exported []artifact
+	for _, a := range artifacts {
+		if a.IsCached() && (len(versions) == 0 || containsString(versions, a.version)) {
+			exported = append(exported, a)
+		}
+	}
+
+	for _, version := range versions {
+		var found bool
+		for _, a := range exported {
+			found = found || a.version == version
+		}
+		if !found {
+			return fmt.Errorf("version %s is not in the cache, use \"kcm fetch\" first", version)
+		}
+	}
+
+	if len(exported) == 0 {
+		return fmt.Errorf("the cache is empty, use \"kcm fetch\" first")
+	}
+
+	// 2. write the bundle
+
+	if err := exportArtifacts(dst, exported); err != nil {
+		return err
+	}
+
+	for _, a := range exported {
+		log.Printf("exported %s", a)
+	}
+	log.Printf("wrote %s, use \"kcm artifacts import %s\" to import it", dst, filepath.Base(dst))
+
+	return nil
+}
+
+func runArtifactsImport(args []string) error {
+	// 1. find the archives, a directory or a bundle is imported entirely
+
+	type archive struct {
+		path string
+		name string // the name printed, the path of an archive extracted from a bundle is meaningless
+	}
+
+	var archives []archive
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() && !isBundle(arg) {
+			archives = append(archives, archive{arg, arg})
+			continue
+		}
+
+		dir := arg
+		if isBundle(arg) {
+			dir, err = ioutil.TempDir(cacheDir, "bundle")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+
+			if err := extractBundle(dir, arg); err != nil {
+				return err
+			}
+		}
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() || makeArtifactCachePath(entry.Name()) == "" {
+				continue
+			}
+
+			a := archive{
+				path: filepath.Join(dir, entry.Name()),
+				name: filepath.Join(arg, entry.Name()),
+			}
+			if isBundle(arg) {
+				a.name = arg + ":" + entry.Name()
+			}
+			archives = append(archives, a)
+		}
+	}
+
+	if len(archives) == 0 {
+		return fmt.Errorf("no Kafka or Zookeeper archive found")
+	}
+
+	// 2. import them
+
+	for _, a := range archives {
+		dst, err := importArtifact(a.path)
+		if err != nil {
+			return fmt.Errorf("unable to import %s. err: %w", a.name, err)
+		}
+
+		if dst == "" {
+			log.Printf("%s is already in the cache", a.name)
+		} else {
+			log.Printf("imported %s to %s", a.name, dst)
+		}
+	}
+
+	return nil
+}
+
+func makeConfigPath() string {
+	return filepath.Join(dataDir, "config")
+}
+
+// makeGlobalFlagsOptions returns the options to parse the global flags.
+//
+// Besides the command line, they can be set in the config file with one flag per line, for example "mirror https://mirror.local/apache",
+// or with env vars prefixed by KCM_, for example KCM_OFFLINE=true. The command line takes precedence over the config file
+// which takes precedence over the env vars.
+func makeGlobalFlagsOptions() []ff.Option {
+	options := []ff.Option{
+		ff.WithEnvVarPrefix("KCM"),
+	}
+
+	// NOTE(vincent): ff fails if the config file doesn't exist.
+
+	if _, err := os.Stat(makeConfigPath()); err == nil {
+		options = append(options,
+			ff.WithConfigFile(makeConfigPath()),
+			ff.WithConfigFileParser(ff.PlainParser),
+		)
+	}
+
+	return options
+}
+
+func main() {
+	log.SetFlags(0)
+
+	// Initialize all necessary directories
+	if err := initDirectories(); err != nil {
+		log.Fatal(err)
+	}
+
+	// NOTE(vincent): the database is opened by each command, see requireDatabase.
+	// If it's unusable only the db commands can be used, to repair or replace it.
+
+	//
+
+	createCmd := &ffcli.Command{
+		Name:      "create",
+		Usage:     "create <name> <version>",
+		FlagSet:   createFlags,
+		ShortHelp: "create a Kafka cluster with a unique name using the specified version",
+		LongHelp: `Create a Kafka cluster with a unique name using the specified version.
+
+The version must be published by Apache, see "kcm versions -available". It can also be an alias:
+ - latest: the newest release
+ - lts: the newest release of the minor version before the latest one
+ - a minor version like 2.6: its newest release
+
+Kafka is published for several versions of Scala, use -scala to choose one. By default it's the one
+recommended for the Kafka version: 2.13 since Kafka 3.0, 2.12 before and older versions for very old releases.
+
+With -fetch Kafka and Zookeeper are downloaded and extracted right away instead of at the first start.
+
+By default the cluster uses Apache Kafka, use -distribution to use another distribution:
+ - apache: Apache Kafka, from the Apache mirrors
+ - confluent: Confluent Community, from packages.confluent.io. The version is a Confluent Platform
+   version like 6.2.0, aliases are not supported.
+
+A cluster can also use a custom distribution of Kafka, like a local build or a release candidate:
+ - -from-dir uses an extracted distribution in place, rebuilding it changes the cluster
+ - -from-tarball extracts a tarball
+ - -from-url downloads and extracts a tarball
+The version is optional if it's part of the file name like kafka_2.13-3.0.0.tgz or kafka-3.0.0-rc1.tgz.
+Custom distributions are named after their file, use -custom-name to choose the name. Clusters using
+the same name share the distribution, it's removed along with the last of them.
+
+The JVM of the brokers can be configured for the whole cluster with -heap, -jvm-opt and -env, or for
+one broker with -broker-heap, -broker-jvm-opt and -broker-env, whose values are prefixed by the broker id
+like 2:1g. The settings of a broker are applied after the ones of the cluster.
+
+With -jmx each broker gets a JMX port, without authentication. The ports are shown by list and status.
+
+Use -plugin-path to add your own jars to the class path of the brokers, like an authorizer, a metrics
+reporter or a config provider. See "kcm plugins" to change them later.
+
+The broker logs are rolled once they reach -log-max-size and -log-max-files of them are kept. With
+-separate-logs the controller, state change and request logs are written to their own files like Kafka
+does, instead of kafka.log. See "kcm logs -file" to print them.`,
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm create <name> <version>")
+			}
+
+			var version string
+			if len(args) > 1 {
+				version = args[1]
+			}
+
+			return runCreateCluster(ClusterName(args[0]), version)
+		},
+	}
+
+	removeCmd := &ffcli.Command{
+		Name:      "remove",
+		Usage:     "remove <name>",
+		ShortHelp: "remove a Kafka cluster",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm remove <name>")
+			}
+			return runRemoveCluster(ClusterName(args[0]))
+		},
+	}
+
+	listCmd := &ffcli.Command{
+		Name:      "list",
+		Usage:     "list [pattern]",
+		ShortHelp: "list the existing Kafka clusters",
+		LongHelp: `list the existing Kafka clusters.
+
+The list can be filtered using the "pattern" argument which is a regex.`,
+		Exec: func(args []string) error {
+			if len(args) == 0 {
+				return runListClusters("")
+			}
+			return runListClusters(args[0])
+		},
+	}
+
+	statusCmd := &ffcli.Command{
+		Name:      "status",
+		Usage:     "status",
+		ShortHelp: "print the status of the current kafka cluster, if any",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return runStatus("")
+			}
+			return runStatus(ClusterName(args[0]))
+		},
+	}
+
+	startCmd := &ffcli.Command{
+		Name:      "start",
+		Usage:     "start [-debug [-suspend]] <cluster>[:<broker>]",
+		FlagSet:   startFlags,
+		ShortHelp: "start a cluster",
+		LongHelp: `Start a cluster.
+
+With -debug the brokers are started with a JDWP agent so that a Java debugger can attach to them,
+for example to debug an authorizer or a metrics reporter. Each broker gets the first free port
+starting at 5005, printed at start and shown by status. Use <cluster>:<broker> to debug only one
+broker; a broker already running must be stopped first.
+
+With -suspend the brokers wait for a debugger to attach before running.`,
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm start <cluster>")
+			}
+
+			name, brokerID, err := parseClusterBroker(args[0])
+			if err != nil {
+				return err
+			}
+			if brokerID > 0 && !*startDebug {
+				return fmt.Errorf("a broker can only be chosen with -debug")
+			}
+			if *startSuspend && !*startDebug {
+				return fmt.Errorf("-suspend requires -debug")
+			}
+
+			return runStart(name, brokerID)
+		},
+	}
+
+	stopCmd := &ffcli.Command{
+		Name:      "stop",
+		FlagSet:   stopFlags,
+		Usage:     "stop [cluster]",
+		ShortHelp: "stop a cluster (or all)",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return runStop("")
+			}
+			return runStop(ClusterName(args[0]))
+		},
+	}
+
+	logsCmd := &ffcli.Command{
+		Name:      "logs",
+		FlagSet:   logsFlags,
+		Usage:     "logs [cluster]",
+		ShortHelp: "print the logs for a cluster (or all)",
+		LongHelp: `Print the logs for a cluster, or all of them.
+
+By default the main log of the brokers is printed, use -file to print another one:
+ - kafka: kafka.log, the main log
+ - controller, state-change, request: the logs written to their own files by the clusters created with -separate-logs
+ - gc: the GC log
+ - stdout, stderr: the standard output and error of the JVM, like the thread dumps
+
+With -zk the same files of the Zookeeper nodes are printed too, if they have them.`,
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return runLogs("")
+			}
+			return runLogs(ClusterName(args[0]))
+		},
+	}
+
+	runScriptCmd := &ffcli.Command{
+		Name:      "run-script",
+		Usage:     "run-script <cluster> <script name>",
+		ShortHelp: "run a kafka script on a cluster",
+		LongHelp: `Run a kafka script on a cluster.
+
+This is a wrapper to run things like kafka-topics.sh or kafka-consumer-groups.sh with the correct cluster information
+already provided.
+
+For example this:
+
+	$ kcm run-script staging kafka-topics.sh --describe
+
+Would be equivalent to running this:
+
+	$ kafka-topics.sh --zookeeper localhost:2181/staging --describe
+
+Or this:
+
+	$ kcm run-script staging kafka-consumer-groups.sh --list
+
+Would be equivalent to running this:
+
+    $ kafka-consumer-groups.sh --bootstrap-servers localhost:9092 --list`,
+		Exec: func(args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("Usage: kcm run-script <cluster> <script name>")
+			}
+			return runScript(args)
+		},
+	}
+
+	makeZkCmd := func(action string, flagSet *flag.FlagSet, usage, help string) *ffcli.Command {
+		return &ffcli.Command{
+			Name:      action,
+			Usage:     usage,
+			FlagSet:   flagSet,
+			ShortHelp: help,
+			Exec: func(args []string) error {
+				if len(args) < 1 {
+					return fmt.Errorf("Usage: kcm zk %s", usage)
+				}
+				return runZk(action, args)
+			},
+		}
+	}
+
+	zkCreateEnsembleCmd := &ffcli.Command{
+		Name:      "create-ensemble",
+		Usage:     "create-ensemble [-nodes 3] [-version version] <name>",
+		FlagSet:   zkCreateEnsembleFlags,
+		ShortHelp: "create a Zookeeper ensemble",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm zk create-ensemble <name>")
+			}
+			return runZkCreateEnsemble(args[0])
+		},
+	}
+
+	zkRemoveCmd := &ffcli.Command{
+		Name:      "remove",
+		Usage:     "remove <zookeeper>",
+		ShortHelp: "remove a Zookeeper ensemble not used by any cluster",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm zk remove <zookeeper>")
+			}
+			return runZkRemove(args[0])
+		},
+	}
+
+	zkStartCmd := &ffcli.Command{
+		Name:      "start",
+		Usage:     "start <zookeeper> [node]",
+		ShortHelp: "start a Zookeeper ensemble or one of its nodes",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm zk start <zookeeper> [node]")
+			}
+			return runZkLifecycle(true, args)
+		},
+	}
+
+	zkStopCmd := &ffcli.Command{
+		Name:      "stop",
+		Usage:     "stop [-force] [-timeout 10s] <zookeeper> [node]",
+		FlagSet:   zkStopFlags,
+		ShortHelp: "stop a Zookeeper ensemble or one of its nodes",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm zk stop <zookeeper> [node]")
+			}
+			return runZkLifecycle(false, args)
+		},
+	}
+
+	zkCmd := &ffcli.Command{
+		Name:      "zk",
+		Usage:     "zk <subcommand> [flag] [args...]",
+		ShortHelp: "manage the Zookeeper nodes and browse the Zookeeper data of a cluster",
+		LongHelp: `Manage the Zookeeper nodes and browse the Zookeeper data of a cluster.
+
+When browsing all paths are relative to the Zookeeper prefix of the cluster, so for example this:
+
+	$ kcm zk get staging /controller
+
+Would read the znode /staging/controller.
+
+Well-known Kafka znodes (brokers, controller, topics and partition states) are decoded.
+
+Ensembles of multiple nodes can be created and used by clusters:
+
+	$ kcm zk create-ensemble -nodes 3 quorum
+	$ kcm create -zk quorum staging 2.6.0
+
+Each node can be stopped and started on its own to test failures:
+
+	$ kcm zk stop quorum 2`,
+		Subcommands: []*ffcli.Command{
+			makeZkCmd("ls", nil, "ls <cluster> [path]", "list the children of a znode"),
+			makeZkCmd("get", nil, "get <cluster> [path]", "print the data of a znode"),
+			makeZkCmd("stat", nil, "stat <cluster> [path]", "print the stat of a znode"),
+			makeZkCmd("tree", nil, "tree <cluster> [path]", "print the tree of znodes below a znode"),
+			makeZkCmd("rm", zkRmFlags, "rm [-r] <cluster> <path>", "remove a znode"),
+			zkCreateEnsembleCmd, zkRemoveCmd,
+			zkStartCmd, zkStopCmd,
+		},
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	psCmd := &ffcli.Command{
+		Name:      "ps",
+		Usage:     "ps [-adopt] [-kill] [-timeout 30s]",
+		FlagSet:   psFlags,
+		ShortHelp: "find the brokers and Zookeeper nodes launched by kcm, even those not tracked anymore",
+		LongHelp: `Find the brokers and Zookeeper nodes launched by kcm, even those not tracked anymore.
+
+The running JVMs are found using their configuration file in the kcm data directory. This is useful
+if the database was removed or is out of sync: the processes keep running and use their ports.
+
+Each process is either:
+ - tracked: kcm knows about it
+ - not tracked: the broker or Zookeeper node exists but kcm doesn't know the process
+ - unknown: the broker or Zookeeper node doesn't exist anymore
+
+Processes not tracked can be adopted again with -adopt. Processes not tracked or unknown can be stopped with -kill.`,
+		Exec: func([]string) error {
+			return runPs()
+		},
+	}
+
+	dbRepairCmd := &ffcli.Command{
+		Name:      "repair",
+		Usage:     "repair",
+		ShortHelp: "add the clusters and Zookeeper nodes found on disk but missing from the database",
+		Exec: func([]string) error {
+			return runDbRepair()
+		},
+	}
+
+	dbRebuildCmd := &ffcli.Command{
+		Name:      "rebuild",
+		Usage:     "rebuild",
+		ShortHelp: "replace the database with a new one built from the files on disk",
+		Exec: func([]string) error {
+			return runDbRebuild()
+		},
+	}
+
+	dbBackupCmd := &ffcli.Command{
+		Name:      "backup",
+		Usage:     "backup [file]",
+		ShortHelp: "backup the database",
+		Exec: func(args []string) error {
+			return runDbBackup(args)
+		},
+	}
+
+	dbRestoreCmd := &ffcli.Command{
+		Name:      "restore",
+		Usage:     "restore <file>",
+		ShortHelp: "replace the database with a backup",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm db restore <file>")
+			}
+			return runDbRestore(args[0])
+		},
+	}
+
+	dbMigrateCmd := &ffcli.Command{
+		Name:      "migrate",
+		Usage:     "migrate [-dry-run]",
+		FlagSet:   dbMigrateFlags,
+		ShortHelp: "apply the pending migrations of the database",
+		LongHelp: `Apply the pending migrations of the database.
+
+Migrations are applied automatically by every command, this is only useful to see which migrations
+a new version of kcm would apply with -dry-run.`,
+		Exec: func([]string) error {
+			return runDbMigrate()
+		},
+	}
+
+	dbCmd := &ffcli.Command{
+		Name:      "db",
+		Usage:     "db <subcommand> [args...]",
+		ShortHelp: "repair, rebuild, backup or restore the kcm database",
+		LongHelp: `Repair, rebuild, backup or restore the kcm database.
+
+The database is checked every time kcm runs. If it's corrupted or was removed, the clusters and
+Zookeeper nodes can be found again from the config files written when they were started:
+
+	$ kcm db repair
+
+repair keeps the current database and only adds what's missing, rebuild starts from a new database.
+Only the clusters started at least once have config files.
+
+Backups are stored in ~/.kcm/backups by default. The current database is backed up before being restored.`,
+		Subcommands: []*ffcli.Command{
+			dbRepairCmd, dbRebuildCmd,
+			dbBackupCmd, dbRestoreCmd,
+			dbMigrateCmd,
+		},
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	versionsCmd := &ffcli.Command{
+		Name:      "versions",
+		Usage:     "versions [-available] [-refresh]",
+		FlagSet:   versionsFlags,
+		ShortHelp: "list the Kafka and Zookeeper versions downloaded, extracted or used",
+		LongHelp: `List the Kafka and Zookeeper versions downloaded, extracted or used.
+
+For each version this prints the size of its archive in the cache, the size of the extracted
+distribution and the clusters or Zookeeper ensembles using it.
+
+With -available this prints the Kafka versions which can be used instead. The list comes from the
+mirrors and is cached for a day, -refresh forces a refresh. The versions in the cache can always be used.`,
+		Exec: func([]string) error {
+			return runVersions()
+		},
+	}
+
+	var jvmSubcommands []*ffcli.Command
+	for _, d := range []struct{ name, help string }{
+		{"threads", "write a thread dump of the brokers"},
+		{"heap", "write a heap dump of the brokers"},
+		{"gc", "write the heap usage of the brokers, or a class histogram with Java 8"},
+		{"flags", "write the flags of the JVM of the brokers"},
+	} {
+		diagnostic := d.name
+		jvmSubcommands = append(jvmSubcommands, &ffcli.Command{
+			Name:      diagnostic,
+			Usage:     diagnostic + " <cluster> [broker]",
+			ShortHelp: d.help,
+			Exec: func(args []string) error {
+				if len(args) < 1 {
+					return fmt.Errorf("Usage: kcm jvm %s <cluster> [broker]", diagnostic)
+				}
+
+				brokerID, rest := splitBrokerArg(args[1:])
+				if len(rest) > 0 {
+					return fmt.Errorf("Usage: kcm jvm %s <cluster> [broker]", diagnostic)
+				}
+
+				return runJVMDiagnostics(diagnostic, ClusterName(args[0]), brokerID)
+			},
+		})
+	}
+
+	jvmCmd := &ffcli.Command{
+		Name:      "jvm",
+		Usage:     "jvm <threads|heap|gc|flags> <cluster> [broker]",
+		ShortHelp: "write thread dumps, heap dumps and other diagnostics of the JVM of the brokers",
+		LongHelp: `Write thread dumps, heap dumps and other diagnostics of the JVM of the running brokers.
+
+The output of each broker is written to a timestamped file in its diagnostics directory, like
+~/.kcm/staging/broker1/diagnostics/threads-20201015-153000.txt.
+
+The diagnostics use the jcmd tool of the Java runtime of the brokers. Without it, like with a JRE, only
+the thread dumps work: the brokers receive a SIGQUIT and the dump is read from their standard output.
+
+The GC logs of the brokers are always written next to their logs, see "kcm logs -file gc".`,
+		Subcommands: jvmSubcommands,
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	pluginsListCmd := &ffcli.Command{
+		Name:      "list",
+		Usage:     "list <cluster>",
+		ShortHelp: "print the plugin paths of a cluster and the resolved class path of its brokers",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm plugins list <cluster>")
+			}
+			return runPluginsList(ClusterName(args[0]))
+		},
+	}
+
+	pluginsAddCmd := &ffcli.Command{
+		Name:      "add",
+		Usage:     "add <cluster> <dir|jar>...",
+		ShortHelp: "add plugin paths to a cluster",
+		Exec: func(args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("Usage: kcm plugins add <cluster> <dir|jar>...")
+			}
+			return runPluginsEdit(ClusterName(args[0]), true, args[1:])
+		},
+	}
+
+	pluginsRemoveCmd := &ffcli.Command{
+		Name:      "remove",
+		Usage:     "remove <cluster> <dir|jar>...",
+		ShortHelp: "remove plugin paths from a cluster",
+		Exec: func(args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("Usage: kcm plugins remove <cluster> <dir|jar>...")
+			}
+			return runPluginsEdit(ClusterName(args[0]), false, args[1:])
+		},
+	}
+
+	pluginsCmd := &ffcli.Command{
+		Name:      "plugins",
+		Usage:     "plugins <subcommand> [args...]",
+		ShortHelp: "manage the jars added to the class path of the brokers, like authorizers or metrics reporters",
+		LongHelp: `Manage the jars added to the class path of the brokers, like authorizers or metrics reporters.
+
+A plugin path is a directory, whose jars are all used, or a single jar. The plugin jars come first in
+the class path so they take precedence over the jars of the distribution.
+
+The directories are read every time a broker starts: jars added to them or rebuilt are used by the
+next start. list prints the brokers started with another class path.`,
+		Subcommands: []*ffcli.Command{
+			pluginsListCmd, pluginsAddCmd, pluginsRemoveCmd,
+		},
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	logLevelGetCmd := &ffcli.Command{
+		Name:      "get",
+		Usage:     "get <cluster> [broker] [logger]",
+		ShortHelp: "print the level of a logger, or the persistent levels",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm loglevel get <cluster> [broker] [logger]")
+			}
+
+			brokerID, rest := splitBrokerArg(args[1:])
+			if len(rest) > 1 {
+				return fmt.Errorf("Usage: kcm loglevel get <cluster> [broker] [logger]")
+			}
+
+			var logger string
+			if len(rest) > 0 {
+				logger = rest[0]
+			}
+
+			return runLogLevelGet(ClusterName(args[0]), brokerID, logger)
+		},
+	}
+
+	logLevelSetCmd := &ffcli.Command{
+		Name:      "set",
+		Usage:     "set [-stop-timeout duration] [-start-timeout duration] <cluster> [broker] <logger> <level>",
+		FlagSet:   logLevelSetFlags,
+		ShortHelp: "change the level of a logger and keep it when the brokers restart",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm loglevel set <cluster> [broker] <logger> <level>")
+			}
+
+			brokerID, rest := splitBrokerArg(args[1:])
+			if len(rest) != 2 {
+				return fmt.Errorf("Usage: kcm loglevel set <cluster> [broker] <logger> <level>")
+			}
+
+			return runLogLevelSet(ClusterName(args[0]), brokerID, rest[0], rest[1])
+		},
+	}
+
+	logLevelCmd := &ffcli.Command{
+		Name:      "loglevel",
+		Usage:     "loglevel <get|set> <cluster> [broker] <logger> [level]",
+		ShortHelp: "print or change the level of the loggers of the brokers",
+		LongHelp: `Print or change the level of the loggers of the brokers, like kafka.request.logger or kafka.controller.
+
+Without a broker id the level applies to all brokers of the cluster, a broker level takes precedence over
+the cluster level. The level is one of ` + strings.Join(logLevels, ", ") + `, use "` + defaultLogLevel + `" to remove it
+so that the logger uses the level of its parent again. The root logger is named ` + rootLogger + `.
+
+The levels are persistent: they're written to the logging config of the brokers every time they start.
+
+Since Kafka 2.4 the started brokers change their levels right away with the broker-loggers API of
+kafka-configs. Before Kafka 2.4 the started brokers are restarted one at a time instead, each one
+accepting connections before the next one is restarted.
+
+get prints the level of a logger in the started brokers along with its persistent level. Without a
+logger it prints the persistent levels.`,
+		Subcommands: []*ffcli.Command{
+			logLevelGetCmd, logLevelSetCmd,
+		},
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	javaCmd := &ffcli.Command{
+		Name:      "java",
+		Usage:     "java",
+		ShortHelp: "list the Java runtimes found and the clusters using them",
+		LongHelp: `List the Java runtimes found and the clusters using them.
+
+The runtimes are searched in JAVA_HOME, the java command, the usual installation directories
+like /usr/lib/jvm and the directories of sdkman and asdf.
+
+Each cluster uses the newest runtime supported by its Kafka version, chosen when it's created
+or when it's started if none was found then. Use create -java to choose another one, or the
+global -java-home flag to override it for one command.`,
+		Exec: func([]string) error {
+			return runJava()
+		},
+	}
+
+	fetchCmd := &ffcli.Command{
+		Name:      "fetch",
+		Usage:     "fetch [-zk] [-distribution name] [-scala version] <version...>",
+		FlagSet:   fetchFlags,
+		ShortHelp: "download and extract Kafka or Zookeeper versions ahead of time",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm fetch [-zk] <version...>")
+			}
+			return runFetch(args)
+		},
+	}
+
+	pruneCmd := &ffcli.Command{
+		Name:      "prune",
+		Usage:     "prune [-dry-run]",
+		FlagSet:   pruneFlags,
+		ShortHelp: "remove the Kafka and Zookeeper versions not used by any cluster or Zookeeper",
+		LongHelp: `Remove the Kafka and Zookeeper versions not used by any cluster or Zookeeper.
+
+Both the archive in the cache and the extracted distribution are removed. They are downloaded again
+if a cluster uses the version later.`,
+		Exec: func([]string) error {
+			return runPrune()
+		},
+	}
+
+	artifactsImportCmd := &ffcli.Command{
+		Name:      "import",
+		Usage:     "import <file|dir|bundle>...",
+		ShortHelp: "add Kafka or Zookeeper archives copied by hand to the cache",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm artifacts import <file|dir|bundle>...")
+			}
+			return runArtifactsImport(args)
+		},
+	}
+
+	artifactsExportCmd := &ffcli.Command{
+		Name:      "export",
+		Usage:     "export <file> [version...]",
+		ShortHelp: "write the Kafka and Zookeeper archives in the cache to a bundle",
+		Exec: func(args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("Usage: kcm artifacts export <file> [version...]")
+			}
+			return runArtifactsExport(args[0], args[1:])
+		},
+	}
+
+	artifactsCmd := &ffcli.Command{
+		Name:      "artifacts",
+		Usage:     "artifacts <subcommand> [args...]",
+		ShortHelp: "manage the Kafka and Zookeeper archives in the cache",
+		LongHelp: `Manage the Kafka and Zookeeper archives in the cache.
+
+The archives are downloaded from the Apache servers the first time a version is used. On a machine
+without internet access they can be copied by hand and imported:
+
+	$ kcm artifacts import ~/Downloads/kafka_2.12-2.6.0.tgz ~/Downloads/apache-zookeeper-3.6.2-bin.tar.gz
+
+A directory is imported entirely, including the cache directory of another machine. If an archive has
+a .sha512 file next to it, it is verified first.
+
+The whole cache, or only some versions, can also be exported to a single bundle on a machine with
+internet access and imported on another one:
+
+	$ kcm artifacts export kcm-artifacts.tar 2.6.0 3.6.2
+	$ kcm artifacts import kcm-artifacts.tar
+
+Use -offline to make sure kcm never tries to download anything.`,
+		Subcommands: []*ffcli.Command{
+			artifactsImportCmd, artifactsExportCmd,
+		},
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	versionCmd := &ffcli.Command{
+		Name:      "version",
+		Usage:     "version",
+		ShortHelp: "print the version information (necessary to report bugs)",
+		Exec: func([]string) error {
+			log.Printf("kcm version %s, commit %s", gVersion, gCommit)
+			return nil
+		},
+	}
+
+	rootCmd := &ffcli.Command{
+		Usage:     "kcm <subcommand> [flag] [args...]",
+		FlagSet:   globalFlags,
+		Options:   makeGlobalFlagsOptions(),
+		ShortHelp: "manage Kafka clusters for local development and testing",
+		Subcommands: []*ffcli.Command{
+			createCmd, removeCmd, listCmd, statusCmd,
+			startCmd, stopCmd, logsCmd,
+			runScriptCmd,
+			zkCmd,
+			psCmd,
+			dbCmd,
+			versionsCmd, fetchCmd, pruneCmd,
+			artifactsCmd,
+			javaCmd, jvmCmd, pluginsCmd, logLevelCmd,
+			versionCmd,
+		},
+		Exec: func([]string) error {
+			return flag.ErrHelp
+		},
+	}
+
+	for _, cmd := range rootCmd.Subcommands {
+		if cmd != dbCmd && cmd != fetchCmd && cmd != artifactsCmd && cmd != versionCmd {
+			requireDatabase(cmd)
+		}
 	}
 
 	if err := rootCmd.Run(os.Args[1:]); err != nil {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// normalizePluginPath returns the absolute path of a plugin path, which must be a directory or a jar.
+func normalizePluginPath(path string) (string, error) {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	fi, err := os.Stat(p)
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("plugin path %q doesn't exist", p)
+	case !fi.IsDir() && !strings.HasSuffix(p, ".jar"):
+		return "", fmt.Errorf("plugin path %q must be a directory or a jar", p)
+	}
+
+	return p, nil
+}
+
+// makeClusterClasspath returns the class path of the brokers of a cluster: the jars of its plugin paths first,
+// so that they take precedence, then the jars of its distribution.
+//
+// NOTE(vincent): the plugin paths are walked every time a broker starts, so jars added or removed in a directory
+// are picked up by the next start.
+func makeClusterClasspath(cluster Cluster) (string, error) {
+	for _, p := range cluster.PluginPaths {
+		if _, err := os.Stat(p); err != nil {
+			return "", fmt.Errorf("plugin path %q of cluster %q doesn't exist anymore", p, cluster.Name)
+		}
+	}
+
+	extractedPath := makeClusterKafkaPath(cluster)
+
+	dirs := append([]string(nil), cluster.PluginPaths...)
+	for _, root := range clusterDistribution(cluster).ClasspathRoots {
+		dirs = append(dirs, filepath.Join(extractedPath, root))
+	}
+
+	return constructClasspath(dirs...)
+}
+
+// findPluginJars returns the jars found in the plugin paths of a cluster.
+func findPluginJars(cluster Cluster) ([]string, error) {
+	if len(cluster.PluginPaths) == 0 {
+		return nil, nil
+	}
+
+	cp, err := constructClasspath(cluster.PluginPaths...)
+	if err != nil {
+		return nil, err
+	}
+	if cp == "" {
+		return nil, nil
+	}
+
+	return strings.Split(cp, ":"), nil
+}
+
+// processClasspath returns the class path in the command line of a broker, or an empty string if there's none.
+func processClasspath(cmdline string) string {
+	fields := strings.Fields(cmdline)
+	for i, field := range fields {
+		if field == "-cp" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
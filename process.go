@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processIdentity identifies a process launched by kcm.
+//
+// A PID alone is not enough: after a reboot or a PID wraparound it can be used by an unrelated process.
+// The start time and command line of a process never change, and the marker is a system property
+// we add to the command line of every process we launch.
+type processIdentity struct {
+	pid       int
+	startTime int64 // in clock ticks after the system boot
+	cmdline   string
+	marker    string
+}
+
+type processState int
+
+const (
+	processNotRunning processState = iota
+	processRunning
+	// processMismatch means the PID is used by a process which is not the one we launched.
+	processMismatch
+)
+
+// makeProcessMarker returns the system property identifying a process launched by kcm.
+func makeProcessMarker(parts ...string) string {
+	return "-Dkcm.process=" + strings.Join(parts, "/")
+}
+
+func makeBrokerProcessMarker(cluster Cluster, broker Broker) string {
+	return makeProcessMarker("broker", string(cluster.Name), strconv.Itoa(broker.ID))
+}
+
+func makeZookeeperProcessMarker(zookeeper Zookeeper, node ZookeeperNode) string {
+	return makeProcessMarker("zookeeper", zookeeper.Name, strconv.Itoa(node.ID))
+}
+
+// readProcessIdentity reads the start time and command line of a process from /proc.
+func readProcessIdentity(pid int) (processIdentity, error) {
+	res := processIdentity{pid: pid}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return res, err
+	}
+
+	// The command name is in parenthesis and can contain spaces, the other fields follow it.
+	// The start time is the 22nd field, 20th after the command name.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return res, fmt.Errorf("invalid stat file for process %d", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return res, fmt.Errorf("invalid stat file for process %d", pid)
+	}
+
+	res.startTime, err = strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return res, fmt.Errorf("invalid start time for process %d. err: %w", pid, err)
+	}
+
+	args, err := readProcessArgs(pid)
+	if err != nil {
+		return res, err
+	}
+	res.cmdline = strings.Join(args, " ")
+
+	return res, nil
+}
+
+// readProcessArgs reads the arguments of a process from /proc, the first one being the executable.
+func readProcessArgs(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// Each argument is terminated by a NUL byte.
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// State returns the state of the process with this identity.
+func (p processIdentity) State() processState {
+	if p.pid <= 0 || !pidExists(p.pid) {
+		return processNotRunning
+	}
+
+	current, err := readProcessIdentity(p.pid)
+	if err != nil {
+		// The process exited since the check above.
+		return processNotRunning
+	}
+
+	// NOTE(vincent): processes launched by older versions of kcm don't have an identity, we can only trust their PID.
+
+	switch {
+	case p.startTime != 0 && p.startTime != current.startTime:
+		return processMismatch
+	case p.cmdline != "" && p.cmdline != current.cmdline:
+		return processMismatch
+	case p.marker != "" && !hasField(current.cmdline, p.marker):
+		return processMismatch
+	}
+
+	return processRunning
+}
+
+func hasField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kcmProcess is a JVM launched by kcm, found by scanning /proc.
+//
+// It is identified by the configuration file it runs with, which is always in dataDir,
+// so it can be found even if the database doesn't know about it.
+type kcmProcess struct {
+	process processIdentity
+
+	// Only set for a broker
+	clusterName ClusterName
+	brokerID    int
+
+	// Only set for a Zookeeper node
+	zookeeperName string
+	nodeID        int
+}
+
+func (p kcmProcess) IsBroker() bool {
+	return p.clusterName != ""
+}
+
+func (p kcmProcess) String() string {
+	if p.IsBroker() {
+		return fmt.Sprintf("broker %d of cluster %q", p.brokerID, p.clusterName)
+	}
+	return fmt.Sprintf("zookeeper %q node %d", p.zookeeperName, p.nodeID)
+}
+
+// Marker returns the process marker the process was launched with, if any.
+//
+// Processes launched by older versions of kcm don't have one.
+func (p kcmProcess) Marker() string {
+	var marker string
+	if p.IsBroker() {
+		marker = makeBrokerProcessMarker(Cluster{Name: p.clusterName}, Broker{ID: p.brokerID})
+	} else {
+		marker = makeZookeeperProcessMarker(Zookeeper{Name: p.zookeeperName}, ZookeeperNode{ID: p.nodeID})
+	}
+
+	if !hasField(p.process.cmdline, marker) {
+		return ""
+	}
+	return marker
+}
+
+var (
+	brokerConfigPattern    = regexp.MustCompile(`^([^/]+)/broker(\d+)/server\.properties$`)
+	zookeeperConfigPattern = regexp.MustCompile(`^zookeeper/([^/]+)/node(\d+)/zoo\.cfg$`)
+
+	// Used by the versions of kcm which only had a single Zookeeper node.
+	legacyZookeeperConfigPattern = regexp.MustCompile(`^zookeeper_[^/]+/conf/zoo\.cfg$`)
+)
+
+// parseKcmProcess returns the broker or Zookeeper node a JVM runs, based on its configuration file.
+// It returns false if the process wasn't launched by kcm.
+func parseKcmProcess(args []string) (kcmProcess, bool) {
+	var res kcmProcess
+
+	if len(args) == 0 || filepath.Base(args[0]) != "java" {
+		return res, false
+	}
+
+	for _, arg := range args[1:] {
+		if !filepath.IsAbs(arg) {
+			continue
+		}
+		rel, err := filepath.Rel(dataDir, arg)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		if m := brokerConfigPattern.FindStringSubmatch(rel); m != nil {
+			res.clusterName = ClusterName(m[1])
+			res.brokerID, _ = strconv.Atoi(m[2])
+			return res, true
+		}
+		if m := zookeeperConfigPattern.FindStringSubmatch(rel); m != nil {
+			res.zookeeperName = m[1]
+			res.nodeID, _ = strconv.Atoi(m[2])
+			return res, true
+		}
+		if legacyZookeeperConfigPattern.MatchString(rel) {
+			res.zookeeperName = sharedZookeeperName
+			res.nodeID = 1
+			return res, true
+		}
+	}
+
+	return res, false
+}
+
+// findKcmProcesses scans /proc for the brokers and Zookeeper nodes launched by kcm.
+func findKcmProcesses() ([]kcmProcess, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list processes. err: %w", err)
+	}
+
+	var res []kcmProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		// NOTE(vincent): processes can exit at any time while we scan, errors only mean we can skip them.
+
+		args, err := readProcessArgs(pid)
+		if err != nil {
+			continue
+		}
+
+		p, ok := parseKcmProcess(args)
+		if !ok {
+			continue
+		}
+
+		p.process, err = readProcessIdentity(pid)
+		if err != nil {
+			continue
+		}
+		p.process.marker = p.Marker()
+
+		res = append(res, p)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].process.pid < res[j].process.pid
+	})
+
+	return res, nil
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// readConfigFile reads a properties file written by kcm, either for a broker or a Zookeeper node.
+//
+// The kcm.* comments are returned like any other property.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "# kcm."):
+			line = strings.TrimPrefix(line, "# ")
+		case line == "" || line[0] == '#' || line[0] == '!':
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+
+		res[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+
+	return res, nil
+}
+
+// readJVMSettingsFromConfig reads the JVM settings written in a config file with the prefix, like kcm.jvm.
+// The options and environment variables are numbered like kcm.jvm.option.0 to keep their order.
+func readJVMSettingsFromConfig(config map[string]string, prefix string) JVMSettings {
+	res := JVMSettings{
+		Heap: config[prefix+"heap"],
+	}
+
+	for i := 0; ; i++ {
+		v, ok := config[fmt.Sprintf("%soption.%d", prefix, i)]
+		if !ok {
+			break
+		}
+		res.Options = append(res.Options, v)
+	}
+	for i := 0; ; i++ {
+		v, ok := config[fmt.Sprintf("%senv.%d", prefix, i)]
+		if !ok {
+			break
+		}
+		res.Env = append(res.Env, v)
+	}
+
+	return res
+}
+
+// readLogLevelsFromConfig reads the persistent log levels written in a config file with the prefix, like kcm.log.level.
+func readLogLevelsFromConfig(config map[string]string, prefix string) map[string]string {
+	var res map[string]string
+	for key, level := range config {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]string)
+		}
+		res[strings.TrimPrefix(key, prefix)] = level
+	}
+	return res
+}
+
+// versionFromPath returns the version of the extracted archive containing path,
+// for example 2.13-2.6.0 for ~/.kcm/kafka_2.13-2.6.0/libs/kafka.jar with the prefix kafka_.
+func versionFromPath(prefix, path string) string {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+
+	dir := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	if !strings.HasPrefix(dir, prefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(dir, prefix)
+}
+
+// findVersion returns the version of Kafka or Zookeeper used by a broker or a node. In order it tries:
+//   - the path written in its config file
+//   - the class path of its process, if it's running
+//   - the only archive extracted, if there's only one
+func findVersion(prefix, configPath string, process *kcmProcess) string {
+	if version := versionFromPath(prefix, configPath); version != "" {
+		return version
+	}
+
+	if process != nil {
+		for _, field := range strings.Fields(process.process.cmdline) {
+			for _, path := range strings.Split(field, ":") {
+				if version := versionFromPath(prefix, path); version != "" {
+					return version
+				}
+			}
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dataDir, prefix+"*"))
+
+	var versions []string
+	for _, match := range matches {
+		if fi, err := os.Stat(match); err == nil && fi.IsDir() {
+			versions = append(versions, versionFromPath(prefix, match))
+		}
+	}
+	if len(versions) == 1 {
+		return versions[0]
+	}
+
+	return ""
+}
+
+// diskCluster is a cluster read from the config files of its brokers.
+type diskCluster struct {
+	cluster Cluster
+
+	// The Zookeeper connect string of the brokers, without the cluster prefix.
+	zookeeperConnect string
+}
+
+var (
+	brokerDirPattern = regexp.MustCompile(`^broker(\d+)$`)
+	nodeDirPattern   = regexp.MustCompile(`^node(\d+)$`)
+)
+
+// readClustersFromDisk reads the clusters from the config files of their brokers in dataDir.
+//
+// A broker only has a config file once it's been started, a cluster which was never started can't be found.
+func readClustersFromDisk(processes []kcmProcess) ([]diskCluster, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "*", "broker*", "server.properties"))
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make(map[ClusterName]*diskCluster)
+
+	for _, match := range matches {
+		brokerDir := filepath.Dir(match)
+		name := ClusterName(filepath.Base(filepath.Dir(brokerDir)))
+
+		m := brokerDirPattern.FindStringSubmatch(filepath.Base(brokerDir))
+		if m == nil {
+			continue
+		}
+
+		config, err := readConfigFile(match)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config file %q. err: %w", match, err)
+		}
+
+		// 1. the broker
+
+		var broker Broker
+
+		broker.ID, err = strconv.Atoi(config["broker.id"])
+		if err != nil {
+			broker.ID, _ = strconv.Atoi(m[1])
+		}
+
+		listener := config["listeners"]
+		if i := strings.Index(listener, "://"); i >= 0 {
+			listener = listener[i+3:]
+		}
+		addr, err := net.ResolveTCPAddr("tcp", listener)
+		if err != nil {
+			log.Printf("invalid listener %q in %q, skipping broker %d of cluster %q", config["listeners"], match, broker.ID, name)
+			continue
+		}
+		broker.Addr = *addr
+		broker.JVM = readJVMSettingsFromConfig(config, "kcm.broker.jvm.")
+		broker.JMXPort, _ = strconv.Atoi(config["kcm.broker.jmx.port"])
+		broker.LogLevels = readLogLevelsFromConfig(config, "kcm.broker.log.level.")
+
+		// 2. the cluster, the first broker found defines it
+
+		dc, ok := clusters[name]
+		if !ok {
+			dc = &diskCluster{
+				cluster: Cluster{Name: name},
+			}
+			if i := strings.IndexByte(config["zookeeper.connect"], '/'); i >= 0 {
+				dc.zookeeperConnect = config["zookeeper.connect"][:i]
+			}
+
+			clusters[name] = dc
+		}
+
+		if dc.cluster.Version == "" {
+			var process *kcmProcess
+			for i, p := range processes {
+				if p.clusterName == name && p.brokerID == broker.ID {
+					process = &processes[i]
+				}
+			}
+
+			dc.cluster.Distribution = defaultDistribution
+			if dist := config["kcm.kafka.distribution"]; dist != "" {
+				dc.cluster.Distribution = dist
+			}
+
+			dc.cluster.JavaHome = config["kcm.java.home"]
+			dc.cluster.JVM = readJVMSettingsFromConfig(config, "kcm.jvm.")
+			for i := 0; ; i++ {
+				p, ok := config[fmt.Sprintf("kcm.plugin.path.%d", i)]
+				if !ok {
+					break
+				}
+				dc.cluster.PluginPaths = append(dc.cluster.PluginPaths, p)
+			}
+			dc.cluster.Logs.MaxFileSize = config["kcm.log.max.file.size"]
+			dc.cluster.Logs.MaxFiles, _ = strconv.Atoi(config["kcm.log.max.files"])
+			dc.cluster.Logs.Separate = config["kcm.log.separate"] == "true"
+			dc.cluster.LogLevels = readLogLevelsFromConfig(config, "kcm.log.level.")
+
+			if customName := config["kcm.custom.name"]; customName != "" {
+				dc.cluster.Custom = &CustomDistribution{
+					Name:     customName,
+					Source:   customSource(config["kcm.custom.source"]),
+					Location: config["kcm.custom.location"],
+				}
+			}
+
+			switch {
+			case config["kcm.kafka.version"] != "":
+				// The version of a custom distribution or of another distribution than Apache Kafka is written in the config file.
+				dc.cluster.Version = KafkaVersion(config["kcm.kafka.version"])
+				dc.cluster.ScalaVersion = config["kcm.kafka.scala"]
+
+			default:
+				if dist := findVersion("kafka_", config["kcm.kafka.path"], process); dist != "" {
+					dc.cluster.Version, dc.cluster.ScalaVersion = parseKafkaDistName("kafka_" + dist)
+				}
+			}
+		}
+
+		dc.cluster.Brokers = append(dc.cluster.Brokers, broker)
+	}
+
+	res := make([]diskCluster, 0, len(clusters))
+	for _, dc := range clusters {
+		sort.Slice(dc.cluster.Brokers, func(i, j int) bool {
+			return dc.cluster.Brokers[i].ID < dc.cluster.Brokers[j].ID
+		})
+		res = append(res, *dc)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].cluster.Name < res[j].cluster.Name
+	})
+
+	return res, nil
+}
+
+// readZookeepersFromDisk reads the Zookeeper nodes and ensembles from the config files of their nodes in dataDir.
+func readZookeepersFromDisk(processes []kcmProcess) ([]Zookeeper, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "zookeeper", "*", "node*", "zoo.cfg"))
+	if err != nil {
+		return nil, err
+	}
+
+	zookeepers := make(map[string]*Zookeeper)
+
+	for _, match := range matches {
+		nodeDir := filepath.Dir(match)
+		name := filepath.Base(filepath.Dir(nodeDir))
+
+		m := nodeDirPattern.FindStringSubmatch(filepath.Base(nodeDir))
+		if m == nil {
+			continue
+		}
+
+		config, err := readConfigFile(match)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config file %q. err: %w", match, err)
+		}
+
+		// 1. the node
+
+		var node ZookeeperNode
+		node.ID, _ = strconv.Atoi(m[1])
+		node.DataDir = config["dataDir"]
+
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(config["clientPortAddress"], config["clientPort"]))
+		if err != nil {
+			log.Printf("invalid client address in %q, skipping zookeeper %q node %d", match, name, node.ID)
+			continue
+		}
+		node.Addr = *addr
+
+		if server := strings.Split(config[fmt.Sprintf("server.%d", node.ID)], ":"); len(server) >= 3 {
+			node.PeerPort, _ = strconv.Atoi(server[1])
+			node.ElectionPort, _ = strconv.Atoi(server[2])
+		}
+		if config["admin.enableServer"] == "true" {
+			node.AdminPort, _ = strconv.Atoi(config["admin.serverPort"])
+		}
+
+		// 2. the Zookeeper node or ensemble, the first node found defines it
+
+		zookeeper, ok := zookeepers[name]
+		if !ok {
+			zookeeper = &Zookeeper{
+				Name:            name,
+				Kind:            ZookeeperKind(config["kcm.zookeeper.kind"]),
+				FourLetterWords: config["4lw.commands.whitelist"],
+			}
+			zookeepers[name] = zookeeper
+		}
+
+		if zookeeper.Version == "" {
+			var process *kcmProcess
+			for i, p := range processes {
+				if p.zookeeperName == name && p.nodeID == node.ID {
+					process = &processes[i]
+				}
+			}
+
+			zookeeper.Version = findVersion("zookeeper_", config["kcm.zookeeper.path"], process)
+		}
+
+		zookeeper.Nodes = append(zookeeper.Nodes, node)
+	}
+
+	res := make([]Zookeeper, 0, len(zookeepers))
+	for _, zookeeper := range zookeepers {
+		sort.Slice(zookeeper.Nodes, func(i, j int) bool {
+			return zookeeper.Nodes[i].ID < zookeeper.Nodes[j].ID
+		})
+
+		// The config files written by older versions of kcm don't have the kind,
+		// ensembles are the only ones created with more than one node.
+		if zookeeper.Kind == "" {
+			switch {
+			case zookeeper.Name == sharedZookeeperName:
+				zookeeper.Kind = zookeeperShared
+			case zookeeper.IsEnsemble():
+				zookeeper.Kind = zookeeperEnsemble
+			default:
+				zookeeper.Kind = zookeeperDedicated
+			}
+		}
+		res = append(res, *zookeeper)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// repairDatabase adds the clusters, brokers and Zookeeper nodes found on disk which are missing from the database.
+//
+// Nothing already in the database is changed.
+func repairDatabase(conn *sqlite.Conn) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	processes, err := findKcmProcesses()
+	if err != nil {
+		return err
+	}
+
+	// 1. restore the Zookeeper nodes first, the clusters need them
+
+	diskZookeepers, err := readZookeepersFromDisk(processes)
+	if err != nil {
+		return err
+	}
+
+	for _, zookeeper := range diskZookeepers {
+		existing, err := getZookeeperConn(conn, zookeeper.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+
+		if zookeeper.Version == "" {
+			log.Printf("unable to find the version of zookeeper %q, using %s", zookeeper.Name, defaultZookeeperVersion)
+			zookeeper.Version = defaultZookeeperVersion
+		}
+
+		if _, err := insertZookeeper(conn, zookeeper); err != nil {
+			return fmt.Errorf("unable to restore zookeeper %q. err: %w", zookeeper.Name, err)
+		}
+
+		log.Printf("restored zookeeper %s", zookeeper)
+	}
+
+	zookeepers, err := listZookeepersConn(conn)
+	if err != nil {
+		return err
+	}
+
+	// 2. restore the clusters and their brokers
+
+	diskClusters, err := readClustersFromDisk(processes)
+	if err != nil {
+		return err
+	}
+
+	for _, dc := range diskClusters {
+		// NOTE(vincent): a cluster can exist without any broker so we can't use getCluster here.
+
+		var clusterID int64
+		err := sqlitex.Exec(conn, `SELECT id FROM cluster WHERE name = ?`, func(stmt *sqlite.Stmt) error {
+			clusterID = stmt.ColumnInt64(0)
+			return nil
+		}, string(dc.cluster.Name))
+		if err != nil {
+			return err
+		}
+
+		if clusterID > 0 {
+			if err := repairBrokers(conn, clusterID, dc.cluster); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if dc.cluster.Version == "" {
+			log.Printf("unable to find the Kafka version of cluster %q, skipping it", dc.cluster.Name)
+			continue
+		}
+
+		// The cluster uses the Zookeeper its brokers connect to, or the shared one if it's unknown.
+
+		var found bool
+		for _, zookeeper := range zookeepers {
+			if zookeeper.ConnectString() == dc.zookeeperConnect {
+				dc.cluster.Zookeeper = zookeeper
+				found = true
+				break
+			}
+		}
+		if !found {
+			// NOTE(vincent): the shared node is only registered when a cluster needs it.
+			if err := ensureSharedZookeeper(conn, defaultZookeeperVersion); err != nil {
+				return err
+			}
+			shared, err := getZookeeperConn(conn, sharedZookeeperName)
+			if err != nil {
+				return err
+			}
+			dc.cluster.Zookeeper = *shared
+
+			log.Printf("cluster %q used the unknown zookeeper %q, using the shared one instead", dc.cluster.Name, dc.zookeeperConnect)
+		}
+
+		if _, err := insertCluster(conn, dc.cluster); err != nil {
+			return fmt.Errorf("unable to restore cluster %q. err: %w", dc.cluster.Name, err)
+		}
+
+		log.Printf("restored cluster %q (%s version %s, Scala %s)", dc.cluster.Name, dc.cluster.Distribution, dc.cluster.Version, dc.cluster.ScalaVersion)
+	}
+
+	return nil
+}
+
+// repairBrokers adds the brokers of a cluster found on disk which are missing from the existing cluster.
+func repairBrokers(conn *sqlite.Conn, clusterID int64, cluster Cluster) error {
+	existing := make(map[int]bool)
+
+	err := sqlitex.Exec(conn, `SELECT id FROM broker WHERE cluster_id = ?`, func(stmt *sqlite.Stmt) error {
+		existing[int(stmt.ColumnInt64(0))] = true
+		return nil
+	}, clusterID)
+	if err != nil {
+		return err
+	}
+
+	for _, broker := range cluster.Brokers {
+		if existing[broker.ID] {
+			continue
+		}
+
+		if err := insertBroker(conn, clusterID, broker); err != nil {
+			return fmt.Errorf("unable to restore broker %d of cluster %q. err: %w", broker.ID, cluster.Name, err)
+		}
+
+		log.Printf("restored broker %d of cluster %q", broker.ID, cluster.Name)
+	}
+
+	return nil
+}
@@ -32,21 +32,22 @@ func (r kafkaScriptRequirement) FlagName() string {
 	return r.connect.DefaultFlagName()
 }
 
+// kafkaScriptsRequirements contains the scripts by name, without their extension which depends on the distribution.
 var kafkaScriptsRequirements = map[string]kafkaScriptRequirement{
-	"kafka-acls.sh":                       {kafkaScriptKafka, ""},
-	"kafka-broker-api-versions.sh":        {kafkaScriptKafka, ""},
-	"kafka-configs.sh":                    {kafkaScriptKafka, ""},
-	"kafka-console-consumer.sh":           {kafkaScriptKafka, ""},
-	"kafka-console-producer.sh":           {kafkaScriptKafka, "--broker-list"},
-	"kafka-consumer-groups.sh":            {kafkaScriptKafka, ""},
-	"kafka-consumer-perf-test.sh":         {kafkaScriptKafka, "--broker-list"},
-	"kafka-delegation-tokens.sh":          {kafkaScriptKafka, ""},
-	"kafka-delete-records.sh":             {kafkaScriptKafka, ""},
-	"kafka-preferred-replica-election.sh": {kafkaScriptZookeeper, ""},
-	"kafka-reassign-partitions.sh":        {kafkaScriptKafka, ""},
-	"kafka-replica-verification.sh":       {kafkaScriptKafka, "--broker-list"},
-	"kafka-streams-application-reset.sh":  {kafkaScriptKafka, "--bootstrap-servers"},
-	"kafka-topics.sh":                     {kafkaScriptZookeeper, ""},
-	"kafka-verifiable-consumer.sh":        {kafkaScriptKafka, "--broker-list"},
-	"kafka-verifiable-producer.sh":        {kafkaScriptKafka, "--broker-list"},
+	"kafka-acls":                       {kafkaScriptKafka, ""},
+	"kafka-broker-api-versions":        {kafkaScriptKafka, ""},
+	"kafka-configs":                    {kafkaScriptKafka, ""},
+	"kafka-console-consumer":           {kafkaScriptKafka, ""},
+	"kafka-console-producer":           {kafkaScriptKafka, "--broker-list"},
+	"kafka-consumer-groups":            {kafkaScriptKafka, ""},
+	"kafka-consumer-perf-test":         {kafkaScriptKafka, "--broker-list"},
+	"kafka-delegation-tokens":          {kafkaScriptKafka, ""},
+	"kafka-delete-records":             {kafkaScriptKafka, ""},
+	"kafka-preferred-replica-election": {kafkaScriptZookeeper, ""},
+	"kafka-reassign-partitions":        {kafkaScriptKafka, ""},
+	"kafka-replica-verification":       {kafkaScriptKafka, "--broker-list"},
+	"kafka-streams-application-reset":  {kafkaScriptKafka, "--bootstrap-servers"},
+	"kafka-topics":                     {kafkaScriptZookeeper, ""},
+	"kafka-verifiable-consumer":        {kafkaScriptKafka, "--broker-list"},
+	"kafka-verifiable-producer":        {kafkaScriptKafka, "--broker-list"},
 }
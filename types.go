@@ -14,14 +14,37 @@ type KafkaVersion string
 type Broker struct {
 	ID   int
 	Addr net.TCPAddr
+	// JVM are the settings of this broker only, on top of the ones of the cluster.
+	JVM JVMSettings
+	// JMXPort is the port of the JMX agent, 0 if JMX is disabled.
+	JMXPort int
+	// LogLevels are the persistent levels of the loggers of the broker, by logger name.
+	LogLevels map[string]string
 }
 
 type Cluster struct {
 	ID      int
 	Name    ClusterName
 	Version KafkaVersion
+	// ScalaVersion is the Scala version of the Kafka build.
+	ScalaVersion string
+	// Distribution is the name of the distribution of Kafka, like apache.
+	Distribution string
+	// JavaHome is the Java runtime used to run the brokers, it's empty until one is selected.
+	JavaHome string
+	// Custom is the custom distribution of Kafka used instead of an Apache release, if any.
+	Custom *CustomDistribution
+	// JVM are the settings of the JVM of all brokers.
+	JVM JVMSettings
+	// PluginPaths are the directories and jars added to the class path of the brokers, before the distribution jars.
+	PluginPaths []string
+	// Logs are the settings of the log files of the brokers.
+	Logs LogSettings
+	// LogLevels are the persistent levels of the loggers of all brokers, by logger name.
+	LogLevels map[string]string
 
-	Brokers []Broker
+	Zookeeper Zookeeper
+	Brokers   []Broker
 }
 
 func (c Cluster) String() string {
@@ -32,8 +55,40 @@ func (c Cluster) String() string {
 	w := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', tabwriter.AlignRight)
 
 	fmt.Fprintf(w, "Version\t%s\t\n", c.Version)
+	fmt.Fprintf(w, "Scala version\t%s\t\n", c.ScalaVersion)
+	if c.Distribution != defaultDistribution {
+		fmt.Fprintf(w, "Distribution\t%s\t\n", c.Distribution)
+	}
+	if c.JavaHome != "" {
+		fmt.Fprintf(w, "Java\t%s\t\n", c.JavaHome)
+	}
+	if c.Custom != nil {
+		fmt.Fprintf(w, "Custom distribution\t%s\t\n", c.Custom.String())
+	}
+	if !c.JVM.IsEmpty() {
+		fmt.Fprintf(w, "JVM\t%s\t\n", c.JVM.String())
+	}
+	for _, p := range c.PluginPaths {
+		fmt.Fprintf(w, "Plugin path\t%s\t\n", p)
+	}
+	if !c.Logs.IsEmpty() {
+		fmt.Fprintf(w, "Logs\t%s\t\n", c.Logs.String())
+	}
+	for _, logger := range sortedLoggers(c.LogLevels) {
+		fmt.Fprintf(w, "Log level\t%s=%s\t\n", logger, c.LogLevels[logger])
+	}
+	fmt.Fprintf(w, "Zookeeper\t%s\t\n", c.Zookeeper.String())
 	for _, broker := range c.Brokers {
 		fmt.Fprintf(w, "Broker %d address\t%s\t\n", broker.ID, broker.Addr.String())
+		if broker.JMXPort > 0 {
+			fmt.Fprintf(w, "Broker %d JMX port\t%d\t\n", broker.ID, broker.JMXPort)
+		}
+		if !broker.JVM.IsEmpty() {
+			fmt.Fprintf(w, "Broker %d JVM\t%s\t\n", broker.ID, broker.JVM.String())
+		}
+		for _, logger := range sortedLoggers(broker.LogLevels) {
+			fmt.Fprintf(w, "Broker %d log level\t%s=%s\t\n", broker.ID, logger, broker.LogLevels[logger])
+		}
 	}
 
 	w.Flush()
@@ -41,6 +96,80 @@ func (c Cluster) String() string {
 	return builder.String()
 }
 
+// sharedZookeeperName is the name of the Zookeeper node shared by all clusters
+// which don't have a dedicated one.
+const sharedZookeeperName = "shared"
+
+type ZookeeperNode struct {
+	ID      int
+	Addr    net.TCPAddr
+	DataDir string
+
+	// Only used by members of an ensemble
+	PeerPort     int
+	ElectionPort int
+
+	// AdminPort is the port of the AdminServer of the node, 0 disables it.
+	AdminPort int
+}
+
+// ZookeeperKind is how a Zookeeper was created, which decides the clusters allowed to use it.
+type ZookeeperKind string
+
+const (
+	// zookeeperShared is the node used by every cluster created with -zk shared.
+	zookeeperShared ZookeeperKind = "shared"
+	// zookeeperDedicated is a node created with -zk dedicated, named after its cluster and only used by it.
+	zookeeperDedicated ZookeeperKind = "dedicated"
+	// zookeeperEnsemble is created with kcm zk create-ensemble and can be used by any cluster.
+	zookeeperEnsemble ZookeeperKind = "ensemble"
+)
+
+// Zookeeper is either a standalone Zookeeper node or an ensemble of nodes.
+type Zookeeper struct {
+	ID      int
+	Name    string
+	Kind    ZookeeperKind
+	Version string
+
+	// FourLetterWords are the four letter words commands enabled on the nodes, the default ones if it's empty.
+	FourLetterWords string
+	// JavaHome is the Java runtime used to run the nodes, it's empty until one is selected.
+	JavaHome string
+
+	Nodes []ZookeeperNode
+}
+
+func (z Zookeeper) IsShared() bool {
+	return z.Name == sharedZookeeperName
+}
+
+// IsDedicatedTo returns true if the Zookeeper node was created for the cluster.
+func (z Zookeeper) IsDedicatedTo(name ClusterName) bool {
+	return z.Kind == zookeeperDedicated && z.Name == string(name)
+}
+
+func (z Zookeeper) IsEnsemble() bool {
+	return len(z.Nodes) > 1
+}
+
+// ConnectString returns the address of all nodes in the format expected by zookeeper.connect.
+func (z Zookeeper) ConnectString() string {
+	return strings.Join(z.Addrs(), ",")
+}
+
+func (z Zookeeper) Addrs() []string {
+	res := make([]string, len(z.Nodes))
+	for i, node := range z.Nodes {
+		res[i] = node.Addr.String()
+	}
+	return res
+}
+
+func (z Zookeeper) String() string {
+	return fmt.Sprintf("%s (%s, version %s)", z.Name, z.ConnectString(), z.Version)
+}
+
 //go:generate stringer -type=ClusterState -linecomment
 // type ClusterState int
 
@@ -49,30 +178,72 @@ func (c Cluster) String() string {
 // 	ClusterStarted                     // started
 // )
 
+type zookeeperNodeStatus struct {
+	process   processIdentity
+	zookeeper Zookeeper
+	node      ZookeeperNode
+}
+
+func (s zookeeperNodeStatus) IsValid() bool {
+	return s.process.pid > 0
+}
+
+func (s zookeeperNodeStatus) IsStarted() bool {
+	return s.IsValid() && s.process.State() == processRunning
+}
+
 type zookeeperStatus struct {
-	pid int
+	nodes []zookeeperNodeStatus
 }
 
-func (s zookeeperStatus) IsValid() bool {
-	return s.pid > 0
+func (z zookeeperStatus) String() string {
+	var builder strings.Builder
+
+	w := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	for _, s := range z.nodes {
+		switch s.process.State() {
+		case processRunning:
+			fmt.Fprintf(w, "Node %d\t%s\tpid:%d\t\n", s.node.ID, s.node.Addr.String(), s.process.pid)
+		case processMismatch:
+			fmt.Fprintf(w, "Node %d\t%s\tnot started (pid %d reused)\t\n", s.node.ID, s.node.Addr.String(), s.process.pid)
+		default:
+			fmt.Fprintf(w, "Node %d\t%s\tnot started\t\n", s.node.ID, s.node.Addr.String())
+		}
+	}
+
+	w.Flush()
+
+	return builder.String()
 }
 
-func (s zookeeperStatus) IsStarted() bool {
-	return s.IsValid() && pidExists(s.pid)
+func getZookeeperStatus(ctx context.Context, zookeeper Zookeeper) (zookeeperStatus, error) {
+	var status zookeeperStatus
+	for _, node := range zookeeper.Nodes {
+		tmp, err := getZookeeperNodeStatus(ctx, zookeeper, node)
+		if err != nil {
+			return zookeeperStatus{}, err
+		}
+
+		status.nodes = append(status.nodes, tmp)
+	}
+	return status, nil
 }
 
 type brokerStatus struct {
-	pid     int
+	process processIdentity
 	cluster Cluster
 	broker  Broker
+	// java is the Java runtime of a running broker, if it could be read.
+	java string
 }
 
 func (s brokerStatus) IsValid() bool {
-	return s.pid > 0
+	return s.process.pid > 0
 }
 
 func (s brokerStatus) IsStarted() bool {
-	return s.IsValid() && pidExists(s.pid)
+	return s.IsValid() && s.process.State() == processRunning
 }
 
 type clusterStatus struct {
@@ -85,10 +256,20 @@ func (c clusterStatus) String() string {
 	w := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', tabwriter.AlignRight)
 
 	for _, s := range c.brokers {
-		if s.IsStarted() {
-			fmt.Fprintf(w, "Broker %d started\tpid:%d\t\n", s.broker.ID, s.pid)
-		} else {
-			fmt.Fprintf(w, "Broker %d not started\t\t\n", s.broker.ID)
+		switch s.process.State() {
+		case processRunning:
+			var jmx, debug string
+			if s.broker.JMXPort > 0 {
+				jmx = fmt.Sprintf("jmx:%d", s.broker.JMXPort)
+			}
+			if agent, ok := parseDebugAgent(s.process.cmdline); ok {
+				debug = fmt.Sprintf("debug:%d", agent.port)
+			}
+			fmt.Fprintf(w, "Broker %d started\tpid:%d\t%s\t%s\t%s\t\n", s.broker.ID, s.process.pid, s.java, jmx, debug)
+		case processMismatch:
+			fmt.Fprintf(w, "Broker %d not started\t(pid %d reused)\t\t\t\t\n", s.broker.ID, s.process.pid)
+		default:
+			fmt.Fprintf(w, "Broker %d not started\t\t\t\t\t\n", s.broker.ID)
 		}
 	}
 
@@ -104,6 +285,11 @@ func getClusterStatus(ctx context.Context, cluster Cluster) (clusterStatus, erro
 		if err != nil {
 			return clusterStatus{}, err
 		}
+		if tmp.IsStarted() {
+			if runtime, err := readProcessJavaRuntime(tmp.process.pid); err == nil {
+				tmp.java = fmt.Sprintf("java:%s", runtime.version)
+			}
+		}
 
 		status.brokers = append(status.brokers, tmp)
 	}
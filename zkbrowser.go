@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// zkBrowser is a ZooKeeper client scoped to the prefix of a single cluster.
+//
+// Every path given to the browser is relative to the cluster's prefix, the same way
+// the brokers see it through their zookeeper.connect setting.
+type zkBrowser struct {
+	conn   *zk.Conn
+	prefix string
+}
+
+func newZkBrowser(cluster Cluster) (*zkBrowser, error) {
+	conn, _, err := zk.Connect(cluster.Zookeeper.Addrs(), 5*time.Second, zk.WithLogger(zkDiscardLogger{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zkBrowser{
+		conn:   conn,
+		prefix: "/" + string(cluster.Name),
+	}, nil
+}
+
+// zkDiscardLogger discards the logs of the Zookeeper client, errors are reported by each request anyway.
+type zkDiscardLogger struct{}
+
+func (zkDiscardLogger) Printf(string, ...interface{}) {}
+
+func (b *zkBrowser) Close() {
+	b.conn.Close()
+}
+
+// Run runs fn, which uses the browser, and gives up when ctx is done.
+//
+// NOTE(vincent): the Zookeeper client never gives up if Zookeeper is not reachable.
+// Closing the connection fails the pending request, so fn always returns.
+func (b *zkBrowser) Run(ctx context.Context, fn func() error) error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- fn()
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		b.Close()
+		return ctx.Err()
+	}
+}
+
+// fullPath returns the absolute path in ZooKeeper of a path relative to the cluster prefix.
+func (b *zkBrowser) fullPath(p string) string {
+	return path.Join(b.prefix, path.Clean("/"+p))
+}
+
+func (b *zkBrowser) List(w io.Writer, p string) error {
+	children, _, err := b.conn.Children(b.fullPath(p))
+	if err != nil {
+		return fmt.Errorf("unable to list %q. err: %w", p, err)
+	}
+
+	sort.Strings(children)
+	for _, child := range children {
+		fmt.Fprintln(w, child)
+	}
+
+	return nil
+}
+
+func (b *zkBrowser) Get(w io.Writer, p string) error {
+	data, _, err := b.conn.Get(b.fullPath(p))
+	if err != nil {
+		return fmt.Errorf("unable to get %q. err: %w", p, err)
+	}
+
+	return writeZnodeData(w, path.Clean("/"+p), data)
+}
+
+func (b *zkBrowser) Stat(w io.Writer, p string) error {
+	_, stat, err := b.conn.Get(b.fullPath(p))
+	if err != nil {
+		return fmt.Errorf("unable to stat %q. err: %w", p, err)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "cZxid\t0x%x\t\n", stat.Czxid)
+	fmt.Fprintf(tw, "ctime\t%s\t\n", zkTime(stat.Ctime))
+	fmt.Fprintf(tw, "mZxid\t0x%x\t\n", stat.Mzxid)
+	fmt.Fprintf(tw, "mtime\t%s\t\n", zkTime(stat.Mtime))
+	fmt.Fprintf(tw, "pZxid\t0x%x\t\n", stat.Pzxid)
+	fmt.Fprintf(tw, "cversion\t%d\t\n", stat.Cversion)
+	fmt.Fprintf(tw, "dataVersion\t%d\t\n", stat.Version)
+	fmt.Fprintf(tw, "aclVersion\t%d\t\n", stat.Aversion)
+	fmt.Fprintf(tw, "ephemeralOwner\t0x%x\t\n", stat.EphemeralOwner)
+	fmt.Fprintf(tw, "dataLength\t%d\t\n", stat.DataLength)
+	fmt.Fprintf(tw, "numChildren\t%d\t\n", stat.NumChildren)
+
+	return tw.Flush()
+}
+
+func (b *zkBrowser) Tree(w io.Writer, p string) error {
+	var walk func(p string, depth int) error
+	walk = func(p string, depth int) error {
+		children, _, err := b.conn.Children(b.fullPath(p))
+		if err != nil {
+			return fmt.Errorf("unable to list %q. err: %w", p, err)
+		}
+
+		sort.Strings(children)
+		for _, child := range children {
+			fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", depth), child)
+
+			if err := walk(path.Join(p, child), depth+1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	fmt.Fprintln(w, path.Clean("/"+p))
+
+	return walk(p, 1)
+}
+
+// Remove deletes a znode. If recursive is true all its children are deleted first.
+func (b *zkBrowser) Remove(p string, recursive bool) error {
+	if path.Clean("/"+p) == "/" {
+		return fmt.Errorf("refusing to remove the root of the cluster")
+	}
+
+	if recursive {
+		children, _, err := b.conn.Children(b.fullPath(p))
+		if err != nil {
+			return fmt.Errorf("unable to list %q. err: %w", p, err)
+		}
+
+		for _, child := range children {
+			if err := b.Remove(path.Join(p, child), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.conn.Delete(b.fullPath(p), -1); err != nil {
+		return fmt.Errorf("unable to remove %q. err: %w", p, err)
+	}
+
+	return nil
+}
+
+// Controller returns the id of the broker which is the controller of the cluster.
+func (b *zkBrowser) Controller() (int, error) {
+	data, _, err := b.conn.Get(b.fullPath("/controller"))
+	if err != nil {
+		return 0, err
+	}
+
+	var controller znodeController
+	if err := json.Unmarshal(data, &controller); err != nil {
+		return 0, err
+	}
+
+	return controller.BrokerID, nil
+}
+
+func zkTime(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).Format(time.RFC3339)
+}
+
+//
+// Decoding of the well-known Kafka znodes
+//
+
+var (
+	znodeBrokerIDPattern       = regexp.MustCompile(`^/brokers/ids/\d+$`)
+	znodeTopicPattern          = regexp.MustCompile(`^/brokers/topics/[^/]+$`)
+	znodePartitionStatePattern = regexp.MustCompile(`^/brokers/topics/[^/]+/partitions/\d+/state$`)
+)
+
+type znodeBroker struct {
+	Host      string   `json:"host"`
+	Port      int      `json:"port"`
+	Endpoints []string `json:"endpoints"`
+	JMXPort   int      `json:"jmx_port"`
+	Rack      string   `json:"rack"`
+	Timestamp string   `json:"timestamp"`
+}
+
+type znodeController struct {
+	BrokerID  int    `json:"brokerid"`
+	Timestamp string `json:"timestamp"`
+}
+
+type znodeTopic struct {
+	Partitions       map[string][]int `json:"partitions"`
+	AddingReplicas   map[string][]int `json:"adding_replicas"`
+	RemovingReplicas map[string][]int `json:"removing_replicas"`
+}
+
+type znodePartitionState struct {
+	Leader          int   `json:"leader"`
+	LeaderEpoch     int   `json:"leader_epoch"`
+	ControllerEpoch int   `json:"controller_epoch"`
+	ISR             []int `json:"isr"`
+}
+
+// writeZnodeData writes the data of the znode at p in a readable format.
+// Znodes that aren't known are written as is.
+func writeZnodeData(w io.Writer, p string, data []byte) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	var err error
+	switch {
+	case znodeBrokerIDPattern.MatchString(p):
+		var broker znodeBroker
+		if err = json.Unmarshal(data, &broker); err != nil {
+			break
+		}
+
+		fmt.Fprintf(tw, "Broker\t%s\t\n", path.Base(p))
+		fmt.Fprintf(tw, "Host\t%s:%d\t\n", broker.Host, broker.Port)
+		for _, endpoint := range broker.Endpoints {
+			fmt.Fprintf(tw, "Endpoint\t%s\t\n", endpoint)
+		}
+		if broker.JMXPort > 0 {
+			fmt.Fprintf(tw, "JMX port\t%d\t\n", broker.JMXPort)
+		}
+		if broker.Rack != "" {
+			fmt.Fprintf(tw, "Rack\t%s\t\n", broker.Rack)
+		}
+		fmt.Fprintf(tw, "Registered at\t%s\t\n", kafkaTimestamp(broker.Timestamp))
+
+	case p == "/controller":
+		var controller znodeController
+		if err = json.Unmarshal(data, &controller); err != nil {
+			break
+		}
+
+		fmt.Fprintf(tw, "Controller\tbroker %d\t\n", controller.BrokerID)
+		fmt.Fprintf(tw, "Elected at\t%s\t\n", kafkaTimestamp(controller.Timestamp))
+
+	case znodeTopicPattern.MatchString(p):
+		var topic znodeTopic
+		if err = json.Unmarshal(data, &topic); err != nil {
+			break
+		}
+
+		fmt.Fprintf(tw, "Topic\t%s\t\n", path.Base(p))
+		for _, partition := range sortedPartitions(topic.Partitions) {
+			fmt.Fprintf(tw, "Partition %s\treplicas:%s\t\n", partition, joinInts(topic.Partitions[partition]))
+		}
+		for _, partition := range sortedPartitions(topic.AddingReplicas) {
+			fmt.Fprintf(tw, "Partition %s\tadding:%s\t\n", partition, joinInts(topic.AddingReplicas[partition]))
+		}
+		for _, partition := range sortedPartitions(topic.RemovingReplicas) {
+			fmt.Fprintf(tw, "Partition %s\tremoving:%s\t\n", partition, joinInts(topic.RemovingReplicas[partition]))
+		}
+
+	case znodePartitionStatePattern.MatchString(p):
+		var state znodePartitionState
+		if err = json.Unmarshal(data, &state); err != nil {
+			break
+		}
+
+		fmt.Fprintf(tw, "Leader\t%d\t\n", state.Leader)
+		fmt.Fprintf(tw, "Leader epoch\t%d\t\n", state.LeaderEpoch)
+		fmt.Fprintf(tw, "ISR\t%s\t\n", joinInts(state.ISR))
+		fmt.Fprintf(tw, "Controller epoch\t%d\t\n", state.ControllerEpoch)
+
+	default:
+		_, err := fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	// Not the format we expected: fall back to the raw data.
+	if err != nil {
+		_, err := fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	return tw.Flush()
+}
+
+// kafkaTimestamp formats a timestamp in milliseconds as stored by Kafka in its znodes.
+func kafkaTimestamp(s string) string {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return s
+	}
+	return zkTime(ms)
+}
+
+func sortedPartitions(m map[string][]int) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, _ := strconv.Atoi(res[i])
+		b, _ := strconv.Atoi(res[j])
+		return a < b
+	})
+
+	return res
+}
+
+func joinInts(l []int) string {
+	tmp := make([]string, len(l))
+	for i, v := range l {
+		tmp[i] = strconv.Itoa(v)
+	}
+	return strings.Join(tmp, ",")
+}
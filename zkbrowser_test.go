@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// collapseSpaces replaces the padding of the columns of each line by a single space.
+func collapseSpaces(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestWriteZnodeData(t *testing.T) {
+	timestamp := zkTime(1600000000000)
+
+	testCases := []struct {
+		path string
+		data string
+		exp  string
+	}{
+		{
+			path: "/brokers/ids/1",
+			data: `{"listener_security_protocol_map":{"PLAINTEXT":"PLAINTEXT"},"endpoints":["PLAINTEXT://127.0.0.1:9092"],"jmx_port":9999,"host":"127.0.0.1","timestamp":"1600000000000","port":9092,"version":4}`,
+			exp: `Broker 1
+Host 127.0.0.1:9092
+Endpoint PLAINTEXT://127.0.0.1:9092
+JMX port 9999
+Registered at ` + timestamp,
+		},
+		{
+			path: "/controller",
+			data: `{"version":1,"brokerid":2,"timestamp":"1600000000000"}`,
+			exp: `Controller broker 2
+Elected at ` + timestamp,
+		},
+		{
+			path: "/brokers/topics/foo",
+			data: `{"version":2,"partitions":{"10":[1,2],"2":[2,3],"0":[3,1]},"adding_replicas":{"2":[3]},"removing_replicas":{}}`,
+			exp: `Topic foo
+Partition 0 replicas:3,1
+Partition 2 replicas:2,3
+Partition 10 replicas:1,2
+Partition 2 adding:3`,
+		},
+		{
+			path: "/brokers/topics/foo/partitions/0/state",
+			data: `{"controller_epoch":3,"leader":1,"version":1,"leader_epoch":7,"isr":[1,2]}`,
+			exp: `Leader 1
+Leader epoch 7
+ISR 1,2
+Controller epoch 3`,
+		},
+		// Unknown znodes and data which can't be decoded are written as is.
+		{
+			path: "/cluster/id",
+			data: `{"version":"1","id":"abc"}`,
+			exp:  `{"version":"1","id":"abc"}`,
+		},
+		{
+			path: "/controller",
+			data: "not json",
+			exp:  "not json",
+		},
+	}
+
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		if err := writeZnodeData(&buf, tc.path, []byte(tc.data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := collapseSpaces(buf.String()); got != tc.exp {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tc.path, tc.exp, got)
+		}
+	}
+}
@@ -3,14 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
-	"syscall"
+	"strings"
 	"text/template"
+	"time"
 )
 
-const zookeeperVersion = "3.6.2"
+// defaultZookeeperVersion is the version used when none is provided.
+const defaultZookeeperVersion = "3.6.2"
+
+// defaultZk4lwWhitelist are the four letter words commands enabled on a Zookeeper node when none are configured.
+const defaultZk4lwWhitelist = "srvr,stat,ruok,mntr,conf,cons,envi"
 
 func makeZookeeperExtractedPath(version string) string {
 	return filepath.Join(dataDir, "zookeeper_"+version)
@@ -19,91 +26,196 @@ func makeZookeeperTarballPath(version string) string {
 	return filepath.Join(cacheDir, fmt.Sprintf("zookeeper-%s.tar.gz", version))
 }
 
-// downloadZookeeperArchive downloads a Zookeeper tarball if it doesn't exist.
-func downloadZookeeperArchive() error {
-	// 1. check if it's already downloaded.
-	// If it is we don't have to do anything.
+// makeZookeeperDir returns the directory containing the nodes of a Zookeeper ensemble.
+func makeZookeeperDir(zookeeper Zookeeper) string {
+	return filepath.Join(dataDir, "zookeeper", zookeeper.Name)
+}
 
-	p := makeZookeeperTarballPath(zookeeperVersion)
+// makeZookeeperNodeDir returns the directory containing the configuration and logs of a Zookeeper node.
+func makeZookeeperNodeDir(zookeeper Zookeeper, node ZookeeperNode) string {
+	return filepath.Join(makeZookeeperDir(zookeeper), fmt.Sprintf("node%d", node.ID))
+}
 
-	fi, err := os.Stat(p)
-	switch {
-	case err != nil && !os.IsNotExist(err):
-		return err
-	case err == nil && fi.IsDir():
-		return fmt.Errorf("path %q is a directory, can't extract it", p)
-	case err == nil:
-		return nil
+func makeZookeeperLogPath(zookeeper Zookeeper, node ZookeeperNode) string {
+	return filepath.Join(makeZookeeperNodeDir(zookeeper, node), "zookeeper.log")
+}
+
+// validateZookeeperVersion checks a Zookeeper version is a release published by Apache.
+// NOTE(vincent): the version is part of the paths of the distribution, it must never be used before being validated.
+func validateZookeeperVersion(version string) error {
+	if !releasePattern.MatchString(version) {
+		return fmt.Errorf("invalid Zookeeper version %q, must be a release like %s", version, defaultZookeeperVersion)
+	}
+
+	versions, err := loadZookeeperVersions(false)
+	if err != nil {
+		return fmt.Errorf("unable to load the catalog of Zookeeper versions. err: %w", err)
+	}
+	if !containsString(versions, version) {
+		return fmt.Errorf("unknown Zookeeper version %q, use \"kcm versions -available -zk\" to list the versions available", version)
+	}
+
+	return nil
+}
+
+// makeZookeeperArchiveName returns the name of the tarball of a Zookeeper version on the mirrors.
+// The binary tarballs are named apache-zookeeper-<version>-bin.tar.gz since 3.5, the tarballs of 3.4 contain both the sources and the binaries.
+func makeZookeeperArchiveName(version string) string {
+	if compareVersions(version, "3.5") < 0 {
+		return fmt.Sprintf("zookeeper-%s.tar.gz", version)
+	}
+	return fmt.Sprintf("apache-zookeeper-%s-bin.tar.gz", version)
+}
+
+// makeZookeeperClasspath returns the class path of a Zookeeper version, which must be installed.
+// The jar of Zookeeper 3.4 is at the root of the distribution instead of in lib.
+func makeZookeeperClasspath(version string) (string, error) {
+	extractedPath := makeZookeeperExtractedPath(version)
+
+	cp, err := constructClasspath(filepath.Join(extractedPath, "lib"))
+	if err != nil {
+		return "", err
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(extractedPath, "zookeeper-*.jar")); len(matches) > 0 {
+		cp = strings.Join(append(matches, cp), ":")
 	}
 
-	// 2. doesn't exist, download the tarball
+	return cp, nil
+}
+
+// downloadZookeeperArchive downloads a Zookeeper tarball if it doesn't exist.
+func downloadZookeeperArchive(version string) error {
+	filename := fmt.Sprintf("/zookeeper/zookeeper-%s/%s", version, makeZookeeperArchiveName(version))
 
-	filename := fmt.Sprintf("/zookeeper/zookeeper-%s/apache-zookeeper-%s-bin.tar.gz", zookeeperVersion, zookeeperVersion)
+	dst := makeZookeeperTarballPath(version)
 
-	return downloadFromApacheCloser(p, filename)
+	return downloadArtifact(dst, makeZookeeperExtractedPath(version), func(d *downloader) error {
+		return d.Download(dst, filename)
+	})
 }
 
 // extractZookeeperArchive extracts the Zookeeper tarball to the kcm data directory.
 // This assumes the tarball exists.
-func extractZookeeperArchive() error {
+func extractZookeeperArchive(version string) error {
 	// 1. check if it's already extracted.
 	// If it is we don't have to do anything.
 
-	p := makeZookeeperExtractedPath(zookeeperVersion)
+	p := makeZookeeperExtractedPath(version)
 
 	fi, err := os.Stat(p)
 	switch {
 	case err != nil && !os.IsNotExist(err):
 		return err
 	case err == nil && !fi.IsDir():
-		return fmt.Errorf("path %q is not a directory, can't extract archive %s", p, zookeeperVersion)
+		return fmt.Errorf("path %q is not a directory, can't extract archive %s", p, version)
 	case err == nil:
 		return nil
 	}
 
 	// 2. doesn't exist, extract the tarball
 
-	return extractTarball(p, makeZookeeperTarballPath(zookeeperVersion))
+	return extractTarball(p, makeZookeeperTarballPath(version))
 }
 
-func writeZookeeperLog4jConfig() error {
-	const tpl = `zookeeper.root.logger=INFO, F
+// installZookeeper downloads and extracts Zookeeper if necessary.
+func installZookeeper(version string) error {
+	lock, err := acquireLock(makeArtifactLockName(makeZookeeperExtractedPath(version)))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if err := downloadZookeeperArchive(version); err != nil {
+		return fmt.Errorf("unable to download zookeeper archive. err: %w", err)
+	}
+	if err := extractZookeeperArchive(version); err != nil {
+		return fmt.Errorf("unable to extract zookeeper archive. err: %w", err)
+	}
+
+	return nil
+}
+
+// zookeeperLoggingTemplates are the templates of the logging config of the Zookeeper nodes, by logging backend.
+var zookeeperLoggingTemplates = map[loggingBackend]string{
+	loggingLog4j: `zookeeper.root.logger=INFO, F
 log4j.rootLogger=${zookeeper.root.logger}
 log4j.appender.F=org.apache.log4j.FileAppender
 log4j.appender.F.file={{ .LogFile }}
 log4j.appender.F.layout=org.apache.log4j.PatternLayout
-log4j.appender.F.layout.ConversionPattern=%d{ISO8601} [myid:%X{myid}] - %-5p [%t:%C{1}@%L] - %m%n`
+log4j.appender.F.layout.ConversionPattern=%d{ISO8601} [myid:%X{myid}] - %-5p [%t:%C{1}@%L] - %m%n`,
+	loggingLogback: `<configuration>
+  <appender name="F" class="ch.qos.logback.core.FileAppender">
+    <file>{{ .LogFile }}</file>
+    <encoder>
+      <pattern>%d{ISO8601} [myid:%X{myid}] - %-5p [%t:%C{1}@%L] - %m%n</pattern>
+    </encoder>
+  </appender>
+  <root level="INFO">
+    <appender-ref ref="F" />
+  </root>
+</configuration>
+`,
+}
+
+// writeZookeeperLoggingConfig writes the logging config of a Zookeeper node for the logging backend of its distribution and returns its path.
+func writeZookeeperLoggingConfig(zookeeper Zookeeper, node ZookeeperNode, backend loggingBackend) (string, error) {
+	tpl, ok := zookeeperLoggingTemplates[backend]
+	if !ok {
+		return "", fmt.Errorf("the logging backend %s of the Zookeeper distribution isn't supported", backend)
+	}
 
 	tmpl, err := template.New("root").Parse(tpl)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	//
 
-	path := makeZookeeperExtractedPath(zookeeperVersion)
-
-	p := filepath.Join(path, "conf/log4j.properties")
+	p := filepath.Join(makeZookeeperNodeDir(zookeeper, node), backend.ConfigFile())
 	f, err := os.Create(p)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer f.Close()
 
 	//
 
 	data := struct {
 		LogFile string
 	}{
-		LogFile: filepath.Join(dataDir, "zookeeper.log"),
+		LogFile: makeZookeeperLogPath(zookeeper, node),
+	}
+
+	if err := tmpl.Execute(f, data); err != nil {
+		return "", err
 	}
 
-	return tmpl.Execute(f, data)
+	return p, nil
 }
 
-func writeZookeeperConfig() error {
-	const tpl = `clientPort={{ .Port }}
+func writeZookeeperConfig(zookeeper Zookeeper, node ZookeeperNode) error {
+	// NOTE(vincent): the kcm.* comments are not used by Zookeeper, they allow kcm to rebuild its database from the config files.
+
+	const tpl = `# Generated by kcm
+# kcm.zookeeper.path={{ .ZookeeperPath }}
+# kcm.zookeeper.kind={{ .Kind }}
+tickTime=2000
+initLimit=10
+syncLimit=5
+clientPort={{ .Port }}
 clientPortAddress={{ .Host }}
-dataDir={{ .DataDir }}`
+dataDir={{ .DataDir }}
+admin.enableServer={{ .AdminServer }}
+{{- if .AdminServer }}
+admin.serverAddress={{ .Host }}
+admin.serverPort={{ .AdminPort }}
+{{- end }}
+4lw.commands.whitelist={{ .FourLetterWords }}
+{{- range .Servers }}
+server.{{ .ID }}={{ .Addr.IP }}:{{ .PeerPort }}:{{ .ElectionPort }}
+{{- end }}
+`
 
 	tmpl, err := template.New("root").Parse(tpl)
 	if err != nil {
@@ -112,9 +224,12 @@ dataDir={{ .DataDir }}`
 
 	//
 
-	path := makeZookeeperExtractedPath(zookeeperVersion)
+	path := makeZookeeperNodeDir(zookeeper, node)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
 
-	p := filepath.Join(path, "conf/zoo.cfg")
+	p := filepath.Join(path, "zoo.cfg")
 	f, err := os.Create(p)
 	if err != nil {
 		return err
@@ -122,97 +237,239 @@ dataDir={{ .DataDir }}`
 
 	//
 
-	host, port, err := net.SplitHostPort(*globalZkAddr)
-	if err != nil {
+	data := struct {
+		ZookeeperPath   string
+		Kind            ZookeeperKind
+		Port            int
+		Host            string
+		DataDir         string
+		AdminServer     bool
+		AdminPort       int
+		FourLetterWords string
+		Servers         []ZookeeperNode
+	}{
+		ZookeeperPath:   makeZookeeperExtractedPath(zookeeper.Version),
+		Kind:            zookeeper.Kind,
+		Port:            node.Addr.Port,
+		Host:            node.Addr.IP.String(),
+		DataDir:         node.DataDir,
+		AdminServer:     node.AdminPort > 0,
+		AdminPort:       node.AdminPort,
+		FourLetterWords: orDefault(zookeeper.FourLetterWords, defaultZk4lwWhitelist),
+	}
+
+	// A standalone node doesn't need to know about its peers.
+	if zookeeper.IsEnsemble() {
+		data.Servers = zookeeper.Nodes
+	}
+
+	if err := tmpl.Execute(f, data); err != nil {
 		return err
 	}
 
-	data := struct {
-		Port    string
-		Host    string
-		DataDir string
-	}{
-		Port:    port,
-		Host:    host,
-		DataDir: filepath.Join(dataDir, "zkdata"),
+	// Each member of an ensemble is identified by the myid file in its data directory.
+
+	if !zookeeper.IsEnsemble() {
+		return nil
+	}
+
+	if err := os.MkdirAll(node.DataDir, 0755); err != nil {
+		return err
 	}
 
-	return tmpl.Execute(f, data)
+	return ioutil.WriteFile(filepath.Join(node.DataDir, "myid"), []byte(fmt.Sprintf("%d\n", node.ID)), 0644)
 }
 
-func startZookeeper(ctx context.Context) error {
-	// 1. check if zookeeper is already started
+// prepareZookeeper downloads and extracts the version of a Zookeeper ensemble and finds its Java runtime.
+// It returns the ensemble with its Java runtime.
+//
+// NOTE(vincent): this is done before taking the Zookeeper lock, the download can be long and finding
+// the Java runtimes can run java -version.
+func prepareZookeeper(ctx context.Context, zookeeper Zookeeper) (Zookeeper, error) {
+	if err := installZookeeper(zookeeper.Version); err != nil {
+		return zookeeper, err
+	}
 
-	status, err := getZookeeperStatus(ctx)
+	javaHome, err := resolveZookeeperJava(ctx, zookeeper)
 	if err != nil {
-		return fmt.Errorf("unable to get zookeeper pid. err: %w", err)
+		return zookeeper, err
 	}
-	if status.IsStarted() {
-		return nil
+	zookeeper.JavaHome = javaHome
+
+	return zookeeper, nil
+}
+
+// startZookeeperNodes starts nodes of a Zookeeper ensemble.
+func startZookeeperNodes(ctx context.Context, zookeeper Zookeeper, nodes []ZookeeperNode) error {
+	zookeeper, err := prepareZookeeper(ctx, zookeeper)
+	if err != nil {
+		return err
 	}
 
-	// 2. no pid or it isn't started, update the zookeeper status.
+	lock, err := acquireLock(zookeeperLockName)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
 
-	if err := removeZookeeperStatus(ctx); err != nil {
-		return fmt.Errorf("unable to update zookeeper status. err: %w", err)
+	for _, node := range nodes {
+		if err := startZookeeperNode(ctx, zookeeper, node); err != nil {
+			return err
+		}
 	}
 
-	// 3. download and extract zookeeper if necessary
+	return nil
+}
+
+// startZookeeperNode starts a node if it's not already started.
+//
+// The ensemble must be prepared with prepareZookeeper and the caller must hold the Zookeeper lock,
+// it makes sure another kcm command doesn't launch the node between the check and the launch.
+func startZookeeperNode(ctx context.Context, zookeeper Zookeeper, node ZookeeperNode) error {
+	// 1. check if the node is already started
 
-	if err := downloadZookeeperArchive(); err != nil {
-		return fmt.Errorf("unable to download zookeeper archive. err: %w", err)
+	status, err := getZookeeperNodeStatus(ctx, zookeeper, node)
+	if err != nil {
+		return fmt.Errorf("unable to get zookeeper pid. err: %w", err)
 	}
-	if err := extractZookeeperArchive(); err != nil {
-		return fmt.Errorf("unable to extract zookeeper archive. err: %w", err)
+	if status.IsStarted() {
+		return nil
+	}
+
+	// 2. no pid or it isn't started, update the node status.
+
+	if err := removeZookeeperNodeStatus(ctx, zookeeper, node); err != nil {
+		return fmt.Errorf("unable to update zookeeper node %d status. err: %w", node.ID, err)
 	}
 
-	// 4. write the zookeeper configuration files
+	// 3. write the zookeeper configuration files
 
-	if err := writeZookeeperConfig(); err != nil {
+	if err := writeZookeeperConfig(zookeeper, node); err != nil {
 		return fmt.Errorf("unable to write zookeeper config. err: %w", err)
 	}
-	if err := writeZookeeperLog4jConfig(); err != nil {
-		return fmt.Errorf("unable to write zookeeper log4j config. err: %w", err)
+	backend, err := detectZookeeperLoggingBackend(zookeeper)
+	if err != nil {
+		return err
+	}
+	loggingConfig, err := writeZookeeperLoggingConfig(zookeeper, node, backend)
+	if err != nil {
+		return fmt.Errorf("unable to write zookeeper %s config. err: %w", backend, err)
 	}
 
-	// 5. prepare the command line to run zookeeper.
+	// 4. prepare the command line to run zookeeper.
 	// NOTE(vincent): we don't use the provided shell script, instead we build the proper command line ourselves.
 
-	extractedPath := makeZookeeperExtractedPath(zookeeperVersion)
+	extractedPath := makeZookeeperExtractedPath(zookeeper.Version)
+	configPath := makeZookeeperNodeDir(zookeeper, node)
 
-	cp, err := constructClasspath(filepath.Join(extractedPath, "lib"))
+	cp, err := makeZookeeperClasspath(zookeeper.Version)
 	if err != nil {
 		return err
 	}
 
-	// 6. finally run the command. This doesn't block.
+	// 5. finally run the command. This doesn't block.
+	// The process marker is only used to identify the process later.
 
-	bg, err := runBackgroundCommand(ctx, extractedPath,
-		getJavaBinary(), "-Xmx128m", "-cp", cp,
-		fmt.Sprintf("-Dlog4j.configuration=file://%s/conf/log4j.properties", extractedPath),
+	marker := makeZookeeperProcessMarker(zookeeper, node)
+
+	bg, err := runBackgroundCommand(ctx, extractedPath, nil, configPath,
+		filepath.Join(zookeeper.JavaHome, "bin", "java"), "-Xmx128m", "-cp", cp,
+		backend.JVMProperty(loggingConfig),
+		marker,
 		"org.apache.zookeeper.server.quorum.QuorumPeerMain",
-		filepath.Join(extractedPath, "conf/zoo.cfg"),
+		filepath.Join(configPath, "zoo.cfg"),
 	)
 	if err != nil {
 		return err
 	}
+	bg.process.marker = marker
 
-	// 7. update the zookeeper status
+	// 6. update the node status
 
-	status = zookeeperStatus{
-		pid: bg.pid,
+	status = zookeeperNodeStatus{
+		process:   bg.process,
+		zookeeper: zookeeper,
+		node:      node,
 	}
 
-	if err := setZookeeperStatus(ctx, status); err != nil {
+	if err := setZookeeperNodeStatus(ctx, status); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// stopOptions controls how a process is stopped.
+type stopOptions struct {
+	// force stops a process even if others depend on it.
+	force bool
+	// timeout is the time to wait for a process to terminate before killing it.
+	timeout time.Duration
+}
+
+// checkZookeeperNotInUse returns an error if a cluster using the Zookeeper node has a broker started.
+func checkZookeeperNotInUse(ctx context.Context, zookeeper Zookeeper) error {
+	clusters, err := searchClusters(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range clusters {
+		if cluster.Zookeeper.ID != zookeeper.ID {
+			continue
+		}
+
+		status, err := getClusterStatus(ctx, cluster)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status.brokers {
+			if s.IsStarted() {
+				return fmt.Errorf("zookeeper %q is used by the running cluster %q, stop it first or use -force", zookeeper.Name, cluster.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stopZookeeper stops all nodes of a Zookeeper ensemble.
+// Unless forced it refuses to do so if a cluster using it is running.
+func stopZookeeper(ctx context.Context, zookeeper Zookeeper, opts stopOptions) error {
+	return stopZookeeperNodes(ctx, zookeeper, zookeeper.Nodes, opts)
+}
+
+// stopZookeeperNodes stops some nodes of a Zookeeper ensemble.
+// Unless forced it refuses to do so if a cluster using it is running.
+func stopZookeeperNodes(ctx context.Context, zookeeper Zookeeper, nodes []ZookeeperNode, opts stopOptions) error {
+	// NOTE(vincent): the lock makes sure another kcm command doesn't start using the nodes between the check and the stop.
+
+	lock, err := acquireLock(zookeeperLockName)
+	if err != nil {
 		return err
 	}
+	defer lock.Release()
+
+	if !opts.force {
+		if err := checkZookeeperNotInUse(ctx, zookeeper); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range nodes {
+		if err := stopZookeeperNode(ctx, zookeeper, node, opts); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func stopZookeeper(ctx context.Context) error {
-	// 1. check if zookeeper is started
-	status, err := getZookeeperStatus(ctx)
+// stopZookeeperNode stops a node, the Zookeeper lock must be held.
+func stopZookeeperNode(ctx context.Context, zookeeper Zookeeper, node ZookeeperNode, opts stopOptions) error {
+	// 1. check if the node is started
+	status, err := getZookeeperNodeStatus(ctx, zookeeper, node)
 	if err != nil {
 		return fmt.Errorf("unable to get zookeeper pid. err: %w", err)
 	}
@@ -223,15 +480,115 @@ func stopZookeeper(ctx context.Context) error {
 		return nil
 	}
 
-	// 2. terminate zookeeper
-	if err := syscall.Kill(status.pid, syscall.Signal(15)); err != nil {
-		return fmt.Errorf("unable to send interrupt signal to zookeeper. err: %w", err)
+	// 2. terminate the node and wait for it to exit
+	killed, err := terminateProcess(status.process.pid, opts.timeout)
+	if err != nil {
+		return fmt.Errorf("unable to stop zookeeper node %d. err: %w", node.ID, err)
+	}
+	if killed {
+		log.Printf("zookeeper node %d killed after %s", node.ID, opts.timeout)
 	}
 
 	// 3. remove its status
-	if err := removeZookeeperStatus(ctx); err != nil {
+	if err := removeZookeeperNodeStatus(ctx, zookeeper, node); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func removeZookeeperData(zookeeper Zookeeper) error {
+	for _, node := range zookeeper.Nodes {
+		log.Printf("removing data dir %s", node.DataDir)
+		if err := os.RemoveAll(node.DataDir); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(makeZookeeperDir(zookeeper))
+}
+
+// newZookeeper returns a Zookeeper ensemble with the number of nodes provided.
+//
+// Each node gets the first free client port after the default Zookeeper port; members of an ensemble
+// also get a peer and an election port.
+func newZookeeper(ctx context.Context, name string, kind ZookeeperKind, version string, nodes int) (Zookeeper, error) {
+	// Don't reuse a port already attributed even if it's not currently in use.
+
+	used, err := listUsedPorts(ctx)
+	if err != nil {
+		return Zookeeper{}, err
+	}
+
+	allocate := func(start int) (int, error) {
+		port, err := findFreePort("127.0.0.1", start, used)
+		if err != nil {
+			return 0, err
+		}
+		used[port] = true
+
+		return port, nil
+	}
+
+	res := Zookeeper{
+		Name:            name,
+		Kind:            kind,
+		Version:         version,
+		FourLetterWords: *globalZk4lwWhitelist,
+	}
+
+	for i := 0; i < nodes; i++ {
+		node := ZookeeperNode{ID: i + 1}
+
+		port, err := allocate(2182)
+		if err != nil {
+			return Zookeeper{}, err
+		}
+		node.Addr = net.TCPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: port,
+		}
+
+		if nodes > 1 {
+			if node.PeerPort, err = allocate(2888); err != nil {
+				return Zookeeper{}, err
+			}
+			if node.ElectionPort, err = allocate(3888); err != nil {
+				return Zookeeper{}, err
+			}
+		}
+
+		res.Nodes = append(res.Nodes, node)
+	}
+
+	for i := range res.Nodes {
+		res.Nodes[i].DataDir = filepath.Join(makeZookeeperNodeDir(res, res.Nodes[i]), "data")
+	}
+
+	if err := allocateZookeeperAdminPorts(res.Nodes, used); err != nil {
+		return Zookeeper{}, err
+	}
+
+	return res, nil
+}
+
+// allocateZookeeperAdminPorts sets the AdminServer port of each node to the first free port after the one provided by -zk-admin-port.
+//
+// NOTE(vincent): the AdminServer listens on 8080 by default which is likely already used, so it's disabled unless a port is provided.
+func allocateZookeeperAdminPorts(nodes []ZookeeperNode, used map[int]bool) error {
+	if *globalZkAdminPort <= 0 {
+		return nil
+	}
+
+	for i := range nodes {
+		port, err := findFreePort(nodes[i].Addr.IP.String(), *globalZkAdminPort, used)
+		if err != nil {
+			return err
+		}
+		used[port] = true
+
+		nodes[i].AdminPort = port
+	}
+
+	return nil
+}